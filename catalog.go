@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// catalogNamespace is the Store namespace the catalog entries are written under.
+const catalogNamespace = "_catalog"
+
+// FileMeta describes a file held by a node, either a file the
+// node stored itself or a replica of a file owned by another node.
+type FileMeta struct {
+	// Key is the original key the file was stored with.
+	Key string
+	// Hash is the hex encoded SHA-256 of the file contents.
+	Hash    string
+	Size    int64
+	Created time.Time
+	// Owner is the ServerID of the node that stored the file.
+	Owner string
+	// Replicas are the peers the owner streamed the manifest to.
+	Replicas []string
+	// Chunks is the manifest of the file, the chunks its contents are
+	// split into in order. It is empty for files stored whole.
+	Chunks []ChunkRef
+}
+
+// ChunkRef refers to a chunk of a file.
+type ChunkRef struct {
+	// Hash is the hex encoded SHA-256 of the chunk.
+	Hash string
+	Size int64
+}
+
+// Catalog is a per node index of the files it holds. It maps the
+// original keys, that CASPathTransformFunc hashes away, to their
+// metadata. Every entry is persisted as an object in the Store.
+// It also counts the entries referencing every chunk.
+type Catalog struct {
+	lock    sync.RWMutex
+	store   *Store
+	entries map[string]FileMeta
+	refs    map[string]int
+}
+
+// NewCatalog returns a Catalog loaded from the entries in store.
+func NewCatalog(store *Store) (*Catalog, error) {
+	c := &Catalog{
+		store:   store,
+		entries: make(map[string]FileMeta),
+		refs:    make(map[string]int),
+	}
+	err := store.Walk(catalogNamespace, func(path string, d fs.DirEntry) error {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var meta FileMeta
+		if err := json.Unmarshal(b, &meta); err != nil {
+			log.Printf("(%s): skipping corrupt catalog entry (%s): %s", store.StorageFolder, path, err)
+			return nil
+		}
+		c.entries[catalogKey(meta.Owner, hashKey(meta.Key))] = meta
+		c.ref(meta, 1)
+		return nil
+	})
+	return c, err
+}
+
+// catalogKey returns the key of the entry for the file
+// stored by owner under the hashed key fileKey.
+func catalogKey(owner, fileKey string) string {
+	return hashKey(owner + "/" + fileKey)
+}
+
+// Put adds or replaces the entry of a file.
+func (c *Catalog) Put(meta FileMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	entryKey := catalogKey(meta.Owner, hashKey(meta.Key))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, err := c.store.Write(catalogNamespace, entryKey, bytes.NewReader(b)); err != nil {
+		return err
+	}
+	if old, ok := c.entries[entryKey]; ok {
+		c.ref(old, -1)
+	}
+	c.entries[entryKey] = meta
+	c.ref(meta, 1)
+	return nil
+}
+
+// ref adds n to the reference count of every chunk of meta.
+func (c *Catalog) ref(meta FileMeta, n int) {
+	for _, chunk := range meta.Chunks {
+		key := meta.Owner + "/" + chunk.Hash
+		c.refs[key] += n
+		if c.refs[key] <= 0 {
+			delete(c.refs, key)
+		}
+	}
+}
+
+// Referenced reports whether an entry of owner references the chunk hash.
+func (c *Catalog) Referenced(owner, hash string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.refs[owner+"/"+hash] > 0
+}
+
+// StoredBefore reports whether a file of owner created before t
+// references the chunk hash.
+func (c *Catalog) StoredBefore(owner, hash string, t time.Time) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for _, meta := range c.entries {
+		if meta.Owner != owner || !meta.Created.Before(t) {
+			continue
+		}
+		for _, chunk := range meta.Chunks {
+			if chunk.Hash == hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ChunkSize returns the size of the chunk hash of owner, as recorded
+// by the manifest of a file referencing it.
+func (c *Catalog) ChunkSize(owner, hash string) (int64, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.refs[owner+"/"+hash] == 0 {
+		return 0, false
+	}
+	for _, meta := range c.entries {
+		if meta.Owner != owner {
+			continue
+		}
+		for _, chunk := range meta.Chunks {
+			if chunk.Hash == hash {
+				return chunk.Size, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Get returns the entry of the file stored by owner under key.
+func (c *Catalog) Get(owner, key string) (FileMeta, bool) {
+	return c.get(owner, hashKey(key))
+}
+
+// get returns the entry of the file stored by owner under the hashed key fileKey.
+func (c *Catalog) get(owner, fileKey string) (FileMeta, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	meta, ok := c.entries[catalogKey(owner, fileKey)]
+	return meta, ok
+}
+
+// Remove removes the entry of the file stored by
+// owner under the hashed key fileKey, if there is one.
+func (c *Catalog) Remove(owner, fileKey string) error {
+	entryKey := catalogKey(owner, fileKey)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	meta, ok := c.entries[entryKey]
+	if !ok {
+		return nil
+	}
+	delete(c.entries, entryKey)
+	c.ref(meta, -1)
+	return c.store.Delete(catalogNamespace, entryKey)
+}
+
+// List returns the entries whose key starts with prefix, sorted by key.
+func (c *Catalog) List(prefix string) []FileMeta {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	metas := []FileMeta{}
+	for _, meta := range c.entries {
+		if strings.HasPrefix(meta.Key, prefix) {
+			metas = append(metas, meta)
+		}
+	}
+	sort.Slice(metas, func(i, j int) bool {
+		if metas[i].Key == metas[j].Key {
+			return metas[i].Owner < metas[j].Owner
+		}
+		return metas[i].Key < metas[j].Key
+	})
+	return metas
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCatalogPersistsEntries(t *testing.T) {
+	store := NewStore(StoreOpts{
+		StorageFolder:     t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+	c, err := NewCatalog(store)
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.Put(FileMeta{Key: "photos/cat.png", Owner: "a", Size: 3}))
+	assert.Nil(t, c.Put(FileMeta{Key: "photos/dog.png", Owner: "a", Size: 4}))
+	assert.Nil(t, c.Put(FileMeta{Key: "notes.txt", Owner: "b", Size: 5}))
+
+	c, err = NewCatalog(store)
+	assert.Nil(t, err)
+	metas := c.List("photos/")
+	assert.Len(t, metas, 2)
+	assert.Equal(t, "photos/cat.png", metas[0].Key)
+	assert.Len(t, c.List(""), 3)
+
+	meta, ok := c.Get("b", "notes.txt")
+	assert.True(t, ok)
+	assert.EqualValues(t, 5, meta.Size)
+	_, ok = c.Get("a", "notes.txt")
+	assert.False(t, ok)
+
+	assert.Nil(t, c.Remove("a", hashKey("photos/cat.png")))
+	c, err = NewCatalog(store)
+	assert.Nil(t, err)
+	assert.Len(t, c.List("photos/"), 1)
+}
+
+func TestFileServerStatAndList(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s1, 1)
+	waitForPeers(t, s2, 1)
+
+	assert.Nil(t, s2.Store("docs/a.txt", bytes.NewReader([]byte("hello")), ConsistencyOne))
+
+	meta, err := s2.Stat("docs/a.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, s2.ID, meta.Owner)
+	assert.EqualValues(t, 5, meta.Size)
+	assert.Equal(t, "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824", meta.Hash)
+	assert.Equal(t, []string{s1.Transport.Addr()}, meta.Replicas)
+
+	// The replica holder knows the original key of the file.
+	assert.Eventually(t, func() bool { return len(s1.List("docs/")) == 1 }, time.Second, time.Millisecond*5)
+	assert.Equal(t, "docs/a.txt", s1.List("docs/")[0].Key)
+
+	_, err = s1.Stat("docs/a.txt")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	assert.Nil(t, s2.Delete("docs/a.txt"))
+	assert.Empty(t, s2.List(""))
+	assert.Eventually(t, func() bool { return len(s1.List("")) == 0 }, time.Second, time.Millisecond*5)
+}
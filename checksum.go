@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumSuffix is appended to the path of a file to get the path
+// of the sidecar file holding its checksum.
+const checksumSuffix = ".checksum"
+
+var (
+	// ErrChecksumMismatch is returned when the contents of a
+	// file on disk no longer match the checksum recorded for it.
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrNoChecksum is returned when no checksum was recorded for a file.
+	ErrNoChecksum = errors.New("no checksum recorded")
+)
+
+// checksumFile is the contents of a checksum sidecar file. It records the
+// id and key of the file, which can not be recovered from a hashed path.
+type checksumFile struct {
+	ID     string
+	Key    string
+	SHA256 string
+}
+
+// checksumPath returns the path of the checksum sidecar of a file.
+func checksumPath(pathKey *PathKey) string {
+	return pathKey.AbsPath() + checksumSuffix
+}
+
+// isChecksumFile reports whether name is a checksum sidecar file.
+func isChecksumFile(name string) bool {
+	return strings.HasSuffix(name, checksumSuffix)
+}
+
+// writeChecksum atomically writes the checksum sidecar of a file.
+func (s *Store) writeChecksum(id, key string, sum []byte) error {
+	b, err := json.Marshal(checksumFile{ID: id, Key: key, SHA256: hex.EncodeToString(sum)})
+	if err != nil {
+		return err
+	}
+	pathKey := s.TransFormPath(id, key)
+	f, err := os.CreateTemp(pathKey.Path, "."+pathKey.Filename+checksumSuffix+tempFileMarker+"*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), checksumPath(pathKey))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// readChecksumFile reads a checksum sidecar file.
+func readChecksumFile(path string) (checksumFile, error) {
+	var sum checksumFile
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sum, ErrNoChecksum
+		}
+		return sum, err
+	}
+	err = json.Unmarshal(b, &sum)
+	return sum, err
+}
+
+// Checksum returns the hex encoded SHA-256 recorded for a file.
+func (s *Store) Checksum(id, key string) (string, error) {
+	sum, err := readChecksumFile(checksumPath(s.TransFormPath(id, key)))
+	return sum.SHA256, err
+}
+
+// checksum returns the decoded SHA-256 recorded for a file.
+func (s *Store) checksum(id, key string) ([]byte, error) {
+	sum, err := s.Checksum(id, key)
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(sum)
+}
+
+// Verify reads a file and checks it against its recorded checksum.
+func (s *Store) Verify(id, key string) error {
+	want, err := s.checksum(id, key)
+	if err != nil {
+		return err
+	}
+	_, file, err := s.readSteam(id, key)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(io.Discard, newVerifyingReader(file, want))
+	return err
+}
+
+// WalkChecksums calls fn with the id and key of every
+// file in the store that has a recorded checksum.
+func (s *Store) WalkChecksums(fn func(id, key string) error) error {
+	return filepath.WalkDir(s.StorageFolder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == s.StorageFolder && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || isTempFile(d.Name()) || !isChecksumFile(d.Name()) {
+			return nil
+		}
+		sum, err := readChecksumFile(path)
+		if err != nil {
+			return fmt.Errorf("reading checksum (%s): %w", path, err)
+		}
+		return fn(sum.ID, sum.Key)
+	})
+}
+
+// verifyingReader hashes a file while it is read and fails with
+// ErrChecksumMismatch instead of io.EOF if the hash is not the expected one.
+type verifyingReader struct {
+	r    io.ReadCloser
+	hash hash.Hash
+	want []byte
+}
+
+func newVerifyingReader(r io.ReadCloser, want []byte) *verifyingReader {
+	return &verifyingReader{r: r, hash: sha256.New(), want: want}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(v.hash.Sum(nil), v.want) {
+		return n, ErrChecksumMismatch
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.r.Close()
+}
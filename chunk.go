@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"sort"
+
+	"github.com/muhreeowki/dfs/p2p"
+)
+
+// chunkSuffix is appended to the ID of the node that stored a file
+// to get the Store namespace the chunks of the file are written under.
+// Chunks are keyed by their hash, so identical chunks are stored once.
+const chunkSuffix = ".chunks"
+
+// chunkNamespace returns the Store namespace of the chunks of owner.
+func chunkNamespace(owner string) string {
+	return owner + chunkSuffix
+}
+
+// StoreChunkInstruction is a Message Payload sent as the header of a
+// stream of Size bytes, a chunk encrypted by the node that stored it.
+type StoreChunkInstruction struct {
+	ServerID string
+	Hash     string
+	Size     int64
+}
+
+// GetChunkInstruction is a Message Payload requesting a chunk. The reply
+// is a GetFileResponse followed by the chunk encrypted by its owner.
+type GetChunkInstruction struct {
+	ServerID string
+	Hash     string
+}
+
+// DeleteChunksInstruction is a Message Payload instruction to delete
+// chunks that no file of ServerID references anymore.
+type DeleteChunksInstruction struct {
+	ServerID string
+	Hashes   []string
+}
+
+// validChunkKey reports whether key is the hash of a chunk or the key
+// of one of its shards. Keys are file names on disk, so peers can not
+// send anything else.
+func validChunkKey(key string) bool {
+	hash := key
+	if h, i, ok := parseShardKey(key); ok {
+		if shardKey(h, i) != key {
+			return false
+		}
+		hash = h
+	}
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size
+}
+
+// checkOwner rejects the instructions of a peer that change the objects
+// of another node than itself, and the instructions naming invalid keys.
+func checkOwner(from, owner string, keys ...string) error {
+	if owner != from {
+		return fmt.Errorf("peer (%s) can not change the objects of (%s)", from, owner)
+	}
+	for _, key := range keys {
+		if !validChunkKey(key) {
+			return fmt.Errorf("invalid chunk key %q", key)
+		}
+	}
+	return nil
+}
+
+// storeChunks splits r into chunks and writes the ones that are not on
+// disk yet. Every chunk is also streamed to the owners of its hash, that
+// acknowledge it as acks requires. It returns the manifest and the size
+// of the file, or the chunks stored before the error.
+func (s *FileServer) storeChunks(r io.Reader, acks *ackSet) ([]ChunkRef, int64, error) {
+	var (
+		chunker = NewChunker(r, s.AverageChunkSize)
+		chunks  = []ChunkRef{}
+		size    int64
+	)
+	for {
+		chunk, err := chunker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return chunks, 0, err
+		}
+		ref, err := s.storeChunk(chunk, acks)
+		if err != nil {
+			return chunks, 0, err
+		}
+		chunks = append(chunks, ref)
+		size += ref.Size
+	}
+	// An empty file is a single empty chunk.
+	if len(chunks) == 0 {
+		ref, err := s.storeChunk(nil, acks)
+		if err != nil {
+			return chunks, 0, err
+		}
+		chunks = append(chunks, ref)
+	}
+	return chunks, size, nil
+}
+
+// storeChunk writes a chunk to disk unless it is there already,
+// and streams it to the owners of its hash.
+func (s *FileServer) storeChunk(chunk []byte, acks *ackSet) (ChunkRef, error) {
+	sum := sha256.Sum256(chunk)
+	ref := ChunkRef{Hash: hex.EncodeToString(sum[:]), Size: int64(len(chunk))}
+	if !s.store.Has(chunkNamespace(s.ID), ref.Hash) {
+		if _, err := s.store.Write(chunkNamespace(s.ID), ref.Hash, bytes.NewReader(chunk)); err != nil {
+			return ref, err
+		}
+	}
+	if s.erasure != nil {
+		return ref, s.streamShards(ref.Hash, chunk, acks)
+	}
+	owners, _ := s.placement(ref.Hash)
+	required := acks.level.required(s.ReplicationFactor+1) - 1
+	id := s.expect(acks, "chunk "+ref.Hash, len(owners), required)
+	if len(owners) == 0 {
+		return ref, nil
+	}
+	msg := &Message{
+		ID: id,
+		Payload: StoreChunkInstruction{
+			ServerID: s.ID,
+			Hash:     ref.Hash,
+			Size:     sealedSize(ref.Size),
+		},
+	}
+	_, err := s.streamFile(msg, bytes.NewReader(chunk), owners)
+	return ref, err
+}
+
+// fetchChunk fetches a chunk of a file stored by this node from the
+// network, and writes it to disk decrypted. Replies larger than the
+// chunk sealed are refused.
+func (s *FileServer) fetchChunk(ref ChunkRef) error {
+	if s.erasure != nil {
+		return s.fetchShards(ref)
+	}
+	msg := &Message{
+		Payload: GetChunkInstruction{ServerID: s.ID, Hash: ref.Hash},
+	}
+	return s.fetchFile(msg, ref.Hash, func(r io.Reader, payload GetFileResponse) (int64, error) {
+		if r == nil || payload.Size > sealedSize(ref.Size) {
+			return 0, fmt.Errorf("unexpected reply for chunk (%s)", ref.Hash)
+		}
+		return s.writeChunk(ref.Hash, r)
+	})
+}
+
+// writeChunk decrypts a chunk streamed by a peer and
+// writes it to disk if its contents match its hash.
+func (s *FileServer) writeChunk(hash string, r io.Reader) (int64, error) {
+	buf := new(bytes.Buffer)
+	if _, err := s.open(hash, r, buf); err != nil {
+		return 0, err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	if hex.EncodeToString(sum[:]) != hash {
+		return 0, ErrChecksumMismatch
+	}
+	return s.store.Write(chunkNamespace(s.ID), hash, buf)
+}
+
+// releaseChunks deletes the chunks of files stored by this node that
+// no file references anymore, locally and on every peer.
+func (s *FileServer) releaseChunks(chunks []ChunkRef) error {
+	s.chunkLock.Lock()
+	defer s.chunkLock.Unlock()
+	hashes := []string{}
+	released := make(map[string]bool)
+	for _, ref := range chunks {
+		if released[ref.Hash] || s.catalog.Referenced(s.ID, ref.Hash) {
+			continue
+		}
+		if err := s.store.Delete(chunkNamespace(s.ID), ref.Hash); err != nil {
+			return err
+		}
+		released[ref.Hash] = true
+		hashes = append(hashes, ref.Hash)
+		if s.erasure != nil {
+			for i := 0; i < s.erasure.Shards(); i++ {
+				hashes = append(hashes, shardKey(ref.Hash, i))
+			}
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+	log.Printf("(%s): released (%d) chunks no file references", s.StorageFolder, len(released))
+	_, err := s.broadcastMessage(&Message{
+		Payload: DeleteChunksInstruction{ServerID: s.ID, Hashes: hashes},
+	})
+	return err
+}
+
+// handleStoreChunk writes a chunk streamed by a peer to disk.
+// Peers can only store chunks of their own.
+func (s *FileServer) handleStoreChunk(from string, stream *p2p.Stream, payload StoreChunkInstruction) error {
+	// Closing the stream unread tells the peer to stop sending it.
+	defer stream.Close()
+	if err := checkOwner(from, payload.ServerID, payload.Hash); err != nil {
+		return err
+	}
+	if s.store.Has(chunkNamespace(payload.ServerID), payload.Hash) {
+		return nil
+	}
+	_, err := s.store.Write(chunkNamespace(payload.ServerID), payload.Hash, newExactReader(stream, payload.Size))
+	return err
+}
+
+// handleGetChunk replies with a GetFileResponse followed by the chunk,
+// if it is found. The chunks of this node are encrypted on the fly.
+// Peers can read the chunks of other nodes, to repair them.
+func (s *FileServer) handleGetChunk(from string, id uint64, payload GetChunkInstruction) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("(%s): peer (%s) not found", s.StorageFolder, from)
+	}
+	if !p2p.ValidNodeID(payload.ServerID) || !validChunkKey(payload.Hash) {
+		return errors.Join(
+			fmt.Errorf("(%s): invalid chunk (%s) of (%s) requested by (%s)", s.StorageFolder, payload.Hash, payload.ServerID, from),
+			s.sendMessage(peer, &Message{ID: id, Payload: GetFileResponse{Err: "invalid chunk key"}}),
+		)
+	}
+	namespace := chunkNamespace(payload.ServerID)
+	if hash, i, ok := parseShardKey(payload.Hash); ok && payload.ServerID == s.ID && s.store.Has(namespace, hash) {
+		return s.sendShard(peer, id, hash, i)
+	}
+	if !s.store.Has(namespace, payload.Hash) {
+		return s.sendMessage(peer, &Message{ID: id, Payload: GetFileResponse{}})
+	}
+	size, r, err := s.store.Read(namespace, payload.Hash)
+	if err != nil {
+		return errors.Join(err, s.sendMessage(peer, &Message{
+			ID:      id,
+			Payload: GetFileResponse{Err: err.Error()},
+		}))
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+
+	if payload.ServerID == s.ID {
+		// Chunks are small, so they are encrypted in memory.
+		buf := new(bytes.Buffer)
+		if _, err := s.seal(r, buf, peer); err != nil {
+			return errors.Join(err, s.sendMessage(peer, &Message{
+				ID:      id,
+				Payload: GetFileResponse{Err: err.Error()},
+			}))
+		}
+		size, r = int64(buf.Len()), buf
+	}
+	msg := &Message{ID: id, Payload: GetFileResponse{Found: true, Size: size}}
+	return s.streamTo(peer, msg, r)
+}
+
+// handleDeleteChunks deletes chunks the node that stored them released.
+func (s *FileServer) handleDeleteChunks(from string, payload DeleteChunksInstruction) error {
+	if err := checkOwner(from, payload.ServerID, payload.Hashes...); err != nil {
+		return err
+	}
+	for _, hash := range payload.Hashes {
+		if err := s.store.Delete(chunkNamespace(payload.ServerID), hash); err != nil {
+			return err
+		}
+	}
+	log.Printf("(%s): deleted (%d) chunks of (%s) released by (%s)", s.StorageFolder, len(payload.Hashes), payload.ServerID, from)
+	return nil
+}
+
+// chunkReader reads a file from its chunks. It holds a single chunk in
+// memory and checks it against its hash, so it never returns corrupt
+// data. It can seek, which serving Range requests needs.
+type chunkReader struct {
+	store  *Store
+	owner  string
+	chunks []ChunkRef
+	// fetch, when set, returns the chunks that are not in the store.
+	fetch func(ref ChunkRef) ([]byte, error)
+	// offsets are the positions of the chunks in the file.
+	offsets []int64
+	size    int64
+	pos     int64
+	cur     int
+	buf     []byte
+}
+
+func newChunkReader(store *Store, owner string, chunks []ChunkRef, fetch func(ref ChunkRef) ([]byte, error)) *chunkReader {
+	c := &chunkReader{
+		fetch:   fetch,
+		store:   store,
+		owner:   owner,
+		chunks:  chunks,
+		offsets: make([]int64, len(chunks)),
+		cur:     -1,
+	}
+	for i, ref := range chunks {
+		c.offsets[i] = c.size
+		c.size += ref.Size
+	}
+	return c
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if c.pos >= c.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(c.offsets), func(i int) bool { return c.offsets[i] > c.pos }) - 1
+	if i != c.cur {
+		if err := c.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf[c.pos-c.offsets[i]:])
+	c.pos += int64(n)
+	return n, nil
+}
+
+// load reads the chunk i into memory.
+func (c *chunkReader) load(i int) error {
+	ref := c.chunks[i]
+	_, r, err := c.store.Read(chunkNamespace(c.owner), ref.Hash)
+	if errors.Is(err, fs.ErrNotExist) && c.fetch != nil {
+		var chunk []byte
+		if chunk, err = c.fetch(ref); err != nil {
+			return fmt.Errorf("chunk (%s): %w", ref.Hash, err)
+		}
+		r = bytes.NewReader(chunk)
+	}
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	buf := bytes.NewBuffer(c.buf[:0])
+	if _, err := io.Copy(buf, io.LimitReader(r, ref.Size+1)); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	if int64(buf.Len()) != ref.Size || hex.EncodeToString(sum[:]) != ref.Hash {
+		return fmt.Errorf("chunk (%s): %w", ref.Hash, ErrChecksumMismatch)
+	}
+	c.buf, c.cur = buf.Bytes(), i
+	return nil
+}
+
+func (c *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	c.pos = offset
+	return offset, nil
+}
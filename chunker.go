@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"math/bits"
+)
+
+// DefaultAverageChunkSize is the average size of the chunks files are split into.
+var DefaultAverageChunkSize = 64 << 10
+
+// Chunker splits a stream into content defined chunks with FastCDC.
+// A chunk ends where a rolling gear hash of the last bytes matches a
+// mask, so an edit only changes the chunks around it and identical
+// content yields identical chunks wherever it appears in a file.
+// See "FastCDC: a Fast and Efficient Content-Defined Chunking Approach
+// for Data Deduplication", Xia et al., USENIX ATC 2016.
+type Chunker struct {
+	r    io.Reader
+	buf  []byte
+	pos  int
+	end  int
+	eof  bool
+	min  int
+	avg  int
+	max  int
+	mask struct{ small, large uint64 }
+}
+
+// NewChunker returns a Chunker reading from r whose chunks average avgSize
+// bytes, rounded down to a power of two. Chunks are between a quarter
+// and four times the average, except the last one which may be smaller.
+func NewChunker(r io.Reader, avgSize int) *Chunker {
+	if avgSize < 64 {
+		avgSize = 64
+	}
+	n := bits.Len(uint(avgSize)) - 1
+	c := &Chunker{
+		r:   r,
+		avg: 1 << n,
+		min: 1 << (n - 2),
+		max: 1 << (n + 2),
+	}
+	c.buf = make([]byte, 2*c.max)
+	// Normalized chunking: a stricter mask before the average size and a
+	// looser one after it narrows the spread of the chunk sizes. The masks
+	// use the high bits, which depend on the most recent 64 bytes.
+	c.mask.small = ^uint64(0) << (64 - (n + 2))
+	c.mask.large = ^uint64(0) << (64 - (n - 2))
+	return c
+}
+
+// Next returns the next chunk, or io.EOF after the last one. The chunk
+// is only valid until the following call to Next.
+func (c *Chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.pos == c.end {
+		return nil, io.EOF
+	}
+	n := c.cut(c.buf[c.pos:c.end])
+	chunk := c.buf[c.pos : c.pos+n]
+	c.pos += n
+	return chunk, nil
+}
+
+// fill reads until at least a maximum sized chunk is buffered or r ends.
+func (c *Chunker) fill() error {
+	if c.end-c.pos >= c.max || c.eof {
+		return nil
+	}
+	copy(c.buf, c.buf[c.pos:c.end])
+	c.end -= c.pos
+	c.pos = 0
+	for c.end < len(c.buf) && !c.eof {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data.
+func (c *Chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+	if n > c.max {
+		n = c.max
+	}
+	normal := min(n, c.avg)
+	var fp uint64
+	i := c.min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.mask.small == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.mask.large == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gearTable maps every byte to a random value. It must never change,
+// or the same content would be cut into different chunks.
+var gearTable = func() (table [256]uint64) {
+	// splitmix64 with a fixed seed.
+	x := uint64(0x6466733a63646300)
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func chunks(t *testing.T, data []byte, avgSize int) [][]byte {
+	c := NewChunker(bytes.NewReader(data), avgSize)
+	chunks := [][]byte{}
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			return chunks
+		}
+		assert.Nil(t, err)
+		chunks = append(chunks, bytes.Clone(chunk))
+	}
+}
+
+func TestChunker(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	got := chunks(t, data, 8<<10)
+	assert.Equal(t, data, bytes.Join(got, nil))
+	for i, chunk := range got {
+		assert.LessOrEqual(t, len(chunk), 32<<10)
+		if i < len(got)-1 {
+			assert.GreaterOrEqual(t, len(chunk), 2<<10)
+		}
+	}
+	// The chunks average about the requested size.
+	assert.InDelta(t, 8<<10, len(data)/len(got), 4<<10)
+
+	// The same content is always cut the same way.
+	assert.Equal(t, got, chunks(t, data, 8<<10))
+
+	// An insertion only changes the chunks around it.
+	edited := append(bytes.Clone(data[:len(data)/2]), append([]byte("an edit"), data[len(data)/2:]...)...)
+	seen := make(map[string]bool)
+	for _, chunk := range got {
+		seen[string(chunk)] = true
+	}
+	changed := 0
+	for _, chunk := range chunks(t, edited, 8<<10) {
+		if !seen[string(chunk)] {
+			changed++
+		}
+	}
+	assert.LessOrEqual(t, changed, 2)
+
+	assert.Empty(t, chunks(t, nil, 8<<10))
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/muhreeowki/dfs/p2p"
+)
+
+// The client protocol is separate from the peer protocol. Every request
+// is made on a new connection and answered with a single response:
+//
+//	request:  header frame (ClientRequest), body frames for put
+//	response: header frame (ClientResponse), body frames for get
+//
+// Frames are the length prefixed frames of p2p.WriteFrame. A body is a
+// sequence of data frames ended by an empty frame, so files of unknown
+// size can be streamed. A body that ends without the empty frame was
+// cut short and must not be trusted.
+
+// Client operations.
+const (
+	OpPut  = "put"
+	OpGet  = "get"
+	OpRm   = "rm"
+	OpList = "ls"
+	OpStat = "stat"
+	// OpRotateKeys rotates the key-encryption keys of the node.
+	OpRotateKeys = "rotate-keys"
+	// OpRetireKey retires the key-encryption key named by Key.
+	OpRetireKey = "retire-key"
+)
+
+// DefaultClientAddr is the address a node serves clients on. It only
+// accepts local clients, other addresses need a ClientServer Token.
+var DefaultClientAddr = "127.0.0.1:3100"
+
+// ErrClientToken is returned for requests without the token of the ClientServer.
+var ErrClientToken = errors.New("invalid client token")
+
+// clientChunkSize is the size of the body frames.
+const clientChunkSize = 32 << 10
+
+// ClientRequest is the header of a request made by a Client.
+type ClientRequest struct {
+	Op string
+	// Key is the file key, the prefix of the keys for OpList,
+	// or the key-encryption key for OpRetireKey.
+	Key string
+	// Consistency is the consistency level of OpPut and OpGet.
+	Consistency Consistency
+	// Token is the Token of the ClientServer.
+	Token string
+}
+
+// ClientResponse is the header of the response to a ClientRequest.
+type ClientResponse struct {
+	Err string
+	// NotFound is true when the requested file does not exist.
+	NotFound bool
+	Meta     FileMeta
+	Metas    []FileMeta
+	Rotation KeyRotation
+}
+
+// ClientServer serves the client protocol for a FileServer.
+type ClientServer struct {
+	// Token, when set, must be sent with every request. Without it,
+	// only clients on a loopback address are served.
+	Token string
+
+	server   *FileServer
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// NewClientServer returns a ClientServer that serves requests with s.
+func NewClientServer(s *FileServer) *ClientServer {
+	return &ClientServer{server: s}
+}
+
+// ListenAndServe listens on addr and serves clients until Close is called.
+func (c *ClientServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return c.Serve(l)
+}
+
+// Serve serves the clients that connect to l until Close is called.
+// It refuses to serve a listener on a non-loopback address without a Token.
+func (c *ClientServer) Serve(l net.Listener) error {
+	if len(c.Token) == 0 && !isLoopback(l.Addr().String()) {
+		l.Close()
+		return fmt.Errorf("serving clients on (%s) needs a token, or a loopback address", l.Addr())
+	}
+	c.listener = l
+	log.Printf("(%s): serving clients on: %s", c.server.StorageFolder, l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			defer conn.Close()
+			if err := c.handleConn(conn); err != nil {
+				log.Printf("(%s): client (%s) error: %s", c.server.StorageFolder, conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Close stops accepting clients and waits for the pending requests.
+func (c *ClientServer) Close() error {
+	var err error
+	if c.listener != nil {
+		err = c.listener.Close()
+	}
+	c.wg.Wait()
+	return err
+}
+
+// handleConn serves the single request made on conn.
+func (c *ClientServer) handleConn(conn net.Conn) error {
+	var req ClientRequest
+	if err := readClientFrame(conn, &req); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(req.Token), []byte(c.Token)) != 1 {
+		writeClientFrame(conn, newClientResponse(ClientResponse{}, ErrClientToken))
+		return ErrClientToken
+	}
+	log.Printf("(%s): [%s] request from client (%s) for file (%s)",
+		c.server.StorageFolder,
+		req.Op,
+		conn.RemoteAddr(),
+		req.Key,
+	)
+
+	var (
+		resp ClientResponse
+		err  error
+	)
+	switch req.Op {
+	case OpPut:
+		body := newBodyReader(conn)
+		if err = c.server.Store(req.Key, body, req.Consistency); err == nil {
+			resp.Meta, err = c.server.Stat(req.Key)
+		}
+		// Drain what is left of the body so the response is not
+		// written while the client is still sending.
+		io.Copy(io.Discard, body)
+	case OpGet:
+		return c.handleGet(conn, req.Key, req.Consistency)
+	case OpRm:
+		err = c.server.Delete(req.Key)
+	case OpList:
+		resp.Metas = c.server.List(req.Key)
+	case OpStat:
+		resp.Meta, err = c.server.Stat(req.Key)
+	case OpRotateKeys:
+		resp.Rotation, err = c.server.RotateKeys()
+	case OpRetireKey:
+		err = c.server.RetireKey(req.Key)
+	default:
+		err = fmt.Errorf("unknown operation (%s)", req.Op)
+	}
+	return writeClientFrame(conn, newClientResponse(resp, err))
+}
+
+// handleGet writes the file stored under key as the body of the response.
+func (c *ClientServer) handleGet(conn net.Conn, key string, level Consistency) error {
+	r, err := c.server.Get(key, level)
+	if err != nil {
+		return writeClientFrame(conn, newClientResponse(ClientResponse{}, err))
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	meta, _ := c.server.Stat(key)
+	if err := writeClientFrame(conn, ClientResponse{Meta: meta}); err != nil {
+		return err
+	}
+	// On failure the body is left without its end frame,
+	// which tells the client the file was cut short.
+	w := newBodyWriter(conn)
+	if _, err := io.CopyBuffer(w, r, make([]byte, clientChunkSize)); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// newClientResponse sets the error of resp to err.
+func newClientResponse(resp ClientResponse, err error) ClientResponse {
+	if err != nil {
+		resp.Err = err.Error()
+		resp.NotFound = errors.Is(err, ErrFileNotFound)
+	}
+	return resp
+}
+
+// Client makes requests to the ClientServer of a node.
+type Client struct {
+	// Addr is the address of the ClientServer.
+	Addr string
+	// Consistency is the consistency level of Put and Get,
+	// the node uses its own default when it is not set.
+	Consistency Consistency
+	// Key, when set, encrypts files before Put sends them and
+	// decrypts them as Get reads them, so the nodes only ever see
+	// ciphertext. The metadata nodes return is then of the ciphertext.
+	Key *ClientKey
+	// Token is sent with every request, see ClientServer.Token.
+	Token string
+}
+
+// NewClient returns a Client for the node serving clients on addr.
+func NewClient(addr string) *Client {
+	return &Client{Addr: addr}
+}
+
+// Put stores the contents of r under key and returns the file metadata.
+func (c *Client) Put(key string, r io.Reader) (FileMeta, error) {
+	if c.Key != nil {
+		pr, pw := io.Pipe()
+		go func(r io.Reader) { pw.CloseWithError(c.Key.seal(r, pw)) }(r)
+		defer pr.Close()
+		r = pr
+	}
+	conn, err := c.send(ClientRequest{Op: OpPut, Key: key, Consistency: c.Consistency})
+	if err != nil {
+		return FileMeta{}, err
+	}
+	defer conn.Close()
+
+	w := newBodyWriter(conn)
+	if _, err := io.CopyBuffer(w, r, make([]byte, clientChunkSize)); err != nil {
+		return FileMeta{}, err
+	}
+	if err := w.Close(); err != nil {
+		return FileMeta{}, err
+	}
+	resp, err := readClientResponse(conn)
+	return resp.Meta, err
+}
+
+// Get returns the contents of the file stored under key.
+// The caller must close the returned reader.
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	conn, err := c.send(ClientRequest{Op: OpGet, Key: key, Consistency: c.Consistency})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := readClientResponse(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.Key == nil {
+		return &bodyReadCloser{Reader: newBodyReader(conn), Closer: conn}, nil
+	}
+	pr, pw := io.Pipe()
+	go func() { pw.CloseWithError(c.Key.open(newBodyReader(conn), pw)) }()
+	return &bodyReadCloser{Reader: pr, Closer: closeBoth{pr, conn}}, nil
+}
+
+// Delete deletes the file stored under key.
+func (c *Client) Delete(key string) error {
+	_, err := c.do(ClientRequest{Op: OpRm, Key: key})
+	return err
+}
+
+// List returns the metadata of the files held by the node
+// whose key starts with prefix.
+func (c *Client) List(prefix string) ([]FileMeta, error) {
+	resp, err := c.do(ClientRequest{Op: OpList, Key: prefix})
+	return resp.Metas, err
+}
+
+// Stat returns the metadata of the file stored under key.
+func (c *Client) Stat(key string) (FileMeta, error) {
+	resp, err := c.do(ClientRequest{Op: OpStat, Key: key})
+	return resp.Meta, err
+}
+
+// RotateKeys rotates the key-encryption keys of the node, see
+// FileServer.RotateKeys. The rotation is returned along with
+// the errors of the peers it did not reach.
+func (c *Client) RotateKeys() (KeyRotation, error) {
+	resp, err := c.do(ClientRequest{Op: OpRotateKeys})
+	return resp.Rotation, err
+}
+
+// RetireKey retires the key-encryption key id of the node.
+func (c *Client) RetireKey(id string) error {
+	_, err := c.do(ClientRequest{Op: OpRetireKey, Key: id})
+	return err
+}
+
+// do makes a request without a body and reads its response.
+func (c *Client) do(req ClientRequest) (ClientResponse, error) {
+	conn, err := c.send(req)
+	if err != nil {
+		return ClientResponse{}, err
+	}
+	defer conn.Close()
+	return readClientResponse(conn)
+}
+
+// send connects to the node and writes the request header.
+func (c *Client) send(req ClientRequest) (net.Conn, error) {
+	req.Token = c.Token
+	conn, err := net.Dial("tcp", c.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeClientFrame(conn, req); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readClientResponse reads a response header and turns its error back into an error.
+func readClientResponse(r io.Reader) (ClientResponse, error) {
+	var resp ClientResponse
+	if err := readClientFrame(r, &resp); err != nil {
+		return resp, err
+	}
+	if resp.NotFound {
+		return resp, ErrFileNotFound
+	}
+	if resp.Err == ErrClientToken.Error() {
+		return resp, ErrClientToken
+	}
+	if len(resp.Err) > 0 {
+		return resp, errors.New(resp.Err)
+	}
+	return resp, nil
+}
+
+// isLoopback reports whether addr is on a loopback interface only.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeClientFrame writes v gob encoded as a single frame.
+func writeClientFrame(w io.Writer, v any) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return err
+	}
+	return p2p.WriteFrame(w, p2p.IncomingMessage, buf.Bytes())
+}
+
+// readClientFrame reads a single frame and gob decodes it into v.
+func readClientFrame(r io.Reader, v any) error {
+	var rpc p2p.RPC
+	if err := (p2p.DefaultDecoder{}).Decode(r, &rpc); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(v)
+}
+
+// bodyWriter writes a body as data frames, Close writes the end frame.
+type bodyWriter struct {
+	w io.Writer
+}
+
+func newBodyWriter(w io.Writer) *bodyWriter {
+	return &bodyWriter{w: w}
+}
+
+func (b *bodyWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := p2p.WriteFrame(b.w, p2p.IncomingMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (b *bodyWriter) Close() error {
+	return p2p.WriteFrame(b.w, p2p.IncomingMessage, nil)
+}
+
+// bodyReader reads a body written by a bodyWriter. It returns io.EOF
+// at the end frame and io.ErrUnexpectedEOF if the body was cut short.
+type bodyReader struct {
+	r    io.Reader
+	buf  []byte
+	done bool
+}
+
+func newBodyReader(r io.Reader) *bodyReader {
+	return &bodyReader{r: r}
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	for len(b.buf) == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+		var rpc p2p.RPC
+		if err := (p2p.DefaultDecoder{}).Decode(b.r, &rpc); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.buf = rpc.Payload
+		b.done = len(rpc.Payload) == 0
+	}
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
+
+// bodyReadCloser closes the connection a body is read from.
+type bodyReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// closeBoth closes the pipe a decrypted body is read from, which
+// stops the decryption, and the connection the body came from.
+type closeBoth struct {
+	pipe *io.PipeReader
+	conn net.Conn
+}
+
+func (c closeBoth) Close() error {
+	c.pipe.Close()
+	return c.conn.Close()
+}
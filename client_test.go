@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClient serves clients for s on a local port.
+func newTestClient(t *testing.T, s *FileServer) *Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	clients := NewClientServer(s)
+	go clients.Serve(l)
+	t.Cleanup(func() { clients.Close() })
+	return NewClient(l.Addr().String())
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s2, 1)
+	client := newTestClient(t, s2)
+
+	// Larger than a body frame so the body spans several frames.
+	data := bytes.Repeat([]byte("some file contents "), 4096)
+	meta, err := client.Put("dir/file.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, "dir/file.txt", meta.Key)
+	assert.EqualValues(t, len(data), meta.Size)
+
+	r, err := client.Get("dir/file.txt")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Nil(t, r.Close())
+	assert.Equal(t, data, b)
+
+	stat, err := client.Stat("dir/file.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, meta.Hash, stat.Hash)
+
+	metas, err := client.List("dir/")
+	assert.Nil(t, err)
+	assert.Len(t, metas, 1)
+
+	assert.Nil(t, client.Delete("dir/file.txt"))
+	_, err = client.Get("dir/file.txt")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	_, err = client.Stat("dir/file.txt")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestClientToken(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, p2p.NewMemoryNetwork())
+
+	// Clients on other hosts can only be served with a token.
+	l, err := net.Listen("tcp", ":0")
+	assert.Nil(t, err)
+	assert.ErrorContains(t, NewClientServer(s).Serve(l), "needs a token")
+
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	clients := NewClientServer(s)
+	clients.Token = "secret"
+	go clients.Serve(l)
+	t.Cleanup(func() { clients.Close() })
+
+	client := NewClient(l.Addr().String())
+	_, err = client.List("")
+	assert.ErrorIs(t, err, ErrClientToken)
+	client.Token = "wrong"
+	_, err = client.Stat("a.txt")
+	assert.ErrorIs(t, err, ErrClientToken)
+
+	client.Token = "secret"
+	_, err = client.Put("a.txt", strings.NewReader("hello"))
+	assert.Nil(t, err)
+	out := new(bytes.Buffer)
+	assert.Nil(t, runClient("get", []string{"-node", client.Addr, "-token", "secret", "a.txt"}, nil, out))
+	assert.Equal(t, "hello", out.String())
+}
+
+func TestClientCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, p2p.NewMemoryNetwork())
+	client := newTestClient(t, s)
+	node := []string{"-node", client.Addr}
+
+	out := new(bytes.Buffer)
+	assert.Nil(t, runClient("put", append(node, "a.txt"), strings.NewReader("hello"), out))
+	assert.Contains(t, out.String(), "a.txt\t5\t")
+
+	out.Reset()
+	assert.Nil(t, runClient("get", append(node, "a.txt"), nil, out))
+	assert.Equal(t, "hello", out.String())
+
+	out.Reset()
+	assert.Nil(t, runClient("ls", node, nil, out))
+	assert.Contains(t, out.String(), "a.txt")
+
+	assert.Nil(t, runClient("rm", append(node, "a.txt"), nil, out))
+	assert.ErrorIs(t, runClient("stat", append(node, "a.txt"), nil, out), ErrFileNotFound)
+}
+
+func TestClientEncryption(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, p2p.NewMemoryNetwork())
+	plain := newTestClient(t, s)
+	key, err := NewClientKey(filepath.Join(t.TempDir(), "client.key"))
+	assert.Nil(t, err)
+	client := NewClient(plain.Addr)
+	client.Key = key
+
+	data := bytes.Repeat([]byte("secret contents "), 8192)
+	_, err = client.Put("secret.txt", bytes.NewReader(data))
+	assert.Nil(t, err)
+
+	// The node only holds ciphertext.
+	r, err := s.Get("secret.txt", ConsistencyOne)
+	assert.Nil(t, err)
+	stored, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.True(t, bytes.HasPrefix(stored, clientMagic))
+	assert.False(t, bytes.Contains(stored, []byte("secret contents")))
+
+	rc, err := client.Get("secret.txt")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Nil(t, rc.Close())
+	assert.Equal(t, data, b)
+
+	// Clients without the key read the ciphertext, or fail to decrypt it.
+	rc, err = plain.Get("secret.txt")
+	assert.Nil(t, err)
+	b, err = io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, stored, b)
+	other, err := NewClientKey(filepath.Join(t.TempDir(), "other.key"))
+	assert.Nil(t, err)
+	assert.Nil(t, rc.Close())
+	client.Key = other
+	rc, err = client.Get("secret.txt")
+	assert.Nil(t, err)
+	_, err = io.ReadAll(rc)
+	assert.ErrorIs(t, err, ErrWrongClientKey)
+	assert.Nil(t, rc.Close())
+	client.Key = PassphraseKey("passphrase")
+	rc, err = client.Get("secret.txt")
+	assert.Nil(t, err)
+	_, err = io.ReadAll(rc)
+	assert.ErrorContains(t, err, "key file, not a passphrase")
+	assert.Nil(t, rc.Close())
+
+	// Files are not trusted to be encrypted when they are not.
+	_, err = plain.Put("plain.txt", strings.NewReader("plain"))
+	assert.Nil(t, err)
+	rc, err = client.Get("plain.txt")
+	assert.Nil(t, err)
+	_, err = io.ReadAll(rc)
+	assert.ErrorIs(t, err, ErrNotClientEncrypted)
+	assert.Nil(t, rc.Close())
+}
+
+func TestClientPassphrase(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, p2p.NewMemoryNetwork())
+	client := newTestClient(t, s)
+	key := PassphraseKey("correct horse battery staple")
+	// A lower cost keeps the test fast, it is read back from the file.
+	key.cost = Argon2Cost{Time: 1, LogMemory: 10, Threads: 1}
+	client.Key = key
+
+	_, err := client.Put("a.txt", strings.NewReader("hello"))
+	assert.Nil(t, err)
+	client.Key = PassphraseKey("correct horse battery staple")
+	rc, err := client.Get("a.txt")
+	assert.Nil(t, err)
+	b, err := io.ReadAll(rc)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", string(b))
+	assert.Nil(t, rc.Close())
+
+	client.Key = PassphraseKey("wrong")
+	rc, err = client.Get("a.txt")
+	assert.Nil(t, err)
+	_, err = io.ReadAll(rc)
+	assert.ErrorIs(t, err, ErrWrongClientKey)
+	assert.Nil(t, rc.Close())
+
+	// Nodes can not make clients derive keys at any cost.
+	sealed := new(bytes.Buffer)
+	assert.Nil(t, key.seal(strings.NewReader("hello"), sealed))
+	sealed.Bytes()[len(clientMagic)+1] = maxArgon2LogMemory + 1
+	err = key.open(sealed, io.Discard)
+	assert.ErrorContains(t, err, "Argon2id cost out of bounds")
+}
+
+func TestClientEncryptionCommands(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, p2p.NewMemoryNetwork())
+	client := newTestClient(t, s)
+	keyFile := filepath.Join(t.TempDir(), "client.key")
+	assert.Nil(t, runKeygen([]string{keyFile}, io.Discard))
+	assert.Error(t, runKeygen([]string{keyFile}, io.Discard))
+	node := []string{"-node", client.Addr, "-client-key", keyFile}
+
+	out := new(bytes.Buffer)
+	assert.Nil(t, runClient("put", append(node, "a.txt"), strings.NewReader("hello"), out))
+	out.Reset()
+	assert.Nil(t, runClient("get", append(node, "a.txt"), nil, out))
+	assert.Equal(t, "hello", out.String())
+
+	out.Reset()
+	assert.Nil(t, runClient("get", []string{"-node", client.Addr, "a.txt"}, nil, out))
+	assert.NotContains(t, out.String(), "hello")
+}
+
+func TestBodyReaderTruncated(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newBodyWriter(buf)
+	w.Write([]byte("partial"))
+
+	_, err := io.ReadAll(newBodyReader(buf))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
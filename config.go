@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of a node. It is read from a JSON or YAML file,
+// then overridden by DFS_* environment variables, then by flags. Every
+// setting is named after its flag, with underscores instead of dashes,
+// and its environment variable is that name upper cased after DFS_.
+type Config struct {
+	// ID is the node ID. With TLS, it must be the common name of the
+	// certificate, which it defaults to.
+	ID         string `json:"id" yaml:"id"`
+	ListenAddr string `json:"listen" yaml:"listen"`
+	ClientAddr string `json:"client" yaml:"client"`
+	// ClientToken is the token clients must send, see ClientServer.Token
+	// and HTTPGateway.Token.
+	ClientToken   string `json:"client_token" yaml:"client_token"`
+	HTTPAddr      string `json:"http" yaml:"http"`
+	S3Addr        string `json:"s3" yaml:"s3"`
+	S3Region      string `json:"s3_region" yaml:"s3_region"`
+	S3AccessKey   string `json:"s3_access_key" yaml:"s3_access_key"`
+	S3SecretKey   string `json:"s3_secret_key" yaml:"s3_secret_key"`
+	StorageFolder string `json:"storage" yaml:"storage"`
+	// BootstrapNodes are the peer addresses to join.
+	BootstrapNodes []string `json:"bootstrap" yaml:"bootstrap"`
+	// PathTransform is how files are laid out on disk, see pathTransforms.
+	PathTransform string `json:"path_transform" yaml:"path_transform"`
+	// KeyFile is the identity file of the node, holding its ID and keys,
+	// see LoadIdentity. It is created when it does not exist. The
+	// keyring file, see LoadKeyring, and the known peers file, see
+	// LoadKnownPeers, are kept next to it.
+	KeyFile string `json:"key_file" yaml:"key_file"`
+	// TLSCert, TLSKey and TLSCA are the PEM files of the certificate
+	// and key the node presents to its peers, and of the cluster CA
+	// their certificates must be signed by, see p2p.LoadMutualTLSConfig.
+	TLSCert string `json:"tls_cert" yaml:"tls_cert"`
+	TLSKey  string `json:"tls_key" yaml:"tls_key"`
+	TLSCA   string `json:"tls_ca" yaml:"tls_ca"`
+	// Insecure runs the node without TLS, peers then talk in plaintext.
+	// It must be set explicitly when the TLS files are not given.
+	Insecure bool `json:"insecure" yaml:"insecure"`
+	// MigrateCTR reads objects peers hold in the unauthenticated AES-CTR
+	// format of old nodes, see FileServerOpts.MigrateCTR.
+	MigrateCTR        bool        `json:"migrate_ctr" yaml:"migrate_ctr"`
+	ReplicationFactor int         `json:"replication" yaml:"replication"`
+	VirtualNodes      int         `json:"virtual_nodes" yaml:"virtual_nodes"`
+	DataShards        int         `json:"data_shards" yaml:"data_shards"`
+	ParityShards      int         `json:"parity_shards" yaml:"parity_shards"`
+	WriteConsistency  Consistency `json:"write_consistency" yaml:"write_consistency"`
+	ReadConsistency   Consistency `json:"read_consistency" yaml:"read_consistency"`
+	// KeepLocalChunks keeps erasure coded chunks on the local disk too,
+	// see FileServerOpts.KeepLocalChunks.
+	KeepLocalChunks bool `json:"keep_local_chunks" yaml:"keep_local_chunks"`
+}
+
+// pathTransforms are the PathTransformFuncs a Config can name.
+var pathTransforms = map[string]PathTransformFunc{
+	"cas":   CASPathTransformFunc,
+	"plain": DefaultPathTransformFunc,
+}
+
+// DefaultConfig returns the configuration of a node without file, environment or flags.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:        ":3000",
+		ClientAddr:        DefaultClientAddr,
+		S3Region:          DefaultS3Region,
+		PathTransform:     "cas",
+		ReplicationFactor: DefaultReplicationFactor,
+		WriteConsistency:  ConsistencyOne,
+		ReadConsistency:   ConsistencyOne,
+	}
+}
+
+// LoadConfig returns the configuration given by the serve flags in args,
+// the config file they name and the environment, and validates it.
+// lookupEnv is os.LookupEnv outside of tests.
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	// The config file has to be read before the flags
+	// that override it are parsed for good.
+	var (
+		scratch = DefaultConfig()
+		path, _ = lookupEnv("DFS_CONFIG")
+		pre     = flag.NewFlagSet("serve", flag.ContinueOnError)
+	)
+	pre.SetOutput(io.Discard)
+	scratch.bind(pre)
+	pre.StringVar(&path, "config", path, "")
+	pre.Parse(args)
+
+	cfg := DefaultConfig()
+	if len(path) > 0 {
+		if err := cfg.readFile(path); err != nil {
+			return cfg, err
+		}
+	}
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	cfg.bind(fs)
+	fs.String("config", path, "JSON or YAML config file, also read from DFS_CONFIG")
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envName(f.Name)
+		if v, ok := lookupEnv(name); ok && err == nil && f.Name != "config" {
+			if serr := f.Value.Set(v); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", v, name, serr)
+			}
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	if fs.NArg() > 0 {
+		return cfg, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return cfg, cfg.Validate()
+}
+
+// envName returns the environment variable of the flag name.
+func envName(name string) string {
+	return "DFS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// bind defines the flags of the settings of c on fs,
+// with the current settings as their defaults.
+func (c *Config) bind(fs *flag.FlagSet) {
+	fs.StringVar(&c.ID, "id", c.ID, "node ID, the common name of -tls-cert or random when empty, it must match an existing identity file")
+	fs.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "peer listen address")
+	fs.StringVar(&c.ClientAddr, "client", c.ClientAddr, "client listen address")
+	fs.StringVar(&c.ClientToken, "client-token", c.ClientToken, "token clients and HTTP gateway requests must send, required unless -client and -http are loopback addresses")
+	fs.StringVar(&c.HTTPAddr, "http", c.HTTPAddr, "HTTP gateway listen address, disabled when empty")
+	fs.StringVar(&c.S3Addr, "s3", c.S3Addr, "S3 gateway listen address, disabled when empty")
+	fs.StringVar(&c.S3Region, "s3-region", c.S3Region, "region S3 requests are signed for")
+	fs.StringVar(&c.S3AccessKey, "s3-access-key", c.S3AccessKey, "access key ID of the S3 gateway")
+	fs.StringVar(&c.S3SecretKey, "s3-secret-key", c.S3SecretKey, "secret key of the S3 gateway")
+	fs.StringVar(&c.StorageFolder, "storage", c.StorageFolder, "storage folder, derived from -listen when empty")
+	fs.Var((*addrList)(&c.BootstrapNodes), "bootstrap", "comma separated peer addresses to join")
+	fs.StringVar(&c.PathTransform, "path-transform", c.PathTransform, "layout of the files on disk: cas or plain")
+	fs.StringVar(&c.KeyFile, "key-file", c.KeyFile, "identity file holding the node ID and keys, created when missing, in the storage folder when empty")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "PEM certificate presented to peers")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "PEM key of -tls-cert")
+	fs.StringVar(&c.TLSCA, "tls-ca", c.TLSCA, "PEM cluster CA the certificates of peers must be signed by")
+	fs.BoolVar(&c.Insecure, "insecure", c.Insecure, "talk to peers without TLS, required when the TLS files are not given")
+	fs.BoolVar(&c.MigrateCTR, "migrate-ctr", c.MigrateCTR, "also read objects in the unauthenticated AES-CTR format of old nodes, only while migrating them")
+	fs.IntVar(&c.ReplicationFactor, "replication", c.ReplicationFactor, "number of peers every file is replicated to")
+	fs.IntVar(&c.VirtualNodes, "virtual-nodes", c.VirtualNodes, "points of every peer on the hash ring, the default when zero")
+	fs.IntVar(&c.DataShards, "data-shards", c.DataShards, "data shards of erasure coded chunks, replication when zero")
+	fs.IntVar(&c.ParityShards, "parity-shards", c.ParityShards, "parity shards of erasure coded chunks")
+	fs.BoolVar(&c.KeepLocalChunks, "keep-local-chunks", c.KeepLocalChunks, "keep erasure coded chunks on the local disk too, instead of only their shards on peers")
+	fs.Var(&c.WriteConsistency, "write-consistency", "default consistency level of writes: ONE, QUORUM or ALL")
+	fs.Var(&c.ReadConsistency, "read-consistency", "default consistency level of reads: ONE, QUORUM or ALL")
+}
+
+// readFile reads the settings of a config file into c. Files ending in
+// .yaml or .yml are YAML, the others JSON. Unknown settings are
+// rejected, they are most likely typos.
+func (c *Config) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		if errors.Is(err, io.EOF) {
+			// An empty file sets nothing.
+			err = nil
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	}
+	if err != nil {
+		return fmt.Errorf("config file (%s): %w", path, err)
+	}
+	return nil
+}
+
+// Validate checks the settings, and fills in the storage
+// folder and the key file when they are empty.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(setting, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: %s", setting, fmt.Sprintf(format, args...)))
+	}
+	if len(c.ID) > 0 && !p2p.ValidNodeID(c.ID) {
+		invalid("id", "%q may only hold letters, digits, '-', '_' and '.', and not start with '.'", c.ID)
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		invalid("listen", "%s", err)
+	}
+	if _, _, err := net.SplitHostPort(c.ClientAddr); err != nil {
+		invalid("client", "%s", err)
+	} else if len(c.ClientToken) == 0 && !isLoopback(c.ClientAddr) {
+		invalid("client", "serving clients on (%s) needs client_token, or a loopback address", c.ClientAddr)
+	}
+	if len(c.HTTPAddr) > 0 {
+		if _, _, err := net.SplitHostPort(c.HTTPAddr); err != nil {
+			invalid("http", "%s", err)
+		} else if len(c.ClientToken) == 0 && !isLoopback(c.HTTPAddr) {
+			invalid("http", "serving the HTTP gateway on (%s) needs client_token, or a loopback address", c.HTTPAddr)
+		}
+	}
+	for _, addr := range c.BootstrapNodes {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			invalid("bootstrap", "%s", err)
+		}
+	}
+	if len(c.S3Addr) > 0 && (len(c.S3AccessKey) == 0 || len(c.S3SecretKey) == 0) {
+		invalid("s3", "the S3 gateway needs s3_access_key and s3_secret_key")
+	}
+	switch withTLS := len(c.TLSCert) > 0 || len(c.TLSKey) > 0 || len(c.TLSCA) > 0; {
+	case withTLS && (len(c.TLSCert) == 0 || len(c.TLSKey) == 0 || len(c.TLSCA) == 0):
+		invalid("tls_cert", "tls_cert, tls_key and tls_ca must be set together")
+	case withTLS && c.Insecure:
+		invalid("insecure", "must not be set along with tls_cert, tls_key and tls_ca")
+	case !withTLS && !c.Insecure:
+		invalid("tls_cert", "peers need tls_cert, tls_key and tls_ca, or insecure to run without TLS")
+	}
+	if _, ok := pathTransforms[c.PathTransform]; !ok {
+		invalid("path_transform", "unknown path transform %q, want cas or plain", c.PathTransform)
+	}
+	if c.ReplicationFactor < 0 {
+		invalid("replication", "must not be negative, got %d", c.ReplicationFactor)
+	}
+	if c.VirtualNodes < 0 {
+		invalid("virtual_nodes", "must not be negative, got %d", c.VirtualNodes)
+	}
+	if c.DataShards != 0 || c.ParityShards != 0 {
+		if _, err := NewReedSolomon(c.DataShards, c.ParityShards); err != nil {
+			invalid("data_shards", "%s", err)
+		}
+	}
+
+	if len(c.StorageFolder) == 0 {
+		c.StorageFolder = strings.TrimPrefix(strings.ReplaceAll(c.ListenAddr, ":", "_"), "_") + "_network"
+	}
+	if len(c.KeyFile) == 0 {
+		c.KeyFile = filepath.Join(c.StorageFolder, IdentityFileName)
+	}
+	return errors.Join(errs...)
+}
+
+// NewServer returns a FileServer over TCP configured by c. Peers are
+// authenticated by their TLS certificate first, unless c is Insecure,
+// then by the signed handshake of their node ID, which must be the
+// common name of their certificate.
+func (c Config) NewServer() (*FileServer, error) {
+	var tlsConfig *tls.Config
+	id := c.ID
+	if !c.Insecure {
+		var err error
+		if tlsConfig, err = p2p.LoadMutualTLSConfig(c.TLSCert, c.TLSKey, c.TLSCA); err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		// Peers verify the node ID against the common name of the certificate.
+		cert, err := x509.ParseCertificate(tlsConfig.Certificates[0].Certificate[0])
+		if err != nil {
+			return nil, fmt.Errorf("tls: %w", err)
+		}
+		if len(id) == 0 {
+			id = cert.Subject.CommonName
+		}
+		if id != cert.Subject.CommonName {
+			return nil, fmt.Errorf("tls: certificate (%s) is issued to (%s), not to node (%s)", c.TLSCert, cert.Subject.CommonName, id)
+		}
+	}
+	ident, err := LoadIdentity(c.KeyFile, id)
+	if err != nil {
+		return nil, err
+	}
+	keyring, err := LoadKeyring(filepath.Join(filepath.Dir(c.KeyFile), KeyringFileName))
+	if err != nil {
+		return nil, err
+	}
+	knownPeers, err := LoadKnownPeers(filepath.Join(filepath.Dir(c.KeyFile), KnownPeersFileName))
+	if err != nil {
+		return nil, err
+	}
+	shakeHands := p2p.SignedHandshakeFunc(p2p.SignedHandshakeOpts{
+		NodeID:     ident.ID,
+		ListenAddr: c.ListenAddr,
+		PrivateKey: ident.PrivateKey,
+		Features:   []string{p2p.FeatureStreams},
+		Verify:     knownPeers.Verify,
+	})
+	if tlsConfig != nil {
+		shakeHands = p2p.ChainHandshakeFuncs(p2p.TLSHandshakeFunc(tlsConfig.RootCAs), shakeHands)
+	}
+	tcpTransport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr: c.ListenAddr,
+		ShakeHands: shakeHands,
+		Decoder:    p2p.DefaultDecoder{},
+		TLSConfig:  tlsConfig,
+	})
+	s := NewFileServer(FileServerOpts{
+		ID:                ident.ID,
+		Encryptionkey:     ident.DataKey,
+		MigrateCTR:        c.MigrateCTR,
+		Keyring:           keyring,
+		Transport:         tcpTransport,
+		PathTransformFunc: pathTransforms[c.PathTransform],
+		StorageFolder:     c.StorageFolder,
+		BootstrapNodes:    c.BootstrapNodes,
+		ReplicationFactor: c.ReplicationFactor,
+		VirtualNodes:      c.VirtualNodes,
+		DataShards:        c.DataShards,
+		ParityShards:      c.ParityShards,
+		KeepLocalChunks:   c.KeepLocalChunks,
+		WriteConsistency:  c.WriteConsistency,
+		ReadConsistency:   c.ReadConsistency,
+	})
+	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerDisconnect = s.OnPeerDisconnect
+	return s, nil
+}
+
+// addrList is a flag.Value of comma separated addresses.
+type addrList []string
+
+func (l *addrList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *addrList) Set(s string) error {
+	*l = nil
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); len(addr) > 0 {
+			*l = append(*l, addr)
+		}
+	}
+	return nil
+}
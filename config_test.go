@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+// env returns a lookupEnv over the variables of vars.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeConfig(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig([]string{"-insecure"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ":3000", cfg.ListenAddr)
+	assert.Equal(t, "127.0.0.1:3100", cfg.ClientAddr)
+	assert.Equal(t, "3000_network", cfg.StorageFolder)
+	assert.Equal(t, filepath.Join("3000_network", IdentityFileName), cfg.KeyFile)
+	assert.Equal(t, DefaultReplicationFactor, cfg.ReplicationFactor)
+	assert.Equal(t, ConsistencyOne, cfg.WriteConsistency)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfig(t, "node.json", `{
+		"id": "file",
+		"listen": ":4000",
+		"bootstrap": [":5000", ":6000"],
+		"path_transform": "plain",
+		"replication": 2,
+		"write_consistency": "QUORUM"
+	}`)
+
+	cfg, err := LoadConfig([]string{"-config", path, "-replication", "4"}, env(map[string]string{
+		"DFS_INSECURE":    "true",
+		"DFS_ID":          "env",
+		"DFS_REPLICATION": "3",
+		"DFS_KEY_FILE":    "/keys/node.key",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Flags override the environment, which overrides the file.
+	assert.Equal(t, "env", cfg.ID)
+	assert.Equal(t, 4, cfg.ReplicationFactor)
+	assert.Equal(t, "/keys/node.key", cfg.KeyFile)
+	assert.Equal(t, ":4000", cfg.ListenAddr)
+	assert.Equal(t, "4000_network", cfg.StorageFolder)
+	assert.Equal(t, []string{":5000", ":6000"}, cfg.BootstrapNodes)
+	assert.Equal(t, "plain", cfg.PathTransform)
+	assert.Equal(t, ConsistencyQuorum, cfg.WriteConsistency)
+
+	// The config file can be named by the environment too.
+	cfg, err = LoadConfig([]string{"-bootstrap", ":7000", "-insecure"}, env(map[string]string{"DFS_CONFIG": path}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "file", cfg.ID)
+	assert.Equal(t, []string{":7000"}, cfg.BootstrapNodes)
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	path := writeConfig(t, "node.yaml", `
+listen: ":4000"
+storage: /var/lib/dfs
+data_shards: 4
+parity_shards: 2
+read_consistency: all
+tls_cert: node.crt
+tls_key: node.key
+tls_ca: ca.crt
+`)
+	cfg, err := LoadConfig([]string{"-config", path}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/var/lib/dfs", cfg.StorageFolder)
+	assert.Equal(t, 4, cfg.DataShards)
+	assert.Equal(t, 2, cfg.ParityShards)
+	assert.Equal(t, ConsistencyAll, cfg.ReadConsistency)
+	assert.Equal(t, "ca.crt", cfg.TLSCA)
+}
+
+func TestLoadConfigRejectsUnknownSettings(t *testing.T) {
+	for _, name := range []string{"node.json", "node.yaml"} {
+		content := `{"replicas": 3}`
+		if filepath.Ext(name) == ".yaml" {
+			content = "replicas: 3\n"
+		}
+		_, err := LoadConfig([]string{"-config", writeConfig(t, name, content)}, env(nil))
+		if assert.Error(t, err, name) {
+			assert.Contains(t, err.Error(), "replicas", name)
+		}
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	_, err := LoadConfig([]string{
+		"-listen", "3000",
+		"-client", ":3100",
+		"-bootstrap", ":4000,localhost",
+		"-path-transform", "flat",
+		"-replication", "-1",
+		"-data-shards", "4",
+	}, env(nil))
+	if !assert.Error(t, err) {
+		return
+	}
+	// Every invalid setting is reported at once.
+	for _, setting := range []string{"listen:", "client:", "tls_cert:", "bootstrap:", "path_transform:", "replication:", "data_shards:"} {
+		assert.Contains(t, err.Error(), setting)
+	}
+
+	_, err = LoadConfig(nil, env(map[string]string{"DFS_WRITE_CONSISTENCY": "MOST"}))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "DFS_WRITE_CONSISTENCY")
+	}
+	_, err = LoadConfig([]string{"-client", ":3100", "-client-token", "secret", "-insecure"}, env(nil))
+	assert.Nil(t, err)
+	_, err = LoadConfig([]string{"-tls-cert", "node.crt", "-tls-ca", "ca.crt"}, env(nil))
+	assert.ErrorContains(t, err, "set together")
+	_, err = LoadConfig([]string{"-tls-cert", "node.crt", "-tls-key", "node.key", "-tls-ca", "ca.crt", "-insecure"}, env(nil))
+	assert.ErrorContains(t, err, "insecure:")
+	_, err = LoadConfig([]string{"-s3", ":9000", "-insecure"}, env(nil))
+	assert.ErrorContains(t, err, "s3:")
+	_, err = LoadConfig([]string{"-http", ":8080", "-insecure"}, env(nil))
+	assert.ErrorContains(t, err, "http:")
+	_, err = LoadConfig([]string{"-http", "127.0.0.1:8080", "-insecure"}, env(nil))
+	assert.Nil(t, err)
+	_, err = LoadConfig([]string{"-http", ":8080", "-client-token", "secret", "-insecure"}, env(nil))
+	assert.Nil(t, err)
+	_, err = LoadConfig([]string{"extra"}, env(nil))
+	assert.Error(t, err)
+}
+
+// writeTestCerts writes a cluster CA and a certificate it signed
+// to dir, and returns the TLS flags naming them.
+func writeTestCerts(t *testing.T, dir string) []string {
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	issue := func(tmpl, parent *x509.Certificate, signer *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent == nil {
+			parent, signer = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, key
+	}
+	ca, caKey := issue(&x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dfs test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil)
+	cert, key := issue(&x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []string{
+		"-tls-cert", writePEM("node.crt", "CERTIFICATE", cert.Raw),
+		"-tls-key", writePEM("node.key", "EC PRIVATE KEY", keyDER),
+		"-tls-ca", writePEM("ca.crt", "CERTIFICATE", ca.Raw),
+	}
+}
+
+func TestConfigNewServerTLS(t *testing.T) {
+	dir := t.TempDir()
+	args := append([]string{"-listen", "127.0.0.1:0", "-storage", dir}, writeTestCerts(t, dir)...)
+	cfg, err := LoadConfig(args, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := cfg.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := s.Transport.(*p2p.TCPTransport).TLSConfig
+	if assert.NotNil(t, tlsConfig) {
+		assert.Len(t, tlsConfig.Certificates, 1)
+	}
+	// The node ID is the common name of the certificate.
+	assert.Equal(t, "node", s.ID)
+	other := cfg
+	other.ID = "other"
+	other.KeyFile = filepath.Join(t.TempDir(), IdentityFileName)
+	_, err = other.NewServer()
+	assert.ErrorContains(t, err, "not to node (other)")
+
+	// Missing files are reported before the node starts.
+	cfg.TLSCA = filepath.Join(dir, "missing.crt")
+	_, err = cfg.NewServer()
+	assert.ErrorContains(t, err, "tls:")
+
+	cfg, err = LoadConfig([]string{"-listen", "127.0.0.1:0", "-storage", t.TempDir(), "-insecure"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err = cfg.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, s.Transport.(*p2p.TCPTransport).TLSConfig)
+}
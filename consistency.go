@@ -0,0 +1,314 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/muhreeowki/dfs/p2p"
+)
+
+// ErrNotEnoughReplicas is returned when fewer replicas than the
+// consistency level requires confirmed a write or a read in time.
+var ErrNotEnoughReplicas = errors.New("not enough replicas confirmed")
+
+// Consistency is the number of replicas that must confirm a write or a
+// read. The local copy of a file is one of its replicas, so a file has
+// ReplicationFactor+1 replicas.
+type Consistency int
+
+const (
+	// ConsistencyDefault uses the level configured in FileServerOpts.
+	ConsistencyDefault Consistency = iota
+	// ConsistencyOne only needs the local copy.
+	ConsistencyOne
+	// ConsistencyQuorum needs a majority of the replicas.
+	ConsistencyQuorum
+	// ConsistencyAll needs every replica.
+	ConsistencyAll
+)
+
+// ParseConsistency parses the name of a consistency level, case insensitively.
+func ParseConsistency(s string) (Consistency, error) {
+	switch strings.ToUpper(s) {
+	case "", "DEFAULT":
+		return ConsistencyDefault, nil
+	case "ONE":
+		return ConsistencyOne, nil
+	case "QUORUM":
+		return ConsistencyQuorum, nil
+	case "ALL":
+		return ConsistencyAll, nil
+	}
+	return 0, fmt.Errorf("unknown consistency level (%s), want ONE, QUORUM or ALL", s)
+}
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyDefault:
+		return "DEFAULT"
+	case ConsistencyOne:
+		return "ONE"
+	case ConsistencyQuorum:
+		return "QUORUM"
+	case ConsistencyAll:
+		return "ALL"
+	}
+	return fmt.Sprintf("Consistency(%d)", int(c))
+}
+
+// Set implements flag.Value.
+func (c *Consistency) Set(s string) error {
+	level, err := ParseConsistency(s)
+	if err != nil {
+		return err
+	}
+	*c = level
+	return nil
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (c Consistency) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (c *Consistency) UnmarshalText(b []byte) error {
+	return c.Set(string(b))
+}
+
+// required returns how many of n replicas must confirm.
+func (c Consistency) required(n int) int {
+	switch c {
+	case ConsistencyQuorum:
+		return n/2 + 1
+	case ConsistencyAll:
+		return n
+	}
+	return 1
+}
+
+// requiredShards returns how many shards of an erasure coded chunk
+// peers must confirm. The local copy of the chunk counts as ONE, and
+// QUORUM needs at least the shards that rebuild the chunk.
+func (c Consistency) requiredShards(rs *ReedSolomon) int {
+	switch c {
+	case ConsistencyQuorum:
+		return max(rs.DataShards, rs.Shards()/2+1)
+	case ConsistencyAll:
+		return rs.Shards()
+	}
+	return 0
+}
+
+// or returns c, or def for ConsistencyDefault.
+func (c Consistency) or(def Consistency) Consistency {
+	if c == ConsistencyDefault {
+		return def
+	}
+	return c
+}
+
+// StoreAck is a Message Payload reply to a StoreChunkInstruction or a
+// StoreFileInstruction with an ID, sent once the peer stored it.
+type StoreAck struct {
+	Err string
+}
+
+// pendingWrite is a write streamed to peers that must be acknowledged.
+type pendingWrite struct {
+	req      *request
+	what     string
+	sent     int
+	required int
+	// acked and replied count the replies of the peers so far.
+	acked, replied int
+	// chunk is the hash of the erasure coded chunk whose shards
+	// are written, when its local copy is dropped once they are all
+	// acknowledged.
+	chunk string
+}
+
+// ackSet collects the writes of a Store that peers must acknowledge.
+type ackSet struct {
+	level  Consistency
+	writes []pendingWrite
+}
+
+// expect returns the ID to send a write of what to sent peers with, of
+// which required must acknowledge it. It is zero when no ack is needed.
+func (s *FileServer) expect(acks *ackSet, what string, sent, required int) uint64 {
+	if required <= 0 {
+		return 0
+	}
+	w := pendingWrite{what: what, sent: sent, required: required}
+	if sent > 0 {
+		w.req = s.requests.open(sent)
+	}
+	acks.writes = append(acks.writes, w)
+	if w.req == nil {
+		return 0
+	}
+	return w.req.id
+}
+
+// expectShards is expect for the shards of the chunk hash. Unless the
+// node keeps its local chunks, every shard must be acknowledged for the
+// local copy to be dropped, see dropShardedChunks.
+func (s *FileServer) expectShards(acks *ackSet, hash string, sent int) uint64 {
+	required := acks.level.requiredShards(s.erasure)
+	if s.KeepLocalChunks || sent == 0 {
+		return s.expect(acks, "shards of chunk "+hash, sent, required)
+	}
+	w := pendingWrite{
+		req:      s.requests.open(sent),
+		what:     "shards of chunk " + hash,
+		sent:     sent,
+		required: required,
+		chunk:    hash,
+	}
+	acks.writes = append(acks.writes, w)
+	return w.req.id
+}
+
+// waitAcks waits until every write got enough acks, or RequestTimeout
+// passed. The requests of the writes are closed by closeAcks.
+func (s *FileServer) waitAcks(acks *ackSet) error {
+	timeout := time.After(s.RequestTimeout)
+	for i := range acks.writes {
+		w := &acks.writes[i]
+		for w.acked < w.required {
+			if w.replied == w.sent {
+				return fmt.Errorf("%w: (%s) was stored by (%d) of (%d) peers", ErrNotEnoughReplicas, w.what, w.acked, w.required)
+			}
+			select {
+			case resp := <-w.req.respch:
+				s.countAck(w, resp)
+			case <-timeout:
+				return fmt.Errorf("%w: (%s) was stored by (%d) of (%d) peers in time", ErrNotEnoughReplicas, w.what, w.acked, w.required)
+			}
+		}
+	}
+	return nil
+}
+
+// countAck counts the reply resp of a peer to the write w.
+func (s *FileServer) countAck(w *pendingWrite, resp response) {
+	w.replied++
+	ack, ok := resp.Msg.Payload.(StoreAck)
+	if !ok {
+		discardResponse(resp)
+		return
+	}
+	if len(ack.Err) > 0 {
+		log.Printf("(%s): (%s) failed to store (%s): %s", s.StorageFolder, resp.From, w.what, ack.Err)
+		return
+	}
+	w.acked++
+}
+
+// closeAcks closes the requests of the writes.
+func (s *FileServer) closeAcks(acks *ackSet) {
+	for _, w := range acks.writes {
+		if w.req != nil {
+			s.requests.close(w.req)
+		}
+	}
+	acks.writes = nil
+}
+
+// sendAck acknowledges the write of the request id, unless
+// the peer did not ask for an ack.
+func (s *FileServer) sendAck(from string, id uint64, err error) error {
+	if id == 0 {
+		return err
+	}
+	peer, ok := s.peer(from)
+	if !ok {
+		return errors.Join(err, fmt.Errorf("(%s): peer (%s) not found", s.StorageFolder, from))
+	}
+	var ack StoreAck
+	if err != nil {
+		ack.Err = err.Error()
+	}
+	return errors.Join(err, s.sendMessage(peer, &Message{ID: id, Payload: ack}))
+}
+
+// readManifest returns the newest manifest of a file stored by this
+// node that required of its replicas agree on, the local one included.
+func (s *FileServer) readManifest(key string, required int) (FileMeta, error) {
+	manifests := []FileMeta{}
+	if meta, ok := s.catalog.Get(s.ID, key); ok {
+		manifests = append(manifests, meta)
+	}
+	owners, _ := s.placement(hashKey(key))
+	if len(manifests)+len(owners) < required {
+		return FileMeta{}, fmt.Errorf("%w: (%s) can only be read from (%d) of (%d) replicas", ErrNotEnoughReplicas, key, len(manifests)+len(owners), required)
+	}
+	manifests = append(manifests, s.collectManifests(key, owners)...)
+	if len(manifests) == 0 {
+		return FileMeta{}, ErrFileNotFound
+	}
+
+	newest := manifests[0]
+	for _, meta := range manifests[1:] {
+		if meta.Created.After(newest.Created) {
+			newest = meta
+		}
+	}
+	confirmed := 0
+	for _, meta := range manifests {
+		if meta.Hash == newest.Hash && meta.Created.Equal(newest.Created) {
+			confirmed++
+		}
+	}
+	if confirmed < required {
+		return FileMeta{}, fmt.Errorf("%w: (%s) was confirmed by (%d) of (%d) replicas", ErrNotEnoughReplicas, key, confirmed, required)
+	}
+	if local, ok := s.catalog.Get(s.ID, key); !ok || !local.Created.Equal(newest.Created) {
+		log.Printf("(%s): updating the stale manifest of file (%s) from its replicas", s.StorageFolder, key)
+		if err := s.catalog.Put(newest); err != nil {
+			return newest, err
+		}
+	}
+	return newest, nil
+}
+
+// collectManifests asks peers for the manifest of a file stored by this
+// node, and returns the ones received before RequestTimeout.
+func (s *FileServer) collectManifests(key string, peers []p2p.Peer) []FileMeta {
+	if len(peers) == 0 {
+		return nil
+	}
+	req := s.requests.open(len(peers))
+	defer s.requests.close(req)
+	msg := &Message{
+		ID:      req.id,
+		Payload: GetFileInstruction{ServerID: s.ID, FileKey: hashKey(key)},
+	}
+	waiting, err := s.multicastMessage(peers, msg)
+	if err != nil {
+		log.Printf("(%s): failed to ask for the manifest of (%s): %s", s.StorageFolder, key, err)
+	}
+
+	manifests := []FileMeta{}
+	timeout := time.After(s.RequestTimeout)
+	for ; waiting > 0; waiting-- {
+		select {
+		case resp := <-req.respch:
+			payload, ok := resp.Msg.Payload.(GetFileResponse)
+			if !ok || resp.Stream != nil {
+				discardResponse(resp)
+				continue
+			}
+			if payload.Found && payload.Meta.Key == key {
+				manifests = append(manifests, payload.Meta)
+			}
+		case <-timeout:
+			return manifests
+		}
+	}
+	return manifests
+}
@@ -1,14 +1,38 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"io"
+	"math"
 )
 
+// gcmMagic starts every stream written by copyEncrypt. Streams that do
+// not start with it are rejected, unless they are migrated with
+// copyDecryptLegacy.
+var gcmMagic = []byte("DFSGCM01")
+
+const (
+	// gcmChunkSize is the amount of plaintext sealed in a single chunk.
+	gcmChunkSize = 64 * 1024
+	// gcmNoncePrefixSize is the size of the random part of the chunk nonces,
+	// the rest of the nonce is the chunk index and the final chunk flag.
+	gcmNoncePrefixSize = 7
+	gcmHeaderSize      = 8 + gcmNoncePrefixSize
+	gcmTagSize         = 16
+)
+
+// ErrDecrypt is returned when a stream fails authentication, this
+// happens when the data was tampered with, truncated, or reordered.
+var ErrDecrypt = errors.New("message authentication failed")
+
 // generateID generates a random ID and returns it in string format
 func generateID() string {
 	buf := make([]byte, 32)
@@ -29,8 +53,166 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
-// copyEncrypt encrypts the contents of src and copies the result into the dst
+// encryptedSize returns the size of the stream copyEncrypt
+// writes for size bytes of plaintext.
+func encryptedSize(size int64) int64 {
+	chunks := (size + gcmChunkSize - 1) / gcmChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return gcmHeaderSize + size + chunks*gcmTagSize
+}
+
+// copyEncrypt encrypts the contents of src and copies the result into the dst.
+// The plaintext is split into chunks that are sealed with AES-GCM, every
+// chunk nonce holds the chunk index and whether it is the final chunk.
+// It returns the number of bytes written to dst.
 func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, gcmHeaderSize)
+	copy(header, gcmMagic)
+	prefix := header[len(gcmMagic):]
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return 0, err
+	}
+	nw, err := dst.Write(header)
+	if err != nil {
+		return int64(nw), err
+	}
+
+	var (
+		written = int64(nw)
+		br      = bufio.NewReaderSize(src, gcmChunkSize)
+		buf     = make([]byte, gcmChunkSize, gcmChunkSize+gcmTagSize)
+	)
+	for index := uint64(0); ; index++ {
+		if index > math.MaxUint32 {
+			return written, errors.New("stream too large to encrypt")
+		}
+		nr, err := io.ReadFull(br, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return written, err
+		}
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+		sealed := aead.Seal(buf[:0], gcmNonce(prefix, uint32(index), final), buf[:nr], nil)
+		nw, err := dst.Write(sealed)
+		written += int64(nw)
+		if err != nil {
+			return written, err
+		}
+		if final {
+			return written, nil
+		}
+	}
+}
+
+// copyDecrypt decryts the contents of src and copies the result into the dst.
+// Streams written by copyEncrypt are authenticated chunk by chunk, an error is
+// returned as soon as a chunk fails, so dst may hold a prefix of the plaintext.
+// Streams without the AES-GCM header fail like tampered ones.
+// It returns the number of plaintext bytes written to dst.
+func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	magic := make([]byte, len(gcmMagic))
+	if _, err := io.ReadFull(src, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, ErrDecrypt
+		}
+		return 0, err
+	}
+	if !bytes.Equal(magic, gcmMagic) {
+		return 0, ErrDecrypt
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+	prefix := make([]byte, gcmNoncePrefixSize)
+	if _, err := io.ReadFull(src, prefix); err != nil {
+		return 0, ErrDecrypt
+	}
+
+	var (
+		written int64
+		br      = bufio.NewReaderSize(src, gcmChunkSize+gcmTagSize)
+		buf     = make([]byte, gcmChunkSize+gcmTagSize)
+	)
+	for index := uint64(0); index <= math.MaxUint32; index++ {
+		nr, err := io.ReadFull(br, buf)
+		final := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !final {
+			return written, err
+		}
+		if !final {
+			if _, err := br.Peek(1); err == io.EOF {
+				final = true
+			}
+		}
+		plain, err := aead.Open(buf[:0], gcmNonce(prefix, uint32(index), final), buf[:nr], nil)
+		if err != nil {
+			return written, ErrDecrypt
+		}
+		nw, err := dst.Write(plain)
+		written += int64(nw)
+		if err != nil {
+			return written, err
+		}
+		if final {
+			return written, nil
+		}
+	}
+	return written, ErrDecrypt
+}
+
+// copyDecryptLegacy decrypts streams written by copyEncrypt like copyDecrypt,
+// and streams without the AES-GCM header as legacy AES-CTR streams. The
+// legacy format is not authenticated, a tampered header turns a stream into
+// garbage without an error, so it is only used to migrate old objects.
+func copyDecryptLegacy(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+	magic := make([]byte, len(gcmMagic))
+	n, err := io.ReadFull(src, magic)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	src = io.MultiReader(bytes.NewReader(magic[:n]), src)
+	if bytes.Equal(magic, gcmMagic) {
+		return copyDecrypt(key, src, dst)
+	}
+	return copyDecryptCTR(key, src, dst)
+}
+
+// newGCM returns an AES-GCM AEAD for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmNonce returns the nonce of a chunk, the random prefix
+// followed by the chunk index and the final chunk flag.
+func gcmNonce(prefix []byte, index uint32, final bool) []byte {
+	nonce := make([]byte, gcmNoncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[gcmNoncePrefixSize:], index)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// copyEncryptCTR encrypts the contents of src into dst with the legacy
+// unauthenticated AES-CTR format. It is only kept to test migrations.
+func copyEncryptCTR(key []byte, src io.Reader, dst io.Writer) (int64, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return 0, err
@@ -42,20 +224,22 @@ func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
 	}
 	// Prepend the iv to the file
 	if _, err := dst.Write(iv); err != nil {
-		return 0, nil
+		return 0, err
 	}
-	return writeCryptStream(src, dst, block, iv)
+	n, err := writeCryptStream(src, dst, block, iv)
+	return int64(len(iv)) + n, err
 }
 
-// copyDecrypt decryts the contents of src and copies the result into the dst
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
+// copyDecryptCTR decrypts the contents of src written in the legacy
+// AES-CTR format and copies the result into the dst.
+func copyDecryptCTR(key []byte, src io.Reader, dst io.Writer) (int64, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return 0, err
 	}
 	// Get the iv
 	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 	return writeCryptStream(src, dst, block, iv)
@@ -63,28 +247,29 @@ func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int64, error) {
 
 // writeCryptStream handles encpypting/decrypting data from src to dst,
 // if src is encpyped data, it decryts, if src is decrypted data, it encrypts.
+// It returns the number of bytes written to dst.
 func writeCryptStream(src io.Reader, dst io.Writer, block cipher.Block, iv []byte) (int64, error) {
 	var (
 		buf    = make([]byte, 32*1024)
 		stream = cipher.NewCTR(block, iv)
-		nw     = block.BlockSize()
+		nw     int64
 	)
 	for {
 		nr, err := src.Read(buf)
 		if nr > 0 {
 			stream.XORKeyStream(buf, buf[:nr])
 			n, err := dst.Write(buf[:nr])
+			nw += int64(n)
 			if err != nil {
-				return 0, nil
+				return nw, err
 			}
-			nw += n
 		}
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return 0, nil
+			return nw, err
 		}
 	}
-	return int64(nw), nil
+	return nw, nil
 }
@@ -13,20 +13,111 @@ func TestCopyEncryptDycrypt(t *testing.T) {
 	dst := new(bytes.Buffer)
 	key := newEncryptionKey()
 
-	_, err := copyEncrypt(key, src, dst)
+	n, err := copyEncrypt(key, src, dst)
 	if err != nil {
 		t.Fatal(err)
 	}
+	assert.EqualValues(t, encryptedSize(int64(len(data))), n)
+	assert.EqualValues(t, dst.Len(), n)
 
 	out := new(bytes.Buffer)
-	n, err := copyDecrypt(key, dst, out)
+	n, err = copyDecrypt(key, dst, out)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if n != int64(16+len(data)) {
+	if n != int64(len(data)) {
 		t.Fatal("Invalid length!")
 	}
 
 	assert.EqualValues(t, string(data), out.String(), "Decrption failed!")
 }
+
+func TestCopyEncryptDecryptChunkBoundaries(t *testing.T) {
+	key := newEncryptionKey()
+	for _, size := range []int{0, 1, gcmChunkSize - 1, gcmChunkSize, gcmChunkSize + 1, 3 * gcmChunkSize} {
+		data := bytes.Repeat([]byte{0xab}, size)
+		enc := new(bytes.Buffer)
+		_, err := copyEncrypt(key, bytes.NewReader(data), enc)
+		assert.Nil(t, err)
+		assert.EqualValues(t, encryptedSize(int64(size)), enc.Len())
+
+		out := new(bytes.Buffer)
+		_, err = copyDecrypt(key, enc, out)
+		assert.Nil(t, err)
+		assert.Equal(t, size, out.Len())
+		assert.True(t, bytes.Equal(data, out.Bytes()))
+	}
+}
+
+func TestCopyDecryptDetectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	data := bytes.Repeat([]byte("tamper"), gcmChunkSize)
+	enc := new(bytes.Buffer)
+	_, err := copyEncrypt(key, bytes.NewReader(data), enc)
+	assert.Nil(t, err)
+	sealed := enc.Bytes()
+	chunk := gcmChunkSize + gcmTagSize
+
+	flipped := bytes.Clone(sealed)
+	flipped[gcmHeaderSize+10] ^= 0x1
+
+	// A flipped header byte must not downgrade the stream to AES-CTR.
+	magic := bytes.Clone(sealed)
+	magic[0] ^= 0x1
+	prefix := bytes.Clone(sealed)
+	prefix[len(gcmMagic)] ^= 0x1
+
+	// Drop the final chunk, ending the stream on a chunk boundary.
+	truncated := bytes.Clone(sealed[:gcmHeaderSize+2*chunk])
+
+	// Swap the first two chunks.
+	reordered := bytes.Clone(sealed)
+	copy(reordered[gcmHeaderSize:], sealed[gcmHeaderSize+chunk:gcmHeaderSize+2*chunk])
+	copy(reordered[gcmHeaderSize+chunk:], sealed[gcmHeaderSize:gcmHeaderSize+chunk])
+
+	for name, b := range map[string][]byte{
+		"tampered":  flipped,
+		"magic":     magic,
+		"prefix":    prefix,
+		"truncated": truncated,
+		"reordered": reordered,
+		"extended":  append(bytes.Clone(sealed), 0x0),
+		"empty":     nil,
+	} {
+		_, err := copyDecrypt(key, bytes.NewReader(b), new(bytes.Buffer))
+		assert.ErrorIs(t, err, ErrDecrypt, name)
+	}
+
+	_, err = copyDecrypt(newEncryptionKey(), bytes.NewReader(sealed), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestCopyDecryptLegacyCTR(t *testing.T) {
+	key := newEncryptionKey()
+	data := []byte("written before the switch to AES-GCM")
+	enc := new(bytes.Buffer)
+	n, err := copyEncryptCTR(key, bytes.NewReader(data), enc)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 16+len(data), n)
+
+	// Only the migration path reads the unauthenticated format.
+	_, err = copyDecrypt(key, bytes.NewReader(enc.Bytes()), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrDecrypt)
+	out := new(bytes.Buffer)
+	_, err = copyDecryptLegacy(key, enc, out)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out.Bytes())
+
+	// It still authenticates AES-GCM streams.
+	gcm := new(bytes.Buffer)
+	_, err = copyEncrypt(key, bytes.NewReader(data), gcm)
+	assert.Nil(t, err)
+	out.Reset()
+	_, err = copyDecryptLegacy(key, bytes.NewReader(gcm.Bytes()), out)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out.Bytes())
+	gcm.Bytes()[gcm.Len()-1] ^= 0x1
+	_, err = copyDecryptLegacy(key, gcm, new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrDecrypt)
+}
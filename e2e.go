@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Files a Client encrypts never reach the nodes in plaintext. The client
+// seals every file with its own data key, wrapped by a key derived from
+// a passphrase or read from a key file, and the node stores the result
+// like any other file:
+//
+//	magic (8) | Argon2id time (1) | memory log2(KiB) (1) | threads (1) | salt (16) | envelope
+//
+// where the envelope is the one of sealEnvelope. The Argon2id cost is 0
+// for files sealed with a key file, and the salt is then unused. Nodes never see
+// any of the keys, so they can not read or rewrap these files.
+var clientMagic = []byte("DFSE2E01")
+
+const (
+	clientSaltSize   = 16
+	clientCostSize   = 3
+	clientHeaderSize = 8 + clientCostSize + clientSaltSize
+
+	// maxArgon2Time, maxArgon2LogMemory and maxArgon2Threads bound the
+	// cost of a file, so a node can not make a client use more than
+	// 1 GiB of memory or more time than needed to read it.
+	maxArgon2Time      = 10
+	maxArgon2LogMemory = 20
+	maxArgon2Threads   = 16
+)
+
+// DefaultArgon2Cost is the Argon2id cost of the keys derived from a
+// passphrase, the second recommendation of RFC 9106: 3 passes over
+// 64 MiB of memory with 4 threads.
+var DefaultArgon2Cost = Argon2Cost{Time: 3, LogMemory: 16, Threads: 4}
+
+// Argon2Cost is the cost of deriving a key from a passphrase with Argon2id.
+type Argon2Cost struct {
+	// Time is the number of passes over the memory.
+	Time uint8
+	// LogMemory is the log2 of the memory used, in KiB.
+	LogMemory uint8
+	Threads   uint8
+}
+
+// check returns an error if the cost is out of bounds.
+func (c Argon2Cost) check() error {
+	if c.Time < 1 || c.Time > maxArgon2Time || c.LogMemory > maxArgon2LogMemory || c.Threads < 1 || c.Threads > maxArgon2Threads {
+		return fmt.Errorf("file has an Argon2id cost out of bounds: (%d) passes over 2^%d KiB with (%d) threads", c.Time, c.LogMemory, c.Threads)
+	}
+	return nil
+}
+
+// ErrNotClientEncrypted is returned when a client with a ClientKey
+// reads a file that was not encrypted by a client.
+var ErrNotClientEncrypted = errors.New("file is not encrypted by the client")
+
+// ErrWrongClientKey is returned when a file was encrypted with another
+// passphrase or key file than the one of the client.
+var ErrWrongClientKey = errors.New("file is encrypted with another passphrase or key file")
+
+// ClientKey is the key a Client encrypts files with before they
+// are sent to the node, see PassphraseKey and LoadClientKey.
+type ClientKey struct {
+	// key is the key of a key file, passphrase the passphrase
+	// keys are derived from. Only one of them is set.
+	key        []byte
+	passphrase []byte
+	// cost is the Argon2id cost of the files the key seals.
+	cost Argon2Cost
+}
+
+// PassphraseKey returns a ClientKey deriving the keys of every
+// file from passphrase and a random salt with Argon2id.
+func PassphraseKey(passphrase string) *ClientKey {
+	return &ClientKey{passphrase: []byte(passphrase), cost: DefaultArgon2Cost}
+}
+
+// NewClientKey writes a new random key to the key file in path,
+// which must not exist yet, and returns it.
+func NewClientKey(path string) (*ClientKey, error) {
+	key := newEncryptionKey()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(hex.EncodeToString(key) + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return &ClientKey{key: key}, nil
+}
+
+// LoadClientKey reads the key file in path, holding a hex encoded
+// 32 byte key. Like the identity file, it must only be accessible
+// by its owner.
+func LoadClientKey(path string) (*ClientKey, error) {
+	b, err := readPrivateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("key file (%s) does not hold a hex encoded 32 byte key", path)
+	}
+	return &ClientKey{key: key}, nil
+}
+
+// keyring returns a keyring holding the key that wraps the data keys
+// of files with the given Argon2id cost and salt. Its ID is derived
+// from the key, so a file wrapped by another key is told apart before
+// the unwrap fails.
+func (k *ClientKey) keyring(cost Argon2Cost, salt []byte) (*Keyring, error) {
+	key := k.key
+	if cost != (Argon2Cost{}) {
+		if k.passphrase == nil {
+			return nil, errors.New("file is encrypted with a passphrase, not a key file")
+		}
+		if err := cost.check(); err != nil {
+			return nil, err
+		}
+		key = argon2.IDKey(k.passphrase, salt, uint32(cost.Time), 1<<cost.LogMemory, cost.Threads, 32)
+	} else if k.key == nil {
+		return nil, errors.New("file is encrypted with a key file, not a passphrase")
+	}
+	sum := sha256.Sum256(key)
+	id := hex.EncodeToString(sum[:kekIDSize/2])
+	return &Keyring{active: id, keys: []kek{{ID: id, Key: hex.EncodeToString(key)}}}, nil
+}
+
+// seal encrypts src and writes it to dst.
+func (k *ClientKey) seal(src io.Reader, dst io.Writer) error {
+	header := make([]byte, clientHeaderSize)
+	copy(header, clientMagic)
+	var cost Argon2Cost
+	if k.passphrase != nil {
+		cost = k.cost
+		header[len(clientMagic)] = cost.Time
+		header[len(clientMagic)+1] = cost.LogMemory
+		header[len(clientMagic)+2] = cost.Threads
+		if _, err := io.ReadFull(rand.Reader, header[len(clientMagic)+clientCostSize:]); err != nil {
+			return err
+		}
+	}
+	keyring, err := k.keyring(cost, header[len(clientMagic)+clientCostSize:])
+	if err != nil {
+		return err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+	_, err = sealEnvelope(keyring, src, dst)
+	return err
+}
+
+// open decrypts a file written by seal to dst.
+func (k *ClientKey) open(src io.Reader, dst io.Writer) error {
+	header := make([]byte, clientHeaderSize+envelopeHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ErrNotClientEncrypted
+		}
+		return err
+	}
+	envelope := header[clientHeaderSize:]
+	if _, ok := envelopeKEK(envelope); !ok || !bytes.HasPrefix(header, clientMagic) {
+		return ErrNotClientEncrypted
+	}
+	cost := Argon2Cost{
+		Time:      header[len(clientMagic)],
+		LogMemory: header[len(clientMagic)+1],
+		Threads:   header[len(clientMagic)+2],
+	}
+	keyring, err := k.keyring(cost, header[len(clientMagic)+clientCostSize:clientHeaderSize])
+	if err != nil {
+		return err
+	}
+	_, err = openEnvelope(keyring, nil, io.MultiReader(bytes.NewReader(envelope), src), dst)
+	if errors.Is(err, ErrUnknownKEK) {
+		return ErrWrongClientKey
+	}
+	return err
+}
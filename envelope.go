@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/muhreeowki/dfs/p2p"
+)
+
+// ErrKEKInUse is returned when retiring a key that still wraps data keys.
+var ErrKEKInUse = errors.New("key-encryption key still wraps data keys")
+
+// GetKeyHeadersInstruction is a Message Payload asking a peer for the
+// envelope headers of the objects it holds for the node ServerID.
+type GetKeyHeadersInstruction struct {
+	ServerID string
+}
+
+// KeyHeadersResponse is a Message Payload reply to a GetKeyHeadersInstruction,
+// holding the envelope header of every object by its key.
+type KeyHeadersResponse struct {
+	Headers map[string][]byte
+	Err     string
+}
+
+// RewrapKeysInstruction is a Message Payload instruction to replace the
+// envelope headers of objects held for the node ServerID. It is answered
+// with a StoreAck.
+type RewrapKeysInstruction struct {
+	ServerID string
+	Rewraps  []KeyRewrap
+}
+
+// KeyRewrap replaces the envelope header Old of the object Key with New.
+// Objects that do not start with Old anymore are left alone.
+type KeyRewrap struct {
+	Key      string
+	Old, New []byte
+}
+
+// KeyRotation is the outcome of RotateKeys.
+type KeyRotation struct {
+	// KeyID is the new active key.
+	KeyID string
+	// Previous are the older keys, which can be retired
+	// once the rotation reached every peer.
+	Previous []string
+	// Rewrapped is the number of data keys wrapped by the new key.
+	Rewrapped int
+}
+
+// seal encrypts an object sent to peers, see sealEnvelope.
+func (s *FileServer) seal(src io.Reader, dst io.Writer, peers ...p2p.Peer) (int64, error) {
+	ids := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		ids = append(ids, peerKey(peer))
+	}
+	return sealEnvelope(s.Keyring, src, dst, ids...)
+}
+
+// open decrypts an object of the chunk hash sealed by this node,
+// see openEnvelope.
+func (s *FileServer) open(hash string, src io.Reader, dst io.Writer) (int64, error) {
+	return openEnvelope(s.Keyring, s.legacyDecrypt(hash), src, dst)
+}
+
+// legacyDecrypt returns how an object of the chunk hash sent to peers
+// before envelope encryption is decrypted, or nil when there is no
+// legacy key. Only chunks of files stored before the keyring was
+// created are decrypted, others fail with ErrDecrypt. Legacy AES-CTR
+// objects are only decrypted when MigrateCTR is set.
+func (s *FileServer) legacyDecrypt(hash string) decryptFunc {
+	key := s.Encryptionkey
+	if key == nil {
+		return nil
+	}
+	return func(src io.Reader, dst io.Writer) (int64, error) {
+		if !s.catalog.StoredBefore(s.ID, hash, s.Keyring.Since()) {
+			return 0, ErrDecrypt
+		}
+		if s.MigrateCTR {
+			return copyDecryptLegacy(key, src, dst)
+		}
+		return copyDecrypt(key, src, dst)
+	}
+}
+
+// RotateKeys adds a new key-encryption key to the keyring and rewraps the
+// data keys of the objects the connected peers hold for this node with it.
+// Only the envelope headers are rewritten, the bodies stay as they are.
+// Peers that are not connected keep data keys wrapped by the older keys,
+// so those can only be retired once the rotation is run again with them.
+// A peer that reported its objects and took every rewrap is released
+// from the holders of the older keys.
+func (s *FileServer) RotateKeys() (KeyRotation, error) {
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+	id, err := s.Keyring.Rotate()
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	rot := KeyRotation{KeyID: id}
+	for _, kid := range s.Keyring.IDs() {
+		if kid != id {
+			rot.Previous = append(rot.Previous, kid)
+		}
+	}
+	log.Printf("(%s): rotated to key-encryption key (%s)", s.StorageFolder, id)
+
+	peers := s.peerList()
+	headers, err := s.collectKeyHeaders(peers)
+	for _, peer := range peers {
+		objects, ok := headers[peerKey(peer)]
+		if !ok {
+			continue
+		}
+		rewraps := []KeyRewrap{}
+		failed := false
+		for key, header := range objects {
+			if kid, _ := envelopeKEK(header); kid == id {
+				continue
+			}
+			wrapped, rerr := s.Keyring.rewrap(header, peerKey(peer))
+			if rerr != nil {
+				err = errors.Join(err, fmt.Errorf("object (%s) on (%s): %w", key, peerKey(peer), rerr))
+				failed = true
+				continue
+			}
+			rewraps = append(rewraps, KeyRewrap{Key: key, Old: header, New: wrapped})
+		}
+		if len(rewraps) > 0 {
+			if rerr := s.rewrapOn(peer, rewraps); rerr != nil {
+				err = errors.Join(err, rerr)
+				continue
+			}
+			rot.Rewrapped += len(rewraps)
+		}
+		if !failed {
+			err = errors.Join(err, s.Keyring.Release(peerKey(peer), id))
+		}
+	}
+	log.Printf("(%s): rewrapped (%d) data keys with key-encryption key (%s)", s.StorageFolder, rot.Rewrapped, id)
+	return rot, err
+}
+
+// RetireKey removes a key-encryption key from the keyring, once none of
+// the peers holds an object whose data key it still wraps. Every peer
+// the key wrapped data keys for, see Keyring.Holders, must be connected
+// to report its objects, it is refused otherwise.
+func (s *FileServer) RetireKey(id string) error {
+	s.keyLock.Lock()
+	defer s.keyLock.Unlock()
+	if id == s.Keyring.Active() {
+		return fmt.Errorf("key (%s) is the active key, rotate the keys first", id)
+	}
+	peers := s.peerList()
+	connected := make(map[string]bool, len(peers))
+	for _, peer := range peers {
+		connected[peerKey(peer)] = true
+	}
+	var missing []string
+	for _, holder := range s.Keyring.Holders(id) {
+		if !connected[holder] {
+			missing = append(missing, holder)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("key (%s) wrapped data keys for peers that are not connected (%s): %w", id, strings.Join(missing, ", "), ErrKEKInUse)
+	}
+	headers, err := s.collectKeyHeaders(peers)
+	if err != nil {
+		return fmt.Errorf("key (%s) not retired: %w", id, err)
+	}
+	wrapped := 0
+	for _, objects := range headers {
+		for _, header := range objects {
+			if kid, _ := envelopeKEK(header); kid == id {
+				wrapped++
+			}
+		}
+	}
+	if wrapped > 0 {
+		return fmt.Errorf("key (%s) wraps (%d) data keys: %w", id, wrapped, ErrKEKInUse)
+	}
+	if err := s.Keyring.Retire(id); err != nil {
+		return err
+	}
+	log.Printf("(%s): retired key-encryption key (%s)", s.StorageFolder, id)
+	return nil
+}
+
+// collectKeyHeaders asks peers for the envelope headers of the objects
+// they hold for this node, and returns them by peer. It fails when a
+// peer did not reply before RequestTimeout.
+func (s *FileServer) collectKeyHeaders(peers []p2p.Peer) (map[string]map[string][]byte, error) {
+	headers := make(map[string]map[string][]byte)
+	if len(peers) == 0 {
+		return headers, nil
+	}
+	req := s.requests.open(len(peers))
+	defer s.requests.close(req)
+	msg := &Message{
+		ID:      req.id,
+		Payload: GetKeyHeadersInstruction{ServerID: s.ID},
+	}
+	waiting, err := s.multicastMessage(peers, msg)
+	var errs []error
+	if err != nil {
+		errs = append(errs, err)
+	}
+	timeout := time.After(s.RequestTimeout)
+	for ; waiting > 0; waiting-- {
+		select {
+		case resp := <-req.respch:
+			payload, ok := resp.Msg.Payload.(KeyHeadersResponse)
+			if !ok || resp.Stream != nil {
+				discardResponse(resp)
+				errs = append(errs, fmt.Errorf("unexpected reply %T from (%s)", resp.Msg.Payload, resp.From))
+				continue
+			}
+			if len(payload.Err) > 0 {
+				errs = append(errs, fmt.Errorf("(%s): %s", resp.From, payload.Err))
+				continue
+			}
+			headers[resp.From] = payload.Headers
+		case <-timeout:
+			errs = append(errs, fmt.Errorf("(%d) peers did not report their key headers: %w", waiting, ErrRequestTimeout))
+			return headers, errors.Join(errs...)
+		}
+	}
+	return headers, errors.Join(errs...)
+}
+
+// rewrapOn sends rewraps to peer and waits for it to apply them.
+func (s *FileServer) rewrapOn(peer p2p.Peer, rewraps []KeyRewrap) error {
+	req := s.requests.open(1)
+	defer s.requests.close(req)
+	msg := &Message{
+		ID:      req.id,
+		Payload: RewrapKeysInstruction{ServerID: s.ID, Rewraps: rewraps},
+	}
+	if err := s.sendMessage(peer, msg); err != nil {
+		return err
+	}
+	select {
+	case resp := <-req.respch:
+		ack, ok := resp.Msg.Payload.(StoreAck)
+		if !ok {
+			discardResponse(resp)
+			return fmt.Errorf("unexpected reply %T from (%s)", resp.Msg.Payload, resp.From)
+		}
+		if len(ack.Err) > 0 {
+			return fmt.Errorf("(%s) failed to rewrap data keys: %s", resp.From, ack.Err)
+		}
+		return nil
+	case <-time.After(s.RequestTimeout):
+		return fmt.Errorf("(%s) did not rewrap data keys: %w", peerKey(peer), ErrRequestTimeout)
+	}
+}
+
+// handleGetKeyHeaders replies with the envelope headers of the objects
+// held for the node payload.ServerID, which must be the peer itself.
+func (s *FileServer) handleGetKeyHeaders(from string, id uint64, payload GetKeyHeadersInstruction) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("(%s): peer (%s) not found", s.StorageFolder, from)
+	}
+	if payload.ServerID != from {
+		err := fmt.Errorf("peer (%s) can not read the key headers of (%s)", from, payload.ServerID)
+		return errors.Join(err, s.sendMessage(peer, &Message{ID: id, Payload: KeyHeadersResponse{Err: err.Error()}}))
+	}
+	var (
+		resp      = KeyHeadersResponse{Headers: make(map[string][]byte)}
+		namespace = chunkNamespace(payload.ServerID)
+	)
+	err := s.store.WalkChecksums(func(ns, key string) error {
+		if ns != namespace {
+			return nil
+		}
+		header, err := s.readKeyHeader(ns, key)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if header != nil {
+			resp.Headers[key] = header
+		}
+		return nil
+	})
+	if err != nil {
+		resp = KeyHeadersResponse{Err: err.Error()}
+	}
+	return errors.Join(err, s.sendMessage(peer, &Message{ID: id, Payload: resp}))
+}
+
+// handleRewrapKeys replaces the envelope headers of objects held for
+// the node payload.ServerID, which must be the peer itself, and
+// acknowledges it.
+func (s *FileServer) handleRewrapKeys(from string, id uint64, payload RewrapKeysInstruction) error {
+	keys := make([]string, 0, len(payload.Rewraps))
+	for _, r := range payload.Rewraps {
+		keys = append(keys, r.Key)
+	}
+	if err := checkOwner(from, payload.ServerID, keys...); err != nil {
+		return s.sendAck(from, id, err)
+	}
+	var errs []error
+	for _, r := range payload.Rewraps {
+		if _, ok := envelopeKEK(r.New); !ok {
+			errs = append(errs, fmt.Errorf("invalid rewrap of (%s)", r.Key))
+			continue
+		}
+		if err := s.rewrapObject(chunkNamespace(payload.ServerID), r.Key, r.Old, r.New); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	log.Printf("(%s): rewrapped (%d) data keys of (%s)", s.StorageFolder, len(payload.Rewraps)-len(errs), payload.ServerID)
+	return s.sendAck(from, id, errors.Join(errs...))
+}
+
+// readKeyHeader returns the envelope header of an object,
+// or nil if the object predates envelope encryption.
+func (s *FileServer) readKeyHeader(namespace, key string) ([]byte, error) {
+	_, r, err := s.store.Read(namespace, key)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	header := make([]byte, envelopeHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil
+	}
+	if _, ok := envelopeKEK(header); !ok {
+		return nil, nil
+	}
+	return header, nil
+}
+
+// rewrapObject replaces the envelope header old of an object with
+// header. The body is copied as it is, and the object is replaced
+// atomically. Objects deleted or replaced since are left alone.
+func (s *FileServer) rewrapObject(namespace, key string, old, header []byte) error {
+	_, r, err := s.store.Read(namespace, key)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	cur := make([]byte, envelopeHeaderSize)
+	if _, err := io.ReadFull(r, cur); err != nil || !bytes.Equal(cur, old) {
+		return nil
+	}
+	_, err = s.store.Write(namespace, key, io.MultiReader(bytes.NewReader(header), r))
+	return err
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooFewShards is returned when fewer shards than data shards
+// are available to reconstruct the data.
+var ErrTooFewShards = errors.New("too few shards to reconstruct")
+
+// The tables of GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1,
+// gfExp is doubled so the sum of two logarithms never needs a modulo.
+var gfExp, gfLog = func() (exp [510]byte, log [256]byte) {
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i], exp[i+255] = byte(x), byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+// gfMulAdd adds c times src to dst.
+func gfMulAdd(c byte, src, dst []byte) {
+	if c == 0 {
+		return
+	}
+	lc := int(gfLog[c])
+	for i, b := range src {
+		if b != 0 {
+			dst[i] ^= gfExp[lc+int(gfLog[b])]
+		}
+	}
+}
+
+// ReedSolomon is a systematic Reed-Solomon erasure code. Data is split
+// into DataShards shards, and ParityShards shards are computed from them,
+// so the data can be reconstructed from any DataShards of the shards.
+type ReedSolomon struct {
+	DataShards   int
+	ParityShards int
+	// matrix computes every shard from the data shards. Its top rows
+	// are the identity, so the data shards are the data itself.
+	matrix [][]byte
+}
+
+// NewReedSolomon returns a ReedSolomon code with k data and m parity shards.
+func NewReedSolomon(k, m int) (*ReedSolomon, error) {
+	if k <= 0 || m <= 0 || k+m > 256 {
+		return nil, fmt.Errorf("invalid erasure code %d+%d: both must be positive, with at most 256 shards", k, m)
+	}
+	// Any k rows of a Vandermonde matrix are invertible, multiplying it by
+	// the inverse of its top k rows keeps it so and makes the code systematic.
+	vandermonde := make([][]byte, k+m)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, k)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := gfInvert(vandermonde[:k])
+	if err != nil {
+		return nil, err
+	}
+	return &ReedSolomon{
+		DataShards:   k,
+		ParityShards: m,
+		matrix:       gfMatMul(vandermonde, top),
+	}, nil
+}
+
+// Shards returns the total number of shards.
+func (rs *ReedSolomon) Shards() int {
+	return rs.DataShards + rs.ParityShards
+}
+
+// Split splits data into data shards of equal size, padded with
+// zeros, followed by empty parity shards for Encode to compute.
+func (rs *ReedSolomon) Split(data []byte) [][]byte {
+	size := max((len(data)+rs.DataShards-1)/rs.DataShards, 1)
+	buf := make([]byte, size*rs.Shards())
+	copy(buf, data)
+	shards := make([][]byte, rs.Shards())
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return shards
+}
+
+// Join returns the data shards joined together, with the padding of Split.
+func (rs *ReedSolomon) Join(shards [][]byte) []byte {
+	data := []byte{}
+	for _, shard := range shards[:rs.DataShards] {
+		data = append(data, shard...)
+	}
+	return data
+}
+
+// Encode computes the parity shards from the data shards.
+func (rs *ReedSolomon) Encode(shards [][]byte) error {
+	if err := rs.check(shards, false); err != nil {
+		return err
+	}
+	rs.encode(shards, shards[rs.DataShards:], rs.matrix[rs.DataShards:])
+	return nil
+}
+
+// encode computes the outputs with the rows from the data shards.
+func (rs *ReedSolomon) encode(shards, outputs [][]byte, rows [][]byte) {
+	for i, out := range outputs {
+		clear(out)
+		for c := 0; c < rs.DataShards; c++ {
+			gfMulAdd(rows[i][c], shards[c], out)
+		}
+	}
+}
+
+// Reconstruct recomputes the missing shards, that are nil,
+// from any DataShards of the others.
+func (rs *ReedSolomon) Reconstruct(shards [][]byte) error {
+	if err := rs.check(shards, true); err != nil {
+		return err
+	}
+	var (
+		size    int
+		present = [][]byte{}
+		rows    = [][]byte{}
+	)
+	for i, shard := range shards {
+		if shard != nil && len(present) < rs.DataShards {
+			present = append(present, shard)
+			rows = append(rows, rs.matrix[i])
+			size = len(shard)
+		}
+	}
+	if len(present) < rs.DataShards {
+		return ErrTooFewShards
+	}
+
+	// The inverse of the rows of the shards that are present
+	// computes the data shards from them.
+	decode, err := gfInvert(rows)
+	if err != nil {
+		return err
+	}
+	for c := 0; c < rs.DataShards; c++ {
+		if shards[c] != nil {
+			continue
+		}
+		shards[c] = make([]byte, size)
+		for j, shard := range present {
+			gfMulAdd(decode[c][j], shard, shards[c])
+		}
+	}
+
+	missing, rows := [][]byte{}, [][]byte{}
+	for i := rs.DataShards; i < rs.Shards(); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			missing = append(missing, shards[i])
+			rows = append(rows, rs.matrix[i])
+		}
+	}
+	rs.encode(shards, missing, rows)
+	return nil
+}
+
+// check checks there are as many shards as the code has, all of
+// the same size. Missing shards are only allowed when missingOK.
+func (rs *ReedSolomon) check(shards [][]byte, missingOK bool) error {
+	if len(shards) != rs.Shards() {
+		return fmt.Errorf("got %d shards, want %d", len(shards), rs.Shards())
+	}
+	size := -1
+	for _, shard := range shards {
+		if shard == nil && missingOK {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return errors.New("shards differ in size")
+		}
+		size = len(shard)
+	}
+	return nil
+}
+
+// gfMatMul returns the product of the matrices a and b.
+func gfMatMul(a, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+		for i, c := range a[r] {
+			gfMulAdd(c, b[i], out[r])
+		}
+	}
+	return out
+}
+
+// gfInvert returns the inverse of the square matrix m with Gauss-Jordan elimination.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	// Work on m augmented with the identity.
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		inv := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], inv)
+		}
+		for r := 0; r < n; r++ {
+			if r != c {
+				gfMulAdd(work[r][c], work[c], work[r])
+			}
+		}
+	}
+	inverse := make([][]byte, n)
+	for r := range inverse {
+		inverse[r] = work[r][n:]
+	}
+	return inverse, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReedSolomon(t *testing.T) {
+	rs, err := NewReedSolomon(4, 2)
+	assert.Nil(t, err)
+
+	data := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(data)
+	shards := rs.Split(data)
+	assert.Len(t, shards, 6)
+	assert.Nil(t, rs.Encode(shards))
+	assert.Equal(t, data, rs.Join(shards)[:len(data)])
+
+	// Any two lost shards can be rebuilt.
+	for i := 0; i < rs.Shards(); i++ {
+		for j := i + 1; j < rs.Shards(); j++ {
+			lost := make([][]byte, len(shards))
+			for k := range shards {
+				lost[k] = bytes.Clone(shards[k])
+			}
+			lost[i], lost[j] = nil, nil
+			assert.Nil(t, rs.Reconstruct(lost))
+			assert.Equal(t, shards, lost)
+		}
+	}
+
+	lost := append([][]byte{nil, nil, nil}, shards[3:]...)
+	assert.ErrorIs(t, rs.Reconstruct(lost), ErrTooFewShards)
+
+	_, err = NewReedSolomon(0, 2)
+	assert.NotNil(t, err)
+	_, err = NewReedSolomon(200, 100)
+	assert.NotNil(t, err)
+}
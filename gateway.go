@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTPGateway exposes a FileServer over HTTP:
+//
+//	PUT    /files/{key}  stores the request body
+//	GET    /files/{key}  returns the file, Range requests are supported
+//	HEAD   /files/{key}  returns the metadata of the file as headers
+//	DELETE /files/{key}  deletes the file
+//
+// Bodies are streamed and the ETag of a file is its SHA-256 hash. PUT
+// and GET take the consistency level in the X-Consistency header.
+type HTTPGateway struct {
+	// Token, when set, must be sent with every request as a bearer
+	// token in the Authorization header. Without it, only clients on
+	// a loopback address are served.
+	Token string
+
+	server *FileServer
+	mux    *http.ServeMux
+}
+
+// NewHTTPGateway returns an HTTPGateway serving the files of s.
+func NewHTTPGateway(s *FileServer) *HTTPGateway {
+	g := &HTTPGateway{
+		server: s,
+		mux:    http.NewServeMux(),
+	}
+	g.mux.HandleFunc("PUT /files/{key...}", g.handlePut)
+	g.mux.HandleFunc("GET /files/{key...}", g.handleGet)
+	g.mux.HandleFunc("HEAD /files/{key...}", g.handleHead)
+	g.mux.HandleFunc("DELETE /files/{key...}", g.handleDelete)
+	return g
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (g *HTTPGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		return
+	}
+	g.mux.ServeHTTP(w, r)
+}
+
+// authorized reports whether r carries the token of the gateway, or
+// comes from a loopback address when the gateway has no token.
+func (g *HTTPGateway) authorized(r *http.Request) bool {
+	if len(g.Token) == 0 {
+		return isLoopback(r.RemoteAddr)
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(g.Token)) == 1
+}
+
+func (g *HTTPGateway) handlePut(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	level, ok := consistencyHeader(w, r)
+	if !ok {
+		return
+	}
+	if err := g.server.Store(key, r.Body, level); err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	meta, err := g.server.Stat(key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag(meta))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (g *HTTPGateway) handleGet(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	level, ok := consistencyHeader(w, r)
+	if !ok {
+		return
+	}
+	f, err := g.server.Get(key, level)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	if rc, ok := f.(io.Closer); ok {
+		defer rc.Close()
+	}
+	meta, err := g.server.Stat(key)
+	serveFile(w, r, key, f, meta, err == nil)
+}
+
+func (g *HTTPGateway) handleHead(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	meta, err := g.server.Stat(key)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", etag(meta))
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.Header().Set("Last-Modified", meta.Created.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (g *HTTPGateway) handleDelete(w http.ResponseWriter, r *http.Request) {
+	key, ok := pathKey(w, r)
+	if !ok {
+		return
+	}
+	if err := g.server.Delete(key); err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeError replies with the status code matching err.
+func (g *HTTPGateway) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrFileNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrNotEnoughReplicas) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("(%s): http %s %s failed: %s", g.server.StorageFolder, r.Method, r.URL.Path, err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// consistencyHeader returns the consistency level of the X-Consistency
+// header of r, or writes an error response if it is invalid.
+func consistencyHeader(w http.ResponseWriter, r *http.Request) (Consistency, bool) {
+	level, err := ParseConsistency(r.Header.Get("X-Consistency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return 0, false
+	}
+	return level, true
+}
+
+// serveFile writes the file f stored under key as the response to r.
+// hasMeta is false when the metadata of the file is unknown.
+func serveFile(w http.ResponseWriter, r *http.Request, key string, f io.Reader, meta FileMeta, hasMeta bool) {
+	if hasMeta {
+		w.Header().Set("ETag", etag(meta))
+	}
+	// ServeContent handles Range and the conditional headers, it needs
+	// to seek. Range is ignored for readers that can not, as RFC 9110 allows.
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, key, meta.Created, rs)
+		return
+	}
+	if hasMeta {
+		w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+		w.Header().Set("Last-Modified", meta.Created.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if _, err := io.Copy(w, f); err != nil {
+		// The status is already sent, the short body tells the client.
+		log.Printf("failed to send file (%s) over http: %s", key, err)
+	}
+}
+
+// pathKey returns the file key of a request, or replies
+// with an error if the request does not name a file.
+func pathKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.PathValue("key")
+	if len(key) == 0 {
+		http.Error(w, "missing file key", http.StatusBadRequest)
+		return "", false
+	}
+	return key, true
+}
+
+// etag returns the ETag of a file, derived from its content hash.
+func etag(meta FileMeta) string {
+	return `"` + meta.Hash + `"`
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func doRequest(t *testing.T, method, url string, body io.Reader, header http.Header) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, body)
+	assert.Nil(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return resp, b
+}
+
+func TestHTTPGateway(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, p2p.NewMemoryNetwork())
+	ts := httptest.NewServer(NewHTTPGateway(s))
+	defer ts.Close()
+	url := ts.URL + "/files/dir/file.txt"
+
+	data := []byte("0123456789abcdef")
+	resp, _ := doRequest(t, http.MethodPut, url, bytes.NewReader(data), nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	tag := resp.Header.Get("ETag")
+	assert.Len(t, tag, 66)
+
+	resp, b := doRequest(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, data, b)
+	assert.Equal(t, tag, resp.Header.Get("ETag"))
+	assert.EqualValues(t, len(data), resp.ContentLength)
+
+	resp, b = doRequest(t, http.MethodGet, url, nil, http.Header{"Range": {"bytes=4-7"}})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "4567", string(b))
+	assert.Equal(t, "bytes 4-7/16", resp.Header.Get("Content-Range"))
+
+	resp, _ = doRequest(t, http.MethodGet, url, nil, http.Header{"If-None-Match": {tag}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, b = doRequest(t, http.MethodHead, url, nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Empty(t, b)
+	assert.Equal(t, tag, resp.Header.Get("ETag"))
+	assert.EqualValues(t, len(data), resp.ContentLength)
+
+	resp, _ = doRequest(t, http.MethodDelete, url, nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodGet, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, _ = doRequest(t, http.MethodHead, url, nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = doRequest(t, http.MethodPost, url, nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestHTTPGatewayToken(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, p2p.NewMemoryNetwork())
+	g := NewHTTPGateway(s)
+	g.Token = "secret"
+	ts := httptest.NewServer(g)
+	defer ts.Close()
+	url := ts.URL + "/files/file.txt"
+
+	for _, header := range []http.Header{nil, {"Authorization": {"Bearer wrong"}}, {"Authorization": {"secret"}}} {
+		resp, _ := doRequest(t, http.MethodPut, url, bytes.NewReader([]byte("data")), header)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"))
+	}
+	_, err := s.Stat("file.txt")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	resp, _ := doRequest(t, http.MethodPut, url, bytes.NewReader([]byte("data")), http.Header{"Authorization": {"Bearer secret"}})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Without a token, only loopback clients are served.
+	g.Token = ""
+	req := httptest.NewRequest(http.MethodGet, "/files/file.txt", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestHTTPGatewayVerifiedReads(t *testing.T) {
+	t.Parallel()
+	s := newTestServer(t, p2p.NewMemoryNetwork())
+	s.store.VerifyReads = true
+	ts := httptest.NewServer(NewHTTPGateway(s))
+	defer ts.Close()
+	url := ts.URL + "/files/file.txt"
+
+	data := []byte("0123456789")
+	resp, _ := doRequest(t, http.MethodPut, url, bytes.NewReader(data), nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Chunks are verified one by one, so Range is honored.
+	resp, b := doRequest(t, http.MethodGet, url, nil, http.Header{"Range": {"bytes=0-1"}})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, data[:2], b)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// IdentityFileName is the name of the identity file in the storage folder.
+const IdentityFileName = "identity.json"
+
+// Identity is what makes a node the same node across restarts: the ID
+// its files are stored under, the keypair it proves who it is with,
+// and the key it encrypts its data with.
+type Identity struct {
+	ID         string
+	PublicKey  ed25519.PublicKey
+	PrivateKey ed25519.PrivateKey
+	DataKey    []byte
+}
+
+// identityFile is the on-disk form of an Identity. The private key
+// is stored as its seed, the public key is derived from it.
+type identityFile struct {
+	ID         string `json:"id"`
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+	DataKey    string `json:"data_key"`
+}
+
+// NewIdentity returns a new random Identity, with a random ID when id is empty.
+func NewIdentity(id string) (*Identity, error) {
+	if len(id) == 0 {
+		id = generateID()
+	}
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		ID:         id,
+		PublicKey:  pub,
+		PrivateKey: priv,
+		DataKey:    newEncryptionKey(),
+	}, nil
+}
+
+// LoadIdentity reads the identity file in path. A missing file is
+// created with a new identity named id, or a random ID when id is
+// empty. When id is set it must match the ID of an existing file.
+func LoadIdentity(path, id string) (*Identity, error) {
+	ident, err := readIdentity(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if ident, err = NewIdentity(id); err != nil {
+			return nil, err
+		}
+		return ident, writeIdentity(path, ident)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 0 && id != ident.ID {
+		return nil, fmt.Errorf("identity file (%s) belongs to node %s, not %s", path, ident.ID, id)
+	}
+	return ident, nil
+}
+
+// readPrivateFile reads a file holding keys. Like ssh does
+// with its keys, files that others can access are refused.
+func readPrivateFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("key file (%s) is accessible by others (%s), it must be 0600", path, info.Mode().Perm())
+	}
+	return os.ReadFile(path)
+}
+
+// replacePrivateFile atomically replaces the file in path with one
+// holding b, that only the owner can access.
+func replacePrivateFile(path string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	// CreateTemp creates files only the owner can access.
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+tempFileMarker+"*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readIdentity reads and checks the identity file in path.
+func readIdentity(path string) (*Identity, error) {
+	b, err := readPrivateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f identityFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("identity file (%s): %w", path, err)
+	}
+
+	invalid := func(what string) error {
+		return fmt.Errorf("identity file (%s) has an invalid %s", path, what)
+	}
+	if len(f.ID) == 0 {
+		return nil, invalid("id")
+	}
+	seed, err := hex.DecodeString(f.PrivateKey)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, invalid("private_key")
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+	pub := priv.Public().(ed25519.PublicKey)
+	if f.PublicKey != hex.EncodeToString(pub) {
+		return nil, invalid("public_key, it does not match private_key")
+	}
+	key, err := hex.DecodeString(f.DataKey)
+	if err != nil || len(key) != 32 {
+		return nil, invalid("data_key")
+	}
+	return &Identity{ID: f.ID, PublicKey: pub, PrivateKey: priv, DataKey: key}, nil
+}
+
+// writeIdentity writes ident to a new file in path that only the owner
+// can access. It never overwrites a file, that would lose the keys.
+func writeIdentity(path string, ident *Identity) error {
+	b, err := json.MarshalIndent(identityFile{
+		ID:         ident.ID,
+		PublicKey:  hex.EncodeToString(ident.PublicKey),
+		PrivateKey: hex.EncodeToString(ident.PrivateKey.Seed()),
+		DataKey:    hex.EncodeToString(ident.DataKey),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// A partial file would keep the node from ever starting.
+		os.Remove(path)
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadIdentity(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node", IdentityFileName)
+	ident, err := LoadIdentity(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEmpty(t, ident.ID)
+	assert.Len(t, ident.DataKey, 32)
+	sig := ed25519.Sign(ident.PrivateKey, []byte("nonce"))
+	assert.True(t, ed25519.Verify(ident.PublicKey, []byte("nonce"), sig))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	info, err = os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0o700), info.Mode().Perm())
+
+	// The identity survives restarts.
+	again, err := LoadIdentity(path, ident.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ident, again)
+
+	_, err = LoadIdentity(path, "other")
+	assert.Error(t, err)
+}
+
+func TestLoadIdentityWithID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), IdentityFileName)
+	ident, err := LoadIdentity(path, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "node-1", ident.ID)
+	again, err := LoadIdentity(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "node-1", again.ID)
+}
+
+func TestLoadIdentityRejectsInvalidFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), IdentityFileName)
+	ident, err := LoadIdentity(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keys that others can read are refused.
+	if err := os.Chmod(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadIdentity(path, "")
+	assert.Error(t, err)
+
+	other, err := NewIdentity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, invalid := range []*Identity{
+		{ID: ident.ID, PublicKey: other.PublicKey, PrivateKey: ident.PrivateKey, DataKey: ident.DataKey},
+		{ID: ident.ID, PublicKey: ident.PublicKey, PrivateKey: ident.PrivateKey, DataKey: ident.DataKey[:16]},
+		{ID: "", PublicKey: ident.PublicKey, PrivateKey: ident.PrivateKey, DataKey: ident.DataKey},
+	} {
+		if err := os.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeIdentity(path, invalid); err != nil {
+			t.Fatal(err)
+		}
+		_, err = LoadIdentity(path, "")
+		assert.Error(t, err)
+	}
+
+	// An existing file is never overwritten.
+	assert.Error(t, writeIdentity(path, ident))
+}
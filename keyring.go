@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"sync"
+	"time"
+)
+
+// KeyringFileName is the name of the keyring file, next to the identity file.
+const KeyringFileName = "keyring.json"
+
+// Every object sent to a peer is encrypted with its own data key. The data
+// key is wrapped by a key-encryption key (KEK) of the keyring, in a header
+// that starts the object:
+//
+//	magic (8) | KEK ID (16) | nonce (12) | wrapped data key (32+16)
+//
+// and the body that follows is the copyEncrypt stream of the data key.
+// Rotating a KEK only rewrites the headers, never the bodies.
+var envelopeMagic = []byte("DFSENV01")
+
+const (
+	// kekIDSize is the size of the hex encoded ID of a KEK.
+	kekIDSize          = 16
+	envelopeNonceSize  = 12
+	envelopeHeaderSize = 8 + kekIDSize + envelopeNonceSize + 32 + gcmTagSize
+)
+
+// ErrUnknownKEK is returned when an object is wrapped by
+// a key-encryption key that is not in the keyring.
+var ErrUnknownKEK = errors.New("key-encryption key not in the keyring")
+
+// sealedSize returns the size of the object sealEnvelope
+// writes for size bytes of plaintext.
+func sealedSize(size int64) int64 {
+	return envelopeHeaderSize + encryptedSize(size)
+}
+
+// Keyring holds the key-encryption keys of a node. The newest key is the
+// active one, data keys are wrapped by it. Older keys are kept to unwrap
+// the data keys they still wrap, until they are retired.
+type Keyring struct {
+	// path is the keyring file, the keyring is only kept in memory without one.
+	path string
+
+	lock   sync.Mutex
+	active string
+	keys   []kek
+	// since is when the keyring was created, objects sent to
+	// peers before then predate envelope encryption.
+	since time.Time
+}
+
+// kek is a key-encryption key as it is stored in the keyring file.
+type kek struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key"`
+	Created time.Time `json:"created"`
+	// Peers are the IDs of the peers that were sent data keys
+	// wrapped by the key, and may still hold them.
+	Peers []string `json:"peers,omitempty"`
+}
+
+// keyringFile is the on-disk form of a Keyring.
+type keyringFile struct {
+	Active string    `json:"active"`
+	Keys   []kek     `json:"keys"`
+	Since  time.Time `json:"since"`
+}
+
+// NewKeyring returns a keyring kept in memory, with a single new key.
+func NewKeyring() *Keyring {
+	k := &Keyring{since: time.Now()}
+	// Without a file, Rotate can not fail.
+	k.Rotate()
+	return k
+}
+
+// LoadKeyring reads the keyring file in path. A missing file is
+// created with a single new key. Like the identity file, the
+// keyring file must only be accessible by its owner.
+func LoadKeyring(path string) (*Keyring, error) {
+	b, err := readPrivateFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		k := &Keyring{path: path, since: time.Now()}
+		if _, err := k.Rotate(); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var f keyringFile
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("keyring file (%s): %w", path, err)
+	}
+	k := &Keyring{path: path, active: f.Active, keys: f.Keys, since: f.Since}
+	for _, key := range f.Keys {
+		if b, err := hex.DecodeString(key.Key); err != nil || len(b) != 32 || len(key.ID) != kekIDSize {
+			return nil, fmt.Errorf("keyring file (%s) has an invalid key (%s)", path, key.ID)
+		}
+	}
+	if _, ok := k.key(f.Active); !ok {
+		return nil, fmt.Errorf("keyring file (%s) has no active key (%s)", path, f.Active)
+	}
+	// Keyring files written before the creation time was
+	// kept fall back to the oldest key.
+	for _, key := range f.Keys {
+		if f.Since.IsZero() && (k.since.IsZero() || key.Created.Before(k.since)) {
+			k.since = key.Created
+		}
+	}
+	return k, nil
+}
+
+// Active returns the ID of the key new data keys are wrapped by.
+func (k *Keyring) Active() string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.active
+}
+
+// Since returns when the keyring was created. Only the objects sent
+// to peers before then may predate envelope encryption.
+func (k *Keyring) Since() time.Time {
+	return k.since
+}
+
+// IDs returns the IDs of the keys, oldest first.
+func (k *Keyring) IDs() []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	ids := make([]string, 0, len(k.keys))
+	for _, key := range k.keys {
+		ids = append(ids, key.ID)
+	}
+	return ids
+}
+
+// Rotate adds a new key and makes it the active one, it returns its ID.
+func (k *Keyring) Rotate() (string, error) {
+	id := make([]byte, kekIDSize/2)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return "", err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	next := kek{
+		ID:      hex.EncodeToString(id),
+		Key:     hex.EncodeToString(newEncryptionKey()),
+		Created: time.Now(),
+	}
+	prev, keys := k.active, k.keys
+	k.active, k.keys = next.ID, append(k.keys[:len(k.keys):len(k.keys)], next)
+	if err := k.save(); err != nil {
+		k.active, k.keys = prev, keys
+		return "", err
+	}
+	return next.ID, nil
+}
+
+// Retire removes the key id from the keyring. The data keys it still
+// wraps can not be unwrapped anymore, so it must only be retired once
+// nothing references it. The active key can not be retired.
+func (k *Keyring) Retire(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if id == k.active {
+		return fmt.Errorf("key (%s) is the active key", id)
+	}
+	keys := make([]kek, 0, len(k.keys))
+	for _, key := range k.keys {
+		if key.ID != id {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == len(k.keys) {
+		return fmt.Errorf("key (%s): %w", id, ErrUnknownKEK)
+	}
+	prev := k.keys
+	k.keys = keys
+	if err := k.save(); err != nil {
+		k.keys = prev
+		return err
+	}
+	return nil
+}
+
+// key returns the key id, the lock must be held.
+func (k *Keyring) key(id string) ([]byte, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			b, _ := hex.DecodeString(key.Key)
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// save writes the keyring file, the lock must be held. The file is
+// replaced atomically, so a crash never loses the keys.
+func (k *Keyring) save() error {
+	if len(k.path) == 0 {
+		return nil
+	}
+	b, err := json.MarshalIndent(keyringFile{Active: k.active, Keys: k.keys, Since: k.since}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replacePrivateFile(k.path, append(b, '\n'))
+}
+
+// Holders returns the IDs of the peers that may still hold data keys
+// wrapped by the key id.
+func (k *Keyring) Holders(id string) []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	for _, key := range k.keys {
+		if key.ID == id {
+			return append([]string{}, key.Peers...)
+		}
+	}
+	return nil
+}
+
+// Release removes peer from the holders of every key but keep, once
+// all of its data keys are wrapped by keep.
+func (k *Keyring) Release(peer, keep string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	keys := make([]kek, len(k.keys))
+	changed := false
+	for i, key := range k.keys {
+		keys[i] = key
+		if key.ID == keep || !slices.Contains(key.Peers, peer) {
+			continue
+		}
+		keys[i].Peers = slices.DeleteFunc(slices.Clone(key.Peers), func(p string) bool { return p == peer })
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	prev := k.keys
+	k.keys = keys
+	if err := k.save(); err != nil {
+		k.keys = prev
+		return err
+	}
+	return nil
+}
+
+// wrap returns the envelope header of the data key dek, wrapped by the
+// active key. The peers the object is sent to are added to the holders
+// of the key before, so it is never retired while they hold it.
+func (k *Keyring) wrap(dek []byte, peers ...string) ([]byte, error) {
+	k.lock.Lock()
+	id := k.active
+	key, _ := k.key(id)
+	err := k.hold(id, peers)
+	k.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, envelopeHeaderSize)
+	header = append(header, envelopeMagic...)
+	header = append(header, id...)
+	nonce := make([]byte, envelopeNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	// The magic and the KEK ID are authenticated along with the data key.
+	return aead.Seal(header, nonce, dek, header[:len(envelopeMagic)+kekIDSize]), nil
+}
+
+// hold adds peers to the holders of the key id, the lock must be held.
+func (k *Keyring) hold(id string, peers []string) error {
+	i := slices.IndexFunc(k.keys, func(key kek) bool { return key.ID == id })
+	if i < 0 {
+		return nil
+	}
+	held := k.keys[i].Peers
+	for _, peer := range peers {
+		if !slices.Contains(held, peer) {
+			held = append(held[:len(held):len(held)], peer)
+		}
+	}
+	if len(held) == len(k.keys[i].Peers) {
+		return nil
+	}
+	prev := k.keys
+	k.keys = slices.Clone(k.keys)
+	k.keys[i].Peers = held
+	if err := k.save(); err != nil {
+		k.keys = prev
+		return err
+	}
+	return nil
+}
+
+// unwrap returns the data key of the envelope header.
+func (k *Keyring) unwrap(header []byte) ([]byte, error) {
+	id, ok := envelopeKEK(header)
+	if !ok {
+		return nil, errors.New("invalid envelope header")
+	}
+	k.lock.Lock()
+	key, ok := k.key(id)
+	k.lock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("key (%s): %w", id, ErrUnknownKEK)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ad      = header[:len(envelopeMagic)+kekIDSize]
+		nonce   = header[len(ad) : len(ad)+envelopeNonceSize]
+		wrapped = header[len(ad)+envelopeNonceSize:]
+	)
+	dek, err := aead.Open(nil, nonce, wrapped, ad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return dek, nil
+}
+
+// rewrap returns the envelope header wrapping the data key
+// of header by the active key, for the object held by peers.
+func (k *Keyring) rewrap(header []byte, peers ...string) ([]byte, error) {
+	dek, err := k.unwrap(header)
+	if err != nil {
+		return nil, err
+	}
+	return k.wrap(dek, peers...)
+}
+
+// envelopeKEK returns the ID of the key that wraps the data key of header.
+func envelopeKEK(header []byte) (string, bool) {
+	if len(header) != envelopeHeaderSize || !bytes.HasPrefix(header, envelopeMagic) {
+		return "", false
+	}
+	return string(header[len(envelopeMagic) : len(envelopeMagic)+kekIDSize]), true
+}
+
+// sealEnvelope encrypts src with a new data key wrapped by the active
+// key of k, and writes the object sent to peers to dst. It returns its size.
+func sealEnvelope(k *Keyring, src io.Reader, dst io.Writer, peers ...string) (int64, error) {
+	dek := newEncryptionKey()
+	header, err := k.wrap(dek, peers...)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+	n, err := copyEncrypt(dek, src, dst)
+	return envelopeHeaderSize + n, err
+}
+
+// decryptFunc decrypts src to dst and returns the size of the plaintext.
+type decryptFunc func(src io.Reader, dst io.Writer) (int64, error)
+
+// openEnvelope decrypts an object written by sealEnvelope to dst and
+// returns the size of the plaintext. Objects without an envelope header
+// predate envelope encryption and are decrypted by legacy, they fail
+// with ErrDecrypt when it is nil.
+func openEnvelope(k *Keyring, legacy decryptFunc, src io.Reader, dst io.Writer) (int64, error) {
+	header := make([]byte, envelopeHeaderSize)
+	n, err := io.ReadFull(src, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	if _, ok := envelopeKEK(header[:n]); !ok {
+		if legacy == nil {
+			return 0, ErrDecrypt
+		}
+		return legacy(io.MultiReader(bytes.NewReader(header[:n]), src), dst)
+	}
+	dek, err := k.unwrap(header)
+	if err != nil {
+		return 0, err
+	}
+	return copyDecrypt(dek, src, dst)
+}
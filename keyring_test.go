@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSealOpenEnvelope(t *testing.T) {
+	k := NewKeyring()
+	data := bytes.Repeat([]byte("envelope"), gcmChunkSize/4)
+	sealed := new(bytes.Buffer)
+	n, err := sealEnvelope(k, bytes.NewReader(data), sealed)
+	assert.Nil(t, err)
+	assert.EqualValues(t, sealedSize(int64(len(data))), n)
+	assert.EqualValues(t, sealed.Len(), n)
+	id, ok := envelopeKEK(sealed.Bytes()[:envelopeHeaderSize])
+	assert.True(t, ok)
+	assert.Equal(t, k.Active(), id)
+
+	out := new(bytes.Buffer)
+	_, err = openEnvelope(k, nil, bytes.NewReader(sealed.Bytes()), out)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out.Bytes())
+
+	// Every object has its own data key.
+	again := new(bytes.Buffer)
+	_, err = sealEnvelope(k, bytes.NewReader(data), again)
+	assert.Nil(t, err)
+	assert.NotEqual(t, sealed.Bytes()[envelopeHeaderSize:], again.Bytes()[envelopeHeaderSize:])
+
+	// Objects sealed by another keyring can not be opened.
+	_, err = openEnvelope(NewKeyring(), nil, bytes.NewReader(sealed.Bytes()), new(bytes.Buffer))
+	assert.ErrorIs(t, err, ErrUnknownKEK)
+}
+
+func TestOpenEnvelopeLegacy(t *testing.T) {
+	key := newEncryptionKey()
+	legacy := func(src io.Reader, dst io.Writer) (int64, error) {
+		return copyDecrypt(key, src, dst)
+	}
+	for _, data := range [][]byte{nil, []byte("old"), bytes.Repeat([]byte{1}, 1000)} {
+		enc := new(bytes.Buffer)
+		_, err := copyEncrypt(key, bytes.NewReader(data), enc)
+		assert.Nil(t, err)
+		_, err = openEnvelope(NewKeyring(), nil, bytes.NewReader(enc.Bytes()), new(bytes.Buffer))
+		assert.ErrorIs(t, err, ErrDecrypt)
+		out := new(bytes.Buffer)
+		_, err = openEnvelope(NewKeyring(), legacy, enc, out)
+		assert.Nil(t, err)
+		assert.Equal(t, len(data), out.Len())
+		assert.True(t, bytes.Equal(data, out.Bytes()))
+	}
+}
+
+func TestKeyringRewrap(t *testing.T) {
+	k := NewKeyring()
+	data := []byte("rewrapped but never re-encrypted")
+	sealed := new(bytes.Buffer)
+	_, err := sealEnvelope(k, bytes.NewReader(data), sealed)
+	assert.Nil(t, err)
+	old := k.Active()
+
+	id, err := k.Rotate()
+	assert.Nil(t, err)
+	assert.NotEqual(t, old, id)
+	assert.Equal(t, []string{old, id}, k.IDs())
+	header, err := k.rewrap(sealed.Bytes()[:envelopeHeaderSize])
+	assert.Nil(t, err)
+	kid, _ := envelopeKEK(header)
+	assert.Equal(t, id, kid)
+
+	// The key ID is authenticated, headers can not be pointed to another key.
+	tampered := append([]byte{}, header...)
+	copy(tampered[len(envelopeMagic):], old)
+	_, err = k.unwrap(tampered)
+	assert.ErrorIs(t, err, ErrDecrypt)
+
+	// The new header opens the old body, without the old key.
+	assert.Error(t, k.Retire(id))
+	assert.Nil(t, k.Retire(old))
+	assert.ErrorIs(t, k.Retire(old), ErrUnknownKEK)
+	out := new(bytes.Buffer)
+	_, err = openEnvelope(k, nil, io.MultiReader(bytes.NewReader(header), bytes.NewReader(sealed.Bytes()[envelopeHeaderSize:])), out)
+	assert.Nil(t, err)
+	assert.Equal(t, data, out.Bytes())
+}
+
+func TestLoadKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node", KeyringFileName)
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	first := k.Active()
+	second, err := k.Rotate()
+	assert.Nil(t, err)
+	third, err := k.Rotate()
+	assert.Nil(t, err)
+	assert.Nil(t, k.Retire(second))
+
+	// Rotations and retirements survive restarts.
+	again, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, third, again.Active())
+	assert.Equal(t, []string{first, third}, again.IDs())
+	assert.True(t, k.Since().Equal(again.Since()))
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	assert.Nil(t, os.Chmod(path, 0o644))
+	_, err = LoadKeyring(path)
+	assert.ErrorContains(t, err, "accessible by others")
+}
+
+func TestKeyringHolders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), KeyringFileName)
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := k.Active()
+	sealed := new(bytes.Buffer)
+	_, err = sealEnvelope(k, bytes.NewReader([]byte("held")), sealed, "peer1", "peer2")
+	assert.Nil(t, err)
+	_, err = sealEnvelope(k, bytes.NewReader([]byte("held")), new(bytes.Buffer), "peer1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"peer1", "peer2"}, k.Holders(old))
+
+	id, err := k.Rotate()
+	assert.Nil(t, err)
+	assert.Empty(t, k.Holders(id))
+	_, err = k.rewrap(sealed.Bytes()[:envelopeHeaderSize], "peer1")
+	assert.Nil(t, err)
+	assert.Nil(t, k.Release("peer1", id))
+	assert.Equal(t, []string{"peer2"}, k.Holders(old))
+	assert.Equal(t, []string{"peer1"}, k.Holders(id))
+
+	// The holders survive restarts.
+	again, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"peer2"}, again.Holders(old))
+	assert.Equal(t, []string{"peer1"}, again.Holders(id))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+
+	"github.com/muhreeowki/dfs/p2p"
+)
+
+// KnownPeersFileName is the name of the known peers file, next to the identity file.
+const KnownPeersFileName = "known_peers.json"
+
+// KnownPeers pins the public key every node ID was first seen with, like
+// the known hosts of ssh. The pins are kept in a file, so a node ID can
+// not be taken over by another key, not even after a restart. A node
+// that lost its identity file must be removed from the file by hand.
+type KnownPeers struct {
+	path string
+
+	lock sync.Mutex
+	// keys are the hex encoded public keys by node ID.
+	keys map[string]string
+}
+
+// LoadKnownPeers reads the known peers file in path, a missing file
+// is created with the first pin. Like the identity file, it must only
+// be accessible by its owner.
+func LoadKnownPeers(path string) (*KnownPeers, error) {
+	k := &KnownPeers{path: path, keys: make(map[string]string)}
+	b, err := readPrivateFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&k.keys); err != nil {
+		return nil, fmt.Errorf("known peers file (%s): %w", path, err)
+	}
+	for id, key := range k.keys {
+		if b, err := hex.DecodeString(key); err != nil || len(b) != ed25519.PublicKeySize || !p2p.ValidNodeID(id) {
+			return nil, fmt.Errorf("known peers file (%s) has an invalid entry for (%s)", path, id)
+		}
+	}
+	return k, nil
+}
+
+// Verify is a p2p.SignedHandshakeOpts Verify func. It pins the key of
+// a node ID seen for the first time, and rejects the hellos presenting
+// another key than the pinned one.
+func (k *KnownPeers) Verify(h p2p.Hello) error {
+	key := hex.EncodeToString(h.PublicKey)
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	pinned, ok := k.keys[h.NodeID]
+	if ok && pinned != key {
+		return fmt.Errorf("node (%s) presented another key than the one pinned in (%s)", h.NodeID, k.path)
+	}
+	if ok {
+		return nil
+	}
+	k.keys[h.NodeID] = key
+	if err := k.save(); err != nil {
+		delete(k.keys, h.NodeID)
+		return fmt.Errorf("pinning the key of node (%s): %w", h.NodeID, err)
+	}
+	return nil
+}
+
+// save writes the known peers file, the lock must be held.
+func (k *KnownPeers) save() error {
+	b, err := json.MarshalIndent(k.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return replacePrivateFile(k.path, append(b, '\n'))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKnownPeersPinKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node", KnownPeersFileName)
+	k, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := func(id string) p2p.Hello {
+		pub, _, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p2p.Hello{NodeID: id, PublicKey: pub}
+	}
+	node2 := hello("node2")
+	assert.Nil(t, k.Verify(node2))
+	assert.Nil(t, k.Verify(node2))
+	assert.ErrorContains(t, k.Verify(hello("node2")), "another key")
+	assert.Nil(t, k.Verify(hello("node3")))
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// The pins survive restarts.
+	again, err := LoadKnownPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, again.Verify(node2))
+	assert.Error(t, again.Verify(hello("node2")))
+
+	assert.Nil(t, os.Chmod(path, 0o644))
+	_, err = LoadKnownPeers(path)
+	assert.ErrorContains(t, err, "accessible by others")
+}
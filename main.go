@@ -1,55 +1,261 @@
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
-
-	"github.com/muhreeowki/dfs/p2p"
 )
 
 // TODO:
-// Implement a way to add servers
-// Implement a client to read, write, and delete files from the system.
 // Implement some sort of security measures.
 // Research Consensus Algorithm
 
+const usage = `usage: dfs <command> [flags] [args]
+
+commands:
+  serve                 run a node
+  put   <key> [file]    store a file, read from stdin without file or with -
+  get   <key> [file]    fetch a file, written to stdout without file or with -
+  rm    <key>           delete a file
+  ls    [prefix]        list the files held by the node
+  stat  <key>           show the metadata of a file
+  rotate-keys           wrap the data keys held by peers with a new key-encryption key
+  retire-key <id>       remove a key-encryption key that no longer wraps data keys
+  keygen <file>         create a key file for -client-key
+
+run dfs <command> -h for the flags of a command.
+
+put and get encrypt and decrypt files on the client when given a key
+file with -client-key or $DFS_CLIENT_KEY, or a passphrase in
+$DFS_PASSPHRASE. Nodes then only ever see ciphertext.
+`
+
 func main() {
-	s1 := makeServer("store1", ":3000")
-	s2 := makeServer("store2", ":4000", ":3000")
-	s3 := makeServer("store3", ":8000", ":3000", ":4000")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "serve":
+		err = runServe(args)
+	case "put", "get", "rm", "ls", "stat", "rotate-keys", "retire-key":
+		err = runClient(cmd, args, os.Stdin, os.Stdout)
+	case "keygen":
+		err = runKeygen(args, os.Stdout)
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "dfs: unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "dfs %s: %s\n", cmd, err)
+		os.Exit(1)
+	}
+}
+
+// runServe starts a node and serves clients until the process is killed.
+func runServe(args []string) error {
+	cfg, err := LoadConfig(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	s, err := cfg.NewServer()
+	if err != nil {
+		return err
+	}
+	folder := cfg.StorageFolder
+	clients := NewClientServer(s)
+	clients.Token = cfg.ClientToken
+	go func() {
+		if err := clients.ListenAndServe(cfg.ClientAddr); err != nil {
+			log.Fatalf("failed to serve clients: %s", err)
+		}
+	}()
+	if len(cfg.HTTPAddr) > 0 {
+		gateway := NewHTTPGateway(s)
+		gateway.Token = cfg.ClientToken
+		go func() {
+			log.Printf("(%s): serving http on: %s", folder, cfg.HTTPAddr)
+			if err := http.ListenAndServe(cfg.HTTPAddr, gateway); err != nil {
+				log.Fatalf("failed to serve http: %s", err)
+			}
+		}()
+	}
+	if len(cfg.S3Addr) > 0 {
+		gateway := NewS3Gateway(s, S3GatewayOpts{
+			Region:      cfg.S3Region,
+			Credentials: map[string]string{cfg.S3AccessKey: cfg.S3SecretKey},
+		})
+		go func() {
+			log.Printf("(%s): serving s3 on: %s", folder, cfg.S3Addr)
+			if err := http.ListenAndServe(cfg.S3Addr, gateway); err != nil {
+				log.Fatalf("failed to serve s3: %s", err)
+			}
+		}()
+	}
+	return s.Start()
+}
 
-	go s1.Start()
-	time.Sleep(time.Millisecond * 10)
+// runClient runs a client command against a node.
+func runClient(cmd string, args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	node := fs.String("node", DefaultClientAddr, "client address of the node")
+	token := fs.String("token", os.Getenv("DFS_CLIENT_TOKEN"), "client token of the node, see serve -client-token")
+	var level Consistency
+	fs.Var(&level, "consistency", "consistency level of put and get: ONE, QUORUM or ALL, the node default when empty")
+	keyFile := fs.String("client-key", os.Getenv("DFS_CLIENT_KEY"), "key file put and get encrypt files with, see dfs keygen")
+	fs.Parse(args)
+	args = fs.Args()
 
-	go s2.Start()
-	time.Sleep(time.Millisecond * 10)
+	client := NewClient(*node)
+	client.Consistency = level
+	client.Token = *token
+	if cmd == "put" || cmd == "get" {
+		key, err := clientKey(*keyFile, os.Getenv("DFS_PASSPHRASE"))
+		if err != nil {
+			return err
+		}
+		client.Key = key
+	}
+	switch cmd {
+	case "put":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: dfs put <key> [file]")
+		}
+		r := stdin
+		if len(args) == 2 && args[1] != "-" {
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		meta, err := client.Put(args[0], r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "%s\t%d\t%s\n", meta.Key, meta.Size, meta.Hash)
+	case "get":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("usage: dfs get <key> [file]")
+		}
+		r, err := client.Get(args[0])
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if len(args) == 1 || args[1] == "-" {
+			_, err = io.Copy(stdout, r)
+			return err
+		}
+		return writeLocalFile(args[1], r)
+	case "rm":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: dfs rm <key>")
+		}
+		return client.Delete(args[0])
+	case "ls":
+		if len(args) > 1 {
+			return fmt.Errorf("usage: dfs ls [prefix]")
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		metas, err := client.List(prefix)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		for _, meta := range metas {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", meta.Size, meta.Created.Format(time.RFC3339), meta.Owner, meta.Key)
+		}
+		return tw.Flush()
+	case "stat":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: dfs stat <key>")
+		}
+		meta, err := client.Stat(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Key:      %s\n", meta.Key)
+		fmt.Fprintf(stdout, "Size:     %d\n", meta.Size)
+		fmt.Fprintf(stdout, "SHA256:   %s\n", meta.Hash)
+		fmt.Fprintf(stdout, "Created:  %s\n", meta.Created.Format(time.RFC3339))
+		fmt.Fprintf(stdout, "Owner:    %s\n", meta.Owner)
+		fmt.Fprintf(stdout, "Replicas: %s\n", strings.Join(meta.Replicas, ", "))
+	case "rotate-keys":
+		if len(args) != 0 {
+			return fmt.Errorf("usage: dfs rotate-keys")
+		}
+		rot, err := client.RotateKeys()
+		if len(rot.KeyID) > 0 {
+			fmt.Fprintf(stdout, "Key:       %s\n", rot.KeyID)
+			fmt.Fprintf(stdout, "Rewrapped: %d\n", rot.Rewrapped)
+			fmt.Fprintf(stdout, "Previous:  %s\n", strings.Join(rot.Previous, ", "))
+		}
+		return err
+	case "retire-key":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: dfs retire-key <id>")
+		}
+		return client.RetireKey(args[0])
+	}
+	return nil
+}
 
-	go s3.Start()
-	time.Sleep(time.Millisecond * 10)
+// clientKey returns the key of the key file, or of the passphrase
+// without one. Files are not encrypted when neither is given.
+func clientKey(keyFile, passphrase string) (*ClientKey, error) {
+	if len(keyFile) > 0 {
+		return LoadClientKey(keyFile)
+	}
+	if len(passphrase) > 0 {
+		return PassphraseKey(passphrase), nil
+	}
+	return nil, nil
+}
 
-	select {}
+// runKeygen creates a new client key file.
+func runKeygen(args []string, stdout io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: dfs keygen <file>")
+	}
+	if _, err := NewClientKey(args[0]); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "wrote a new key to %s, files encrypted with it are lost without it\n", args[0])
+	return nil
 }
 
-func makeServer(id, listenAddr string, nodes ...string) *FileServer {
-	tcpOpts := p2p.TCPTransportOpts{
-		ListenAddr: listenAddr,
-		ShakeHands: p2p.NOPHandshakeFunc,
-		Decoder:    p2p.NOPDecoder{},
-		OnPeer: func(p p2p.Peer) error {
-			log.Printf("calling onPeer function...")
-			return nil
-		},
-	}
-	tcpTransport := p2p.NewTCPTransport(tcpOpts)
-	serverOpts := FileServerOpts{
-		ID:                id,
-		Encryptionkey:     newEncryptionKey(),
-		Transport:         tcpTransport,
-		PathTransformFunc: CASPathTransformFunc,
-		StorageFolder:     listenAddr[1:] + "_network",
-		BootstrapNodes:    nodes,
-	}
-	s := NewFileServer(serverOpts)
-	tcpTransport.OnPeer = s.OnPeer
-	return s
+// writeLocalFile writes r to path, removing the file if the transfer fails.
+func writeLocalFile(path string, r io.Reader) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
 }
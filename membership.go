@@ -0,0 +1,557 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MemberState is the state of a cluster member as seen by a node.
+type MemberState int
+
+const (
+	StateAlive MemberState = iota
+	StateSuspect
+	StateDead
+)
+
+func (st MemberState) String() string {
+	switch st {
+	case StateAlive:
+		return "alive"
+	case StateSuspect:
+		return "suspect"
+	case StateDead:
+		return "dead"
+	}
+	return "unknown"
+}
+
+// Member is a node in the cluster. Members are gossiped between nodes,
+// the Incarnation orders the updates a node makes about itself.
+type Member struct {
+	ID          string
+	Addr        string
+	State       MemberState
+	Incarnation uint64
+}
+
+// PingMessage is a Message Payload that probes a member, it is answered with an AckMessage.
+// When Join is true the receiver answers with its whole member list.
+type PingMessage struct {
+	Seq     uint64
+	From    Member
+	Join    bool
+	Updates []Member
+}
+
+// PingReqMessage is a Message Payload asking a member to
+// probe Target on behalf of the sender.
+type PingReqMessage struct {
+	Seq     uint64
+	From    Member
+	Target  string
+	Updates []Member
+}
+
+// AckMessage is a Message Payload answering a PingMessage or PingReqMessage.
+type AckMessage struct {
+	Seq     uint64
+	From    Member
+	Updates []Member
+}
+
+// MembershipOpts is an options struct for Membership.
+type MembershipOpts struct {
+	ID string
+	// ProbeInterval is the time between two probes of random members.
+	ProbeInterval time.Duration
+	// ProbeTimeout is how long to wait for an ack before asking
+	// other members to probe indirectly.
+	ProbeTimeout time.Duration
+	// SuspicionTimeout is how long a member stays suspect before it is declared dead.
+	SuspicionTimeout time.Duration
+	// DeadTimeout is how long a dead member is remembered before it is
+	// forgotten. Until then its address is not redialed.
+	DeadTimeout time.Duration
+	// IndirectChecks is the number of members asked to probe indirectly.
+	IndirectChecks int
+	// Send sends a payload over the connection of a peer.
+	Send func(peer string, payload any) error
+	// Dial connects to the listen address of a discovered member.
+	Dial func(addr string) error
+	// OnDead is called with the connection of a member that was declared dead.
+	OnDead func(peer string)
+}
+
+// Default membership timings.
+var (
+	DefaultProbeInterval  = time.Second
+	DefaultIndirectChecks = 3
+)
+
+// memberEntry is the local view of a member.
+type memberEntry struct {
+	Member
+	// peer is the connection the member was last heard from.
+	peer        string
+	suspectedAt time.Time
+	deadAt      time.Time
+	lastDial    time.Time
+}
+
+// update is a member update waiting to be piggybacked.
+type update struct {
+	member    Member
+	transmits int
+}
+
+// Membership is a SWIM style failure detector and membership list. Members are
+// probed over the existing Transport connections, and updates about them are
+// piggybacked on the probes so they spread through the whole cluster.
+type Membership struct {
+	MembershipOpts
+
+	lock    sync.Mutex
+	self    Member
+	members map[string]*memberEntry
+	updates map[string]*update
+	acks    map[uint64]chan struct{}
+
+	seq    atomic.Uint64
+	quitch chan struct{}
+}
+
+// NewMembership returns a new Membership struct.
+func NewMembership(opts MembershipOpts) *Membership {
+	if opts.ProbeInterval == 0 {
+		opts.ProbeInterval = DefaultProbeInterval
+	}
+	if opts.ProbeTimeout == 0 {
+		opts.ProbeTimeout = opts.ProbeInterval / 2
+	}
+	if opts.SuspicionTimeout == 0 {
+		opts.SuspicionTimeout = opts.ProbeInterval * 5
+	}
+	if opts.DeadTimeout == 0 {
+		opts.DeadTimeout = opts.SuspicionTimeout * 12
+	}
+	if opts.IndirectChecks == 0 {
+		opts.IndirectChecks = DefaultIndirectChecks
+	}
+	return &Membership{
+		MembershipOpts: opts,
+		self:           Member{ID: opts.ID},
+		members:        make(map[string]*memberEntry),
+		updates:        make(map[string]*update),
+		acks:           make(map[uint64]chan struct{}),
+		quitch:         make(chan struct{}),
+	}
+}
+
+// Start starts probing members, addr is the listen address gossiped to others.
+func (m *Membership) Start(addr string) {
+	m.lock.Lock()
+	m.self.Addr = addr
+	m.lock.Unlock()
+	go m.probeLoop()
+}
+
+// Stop stops probing members.
+func (m *Membership) Stop() {
+	close(m.quitch)
+}
+
+// Members returns every known member, not including the local node.
+func (m *Membership) Members() []Member {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	members := make([]Member, 0, len(m.members))
+	for _, e := range m.members {
+		members = append(members, e.Member)
+	}
+	return members
+}
+
+// Join introduces the local node over a new connection
+// and asks the other side for its member list.
+func (m *Membership) Join(peer string) {
+	m.lock.Lock()
+	ping := PingMessage{
+		Seq:     m.seq.Add(1),
+		From:    m.self,
+		Join:    true,
+		Updates: m.allMembers(),
+	}
+	m.lock.Unlock()
+	if err := m.Send(peer, ping); err != nil {
+		log.Printf("[%s]: failed to join through (%s): %s", m.ID, peer, err)
+	}
+}
+
+// Disconnected forgets a closed connection, members that were only
+// reachable over it are not probed until they are heard from again.
+func (m *Membership) Disconnected(peer string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, e := range m.members {
+		if e.peer == peer {
+			e.peer = ""
+		}
+	}
+}
+
+// Dead reports whether addr is only the address of members that are
+// dead. It is false for addresses of no known member.
+func (m *Membership) Dead(addr string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	dead := false
+	for _, e := range m.members {
+		if e.Addr != addr {
+			continue
+		}
+		if e.State != StateDead {
+			return false
+		}
+		dead = true
+	}
+	return dead
+}
+
+// HandleMessage handles a membership payload recieved from a peer.
+func (m *Membership) HandleMessage(peer string, payload any) {
+	switch msg := payload.(type) {
+	case PingMessage:
+		m.heardFrom(peer, msg.From)
+		m.merge(msg.Updates)
+		m.lock.Lock()
+		ack := AckMessage{Seq: msg.Seq, From: m.self, Updates: m.piggyback()}
+		if msg.Join {
+			ack.Updates = m.allMembers()
+		}
+		m.lock.Unlock()
+		if err := m.Send(peer, ack); err != nil {
+			log.Printf("[%s]: failed to ack ping from (%s): %s", m.ID, peer, err)
+		}
+
+	case PingReqMessage:
+		m.heardFrom(peer, msg.From)
+		m.merge(msg.Updates)
+		go func() {
+			if m.probe(msg.Target) {
+				m.lock.Lock()
+				ack := AckMessage{Seq: msg.Seq, From: m.self, Updates: m.piggyback()}
+				m.lock.Unlock()
+				m.Send(peer, ack)
+			}
+		}()
+
+	case AckMessage:
+		m.heardFrom(peer, msg.From)
+		m.merge(msg.Updates)
+		m.lock.Lock()
+		if ch, ok := m.acks[msg.Seq]; ok {
+			close(ch)
+			delete(m.acks, msg.Seq)
+		}
+		m.lock.Unlock()
+	}
+}
+
+// heardFrom records that a member talked to us directly over a connection.
+func (m *Membership) heardFrom(peer string, from Member) {
+	if len(from.ID) == 0 || from.ID == m.ID {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.members[from.ID]
+	if !ok {
+		e = &memberEntry{Member: from}
+		m.members[from.ID] = e
+		m.queue(e.Member)
+		log.Printf("[%s]: member (%s) at (%s) joined", m.ID, from.ID, from.Addr)
+	}
+	e.peer = peer
+	if from.Incarnation > e.Incarnation || e.State != StateAlive && from.Incarnation == e.Incarnation {
+		e.Incarnation = from.Incarnation
+		e.State = StateAlive
+		e.Addr = from.Addr
+		m.queue(e.Member)
+	}
+}
+
+// merge applies gossiped member updates.
+func (m *Membership) merge(updates []Member) {
+	var discovered []string
+	m.lock.Lock()
+	for _, u := range updates {
+		if u.ID == m.ID {
+			m.refute(u)
+			continue
+		}
+		e, ok := m.members[u.ID]
+		if !ok {
+			if u.State == StateDead {
+				continue
+			}
+			e = &memberEntry{Member: u, suspectedAt: time.Now()}
+			m.members[u.ID] = e
+			m.queue(u)
+			if m.shouldDial(e) {
+				e.lastDial = time.Now()
+				discovered = append(discovered, u.Addr)
+			}
+			continue
+		}
+		if !overrides(u, e.Member) {
+			continue
+		}
+		if u.State == StateSuspect && e.State != StateSuspect {
+			e.suspectedAt = time.Now()
+		}
+		e.Member = u
+		m.queue(u)
+		if u.State == StateDead {
+			m.declareDead(e)
+		}
+		if m.shouldDial(e) {
+			e.lastDial = time.Now()
+			discovered = append(discovered, u.Addr)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, addr := range discovered {
+		go m.dial(addr)
+	}
+}
+
+// overrides reports whether the update u wins over the current view cur.
+func overrides(u, cur Member) bool {
+	switch u.State {
+	case StateAlive:
+		return u.Incarnation > cur.Incarnation
+	case StateSuspect:
+		return u.Incarnation > cur.Incarnation ||
+			u.Incarnation == cur.Incarnation && cur.State == StateAlive
+	case StateDead:
+		return cur.State != StateDead && u.Incarnation >= cur.Incarnation
+	}
+	return false
+}
+
+// refute answers suspicions about the local node by
+// gossiping a newer incarnation of itself.
+func (m *Membership) refute(u Member) {
+	if u.State == StateAlive || u.Incarnation < m.self.Incarnation {
+		return
+	}
+	m.self.Incarnation = u.Incarnation + 1
+	m.queue(m.self)
+	log.Printf("[%s]: refuting (%s) state with incarnation (%d)", m.ID, u.State, m.self.Incarnation)
+}
+
+// queue schedules a member update to be piggybacked on the next messages.
+func (m *Membership) queue(member Member) {
+	m.updates[member.ID] = &update{member: member}
+}
+
+// piggyback returns the updates to send with a message. Every update is
+// sent a number of times that grows with the logarithm of the cluster size.
+func (m *Membership) piggyback() []Member {
+	limit := 3 * int(math.Ceil(math.Log2(float64(len(m.members)+2))))
+	members := []Member{}
+	for id, u := range m.updates {
+		members = append(members, u.member)
+		u.transmits++
+		if u.transmits >= limit {
+			delete(m.updates, id)
+		}
+	}
+	return members
+}
+
+// allMembers returns the full member list, including the local node.
+func (m *Membership) allMembers() []Member {
+	members := []Member{m.self}
+	for _, e := range m.members {
+		members = append(members, e.Member)
+	}
+	return members
+}
+
+// shouldDial reports whether the local node is responsible for connecting
+// to a member. Only the node with the lower ID dials to avoid duplicate links.
+func (m *Membership) shouldDial(e *memberEntry) bool {
+	return e.State == StateAlive &&
+		len(e.peer) == 0 &&
+		len(e.Addr) > 0 &&
+		m.ID < e.ID &&
+		time.Since(e.lastDial) > m.ProbeInterval*4
+}
+
+func (m *Membership) dial(addr string) {
+	if m.Dial == nil {
+		return
+	}
+	if err := m.Dial(addr); err != nil {
+		log.Printf("[%s]: failed to dial member at (%s): %s", m.ID, addr, err)
+	}
+}
+
+// declareDead drops the connection to a member that was declared dead.
+func (m *Membership) declareDead(e *memberEntry) {
+	log.Printf("[%s]: member (%s) at (%s) is dead", m.ID, e.ID, e.Addr)
+	e.deadAt = time.Now()
+	peer := e.peer
+	e.peer = ""
+	if len(peer) > 0 && m.OnDead != nil {
+		go m.OnDead(peer)
+	}
+}
+
+// probeLoop probes a random member every ProbeInterval.
+func (m *Membership) probeLoop() {
+	ticker := time.NewTicker(m.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.tick()
+		case <-m.quitch:
+			return
+		}
+	}
+}
+
+// tick expires suspicions and dead members, dials undiscovered
+// members and probes a random member.
+func (m *Membership) tick() {
+	var (
+		targets []string
+		dials   []string
+	)
+	m.lock.Lock()
+	for id, e := range m.members {
+		if e.State == StateDead && time.Since(e.deadAt) > m.DeadTimeout {
+			log.Printf("[%s]: forgetting dead member (%s) at (%s)", m.ID, e.ID, e.Addr)
+			delete(m.members, id)
+			continue
+		}
+		if e.State == StateSuspect && time.Since(e.suspectedAt) > m.SuspicionTimeout {
+			e.State = StateDead
+			m.queue(e.Member)
+			m.declareDead(e)
+		}
+		if m.shouldDial(e) {
+			e.lastDial = time.Now()
+			dials = append(dials, e.Addr)
+		}
+		if e.State != StateDead && len(e.peer) > 0 {
+			targets = append(targets, e.ID)
+		}
+	}
+	m.lock.Unlock()
+
+	for _, addr := range dials {
+		go m.dial(addr)
+	}
+	if len(targets) == 0 {
+		return
+	}
+	target := targets[rand.Intn(len(targets))]
+	go func() {
+		if m.probe(target) || m.probeIndirect(target, targets) {
+			return
+		}
+		m.suspect(target)
+	}()
+}
+
+// probe pings a member directly and reports whether it answered in time.
+func (m *Membership) probe(id string) bool {
+	m.lock.Lock()
+	e, ok := m.members[id]
+	if !ok || len(e.peer) == 0 {
+		m.lock.Unlock()
+		return false
+	}
+	peer := e.peer
+	ping := PingMessage{Seq: m.seq.Add(1), From: m.self, Updates: m.piggyback()}
+	ackch := make(chan struct{})
+	m.acks[ping.Seq] = ackch
+	m.lock.Unlock()
+
+	if err := m.Send(peer, ping); err != nil {
+		m.forgetAck(ping.Seq)
+		return false
+	}
+	return m.waitAck(ping.Seq, ackch, m.ProbeTimeout)
+}
+
+// probeIndirect asks other members to probe a member that did not answer.
+// Candidates that left or lost their connection since are skipped.
+func (m *Membership) probeIndirect(target string, candidates []string) bool {
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	m.lock.Lock()
+	req := PingReqMessage{Seq: m.seq.Add(1), From: m.self, Target: target, Updates: m.piggyback()}
+	ackch := make(chan struct{})
+	m.acks[req.Seq] = ackch
+	peers := []string{}
+	for _, id := range candidates {
+		e, ok := m.members[id]
+		if id == target || !ok || len(e.peer) == 0 || len(peers) == m.IndirectChecks {
+			continue
+		}
+		peers = append(peers, e.peer)
+	}
+	m.lock.Unlock()
+
+	for _, peer := range peers {
+		m.Send(peer, req)
+	}
+	if len(peers) == 0 {
+		m.forgetAck(req.Seq)
+		return false
+	}
+	return m.waitAck(req.Seq, ackch, m.ProbeInterval-m.ProbeTimeout)
+}
+
+func (m *Membership) waitAck(seq uint64, ackch chan struct{}, timeout time.Duration) bool {
+	select {
+	case <-ackch:
+		return true
+	case <-time.After(timeout):
+		m.forgetAck(seq)
+		return false
+	case <-m.quitch:
+		return false
+	}
+}
+
+func (m *Membership) forgetAck(seq uint64) {
+	m.lock.Lock()
+	delete(m.acks, seq)
+	m.lock.Unlock()
+}
+
+// suspect marks a member that failed a probe as suspect.
+func (m *Membership) suspect(id string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	e, ok := m.members[id]
+	if !ok || e.State != StateAlive {
+		return
+	}
+	log.Printf("[%s]: member (%s) at (%s) is suspect", m.ID, e.ID, e.Addr)
+	e.State = StateSuspect
+	e.suspectedAt = time.Now()
+	m.queue(e.Member)
+}
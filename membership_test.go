@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMembershipOverrides(t *testing.T) {
+	alive := Member{ID: "a", State: StateAlive, Incarnation: 1}
+	suspect := Member{ID: "a", State: StateSuspect, Incarnation: 1}
+	dead := Member{ID: "a", State: StateDead, Incarnation: 1}
+
+	assert.True(t, overrides(suspect, alive))
+	assert.False(t, overrides(alive, suspect))
+	assert.True(t, overrides(Member{State: StateAlive, Incarnation: 2}, suspect))
+	assert.True(t, overrides(dead, suspect))
+	assert.True(t, overrides(dead, alive))
+	assert.False(t, overrides(suspect, dead))
+	assert.False(t, overrides(alive, dead))
+	assert.True(t, overrides(Member{State: StateAlive, Incarnation: 2}, dead))
+}
+
+func TestMembershipRefutesSuspicion(t *testing.T) {
+	m := NewMembership(MembershipOpts{ID: "a"})
+	m.merge([]Member{{ID: "a", State: StateSuspect, Incarnation: 0}})
+	assert.EqualValues(t, 1, m.self.Incarnation)
+	assert.Equal(t, StateAlive, m.updates["a"].member.State)
+}
+
+func TestMembershipDeclaresDeadAfterSuspicion(t *testing.T) {
+	dead := make(chan string, 1)
+	m := NewMembership(MembershipOpts{
+		ID:               "a",
+		SuspicionTimeout: time.Millisecond,
+		Send:             func(string, any) error { return nil },
+		OnDead:           func(peer string) { dead <- peer },
+	})
+	m.heardFrom("conn-b", Member{ID: "b", Addr: "b:3000"})
+	m.suspect("b")
+	time.Sleep(time.Millisecond * 5)
+	m.tick()
+
+	assert.Equal(t, "conn-b", <-dead)
+	assert.Equal(t, StateDead, m.Members()[0].State)
+}
+
+func TestMembershipForgetsDeadMembers(t *testing.T) {
+	m := NewMembership(MembershipOpts{
+		ID:          "a",
+		DeadTimeout: time.Millisecond,
+		Send:        func(string, any) error { return nil },
+	})
+	m.heardFrom("conn-b", Member{ID: "b", Addr: "b:3000"})
+	m.merge([]Member{{ID: "b", Addr: "b:3000", State: StateDead}})
+	assert.True(t, m.Dead("b:3000"))
+	m.tick()
+	assert.Len(t, m.Members(), 1)
+
+	time.Sleep(time.Millisecond * 5)
+	m.tick()
+	assert.Empty(t, m.Members())
+	assert.False(t, m.Dead("b:3000"))
+
+	// Gossip about the death does not bring it back.
+	m.merge([]Member{{ID: "b", Addr: "b:3000", State: StateDead}})
+	assert.Empty(t, m.Members())
+}
+
+func TestMembershipProbeIndirectSkipsRelaysWithoutConnection(t *testing.T) {
+	sent := make(chan string, 4)
+	m := NewMembership(MembershipOpts{
+		ID:            "a",
+		ProbeInterval: time.Millisecond * 10,
+		Send: func(peer string, _ any) error {
+			sent <- peer
+			return nil
+		},
+	})
+	for _, id := range []string{"b", "c", "d"} {
+		m.heardFrom("conn-"+id, Member{ID: id})
+	}
+	m.Disconnected("conn-c")
+
+	assert.False(t, m.probeIndirect("d", []string{"b", "c", "d", "gone"}))
+	close(sent)
+	peers := []string{}
+	for peer := range sent {
+		peers = append(peers, peer)
+	}
+	assert.Equal(t, []string{"conn-b"}, peers)
+
+	// Without a relay left, nothing is sent.
+	m.Disconnected("conn-b")
+	sent = make(chan string, 1)
+	assert.False(t, m.probeIndirect("d", []string{"b", "c"}))
+	assert.Empty(t, sent)
+}
+
+func TestMembershipDiscoversClusterFromSeed(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	seed := newTestServer(t, network)
+	s2 := newTestServer(t, network, seed.Transport.Addr())
+	s3 := newTestServer(t, network, seed.Transport.Addr())
+	for _, s := range []*FileServer{seed, s2, s3} {
+		s.membership.Start(s.Transport.Addr())
+	}
+
+	// s2 and s3 only know the seed, gossip makes them connect to each other.
+	waitForPeers(t, s2, 2)
+	waitForPeers(t, s3, 2)
+	assert.Eventually(t, func() bool { return len(s2.membership.Members()) == 2 }, time.Second, time.Millisecond*5)
+}
+
+func TestMembershipRemovesDeadPeer(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	s1.membership.Start(s1.Transport.Addr())
+	s2.membership.Start(s2.Transport.Addr())
+	waitForPeers(t, s1, 1)
+	assert.Eventually(t, func() bool { return len(s1.membership.Members()) == 1 }, time.Second, time.Millisecond*5)
+
+	// A stopped server no longer answers probes.
+	s2.Stop()
+	assert.Eventually(t, func() bool {
+		s1.peerLock.Lock()
+		defer s1.peerLock.Unlock()
+		return len(s1.peers) == 0
+	}, time.Second*2, time.Millisecond*10)
+}
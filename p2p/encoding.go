@@ -1,20 +1,34 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
+// MaxPayloadSize is the largest message payload a frame may carry.
+const MaxPayloadSize = 32 << 20
+
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
 }
 
 type GOBDecoder struct{}
 
+// GOBDecoder decodes gob encoded messages, it does not support streams.
 func (dec GOBDecoder) Decode(r io.Reader, rpc *RPC) error {
-	return gob.NewDecoder(r).Decode(rpc)
+	var msg struct{ Payload []byte }
+	if err := gob.NewDecoder(r).Decode(&msg); err != nil {
+		return err
+	}
+	rpc.Payload = msg.Payload
+	return nil
 }
 
+// NOPDecoder reads a single type byte followed by whatever a single Read
+// returns. It does not understand frame boundaries nor streams and is kept
+// only for backwards compatibility, use DefaultDecoder instead.
 type NOPDecoder struct{}
 
 func (dec NOPDecoder) Decode(r io.Reader, rpc *RPC) error {
@@ -23,9 +37,8 @@ func (dec NOPDecoder) Decode(r io.Reader, rpc *RPC) error {
 		return err
 	}
 
-	if peekBuf[0] == IncomingStream {
-		rpc.Stream = true
-		return nil
+	if peekBuf[0] != IncomingMessage {
+		return fmt.Errorf("NOPDecoder does not support frame type (0x%x)", peekBuf[0])
 	}
 
 	buf := make([]byte, 2048)
@@ -36,3 +49,63 @@ func (dec NOPDecoder) Decode(r io.Reader, rpc *RPC) error {
 	rpc.Payload = buf[:n]
 	return nil
 }
+
+// DefaultDecoder decodes length prefixed frames written by WriteFrame.
+// A frame is a type byte, a big endian uint32 payload length, and the payload.
+// The payload of stream frames starts with the big endian uint32 stream ID.
+type DefaultDecoder struct{}
+
+func (dec DefaultDecoder) Decode(r io.Reader, rpc *RPC) error {
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if typ < IncomingMessage || typ > StreamWindowUpdate {
+		return fmt.Errorf("invalid frame type (0x%x)", typ)
+	}
+	rpc.frame = typ
+	rpc.Payload = payload
+	if rpc.frame == IncomingMessage {
+		return nil
+	}
+	if len(payload) < streamIDSize {
+		return fmt.Errorf("stream frame of (%d) bytes has no stream ID", len(payload))
+	}
+	rpc.streamID = binary.BigEndian.Uint32(payload)
+	rpc.Payload = payload[streamIDSize:]
+	return nil
+}
+
+// readFrame reads a single frame written by WriteFrame.
+func readFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if size > MaxPayloadSize {
+		return 0, nil, fmt.Errorf("frame payload of (%d) bytes exceeds limit of (%d) bytes", size, MaxPayloadSize)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+// frameHeaderSize is the size of the type byte and the length prefix.
+const frameHeaderSize = 5
+
+// WriteFrame writes a single frame of type typ carrying payload to w.
+// The header and the payload are written with a single call to Write.
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > MaxPayloadSize {
+		return fmt.Errorf("frame payload of (%d) bytes exceeds limit of (%d) bytes", len(payload), MaxPayloadSize)
+	}
+	buf := make([]byte, frameHeaderSize+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	copy(buf[frameHeaderSize:], payload)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,54 @@
+package p2p
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultDecoderLargeAndCoalescedFrames(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 10*1024)
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, IncomingMessage, large))
+	assert.Nil(t, WriteFrame(buf, IncomingMessage, []byte("second")))
+	assert.Nil(t, WriteFrame(buf, IncomingStream, streamPayload(7, []byte("header"))))
+	assert.Nil(t, WriteFrame(buf, StreamData, streamPayload(7, []byte("stream bytes"))))
+
+	dec := DefaultDecoder{}
+
+	var rpc RPC
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, byte(IncomingMessage), rpc.frame)
+	assert.Equal(t, large, rpc.Payload)
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, "second", string(rpc.Payload))
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, byte(IncomingStream), rpc.frame)
+	assert.Equal(t, uint32(7), rpc.streamID)
+	assert.Equal(t, "header", string(rpc.Payload))
+
+	rpc = RPC{}
+	assert.Nil(t, dec.Decode(buf, &rpc))
+	assert.Equal(t, byte(StreamData), rpc.frame)
+	assert.Equal(t, uint32(7), rpc.streamID)
+	assert.Equal(t, "stream bytes", string(rpc.Payload))
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestDefaultDecoderRejectsStreamFrameWithoutID(t *testing.T) {
+	buf := new(bytes.Buffer)
+	assert.Nil(t, WriteFrame(buf, StreamData, []byte{0, 1}))
+	var rpc RPC
+	assert.NotNil(t, DefaultDecoder{}.Decode(buf, &rpc))
+}
+
+func TestDefaultDecoderRejectsOversizedFrame(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{IncomingMessage, 0xff, 0xff, 0xff, 0xff})
+	var rpc RPC
+	assert.NotNil(t, DefaultDecoder{}.Decode(buf, &rpc))
+}
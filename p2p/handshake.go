@@ -1,7 +1,277 @@
 package p2p
 
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
 // HandshakeFunc is a function that is
 // called to handle and validate a connection
 type HandshakeFunc func(Peer) error
 
 var NOPHandshakeFunc HandshakeFunc = func(p Peer) error { return nil }
+
+// ChainHandshakeFuncs returns a HandshakeFunc that runs fns in order and
+// stops at the first that fails. The last one to set the peer Identity wins.
+func ChainHandshakeFuncs(fns ...HandshakeFunc) HandshakeFunc {
+	return func(p Peer) error {
+		for _, fn := range fns {
+			if err := fn(p); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// ProtocolVersion is the version of the protocol spoken by this node,
+// MinProtocolVersion the oldest version it still speaks.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// FeatureStreams is the feature of nodes that multiplex streams.
+const FeatureStreams = "streams"
+
+// DefaultHandshakeTimeout bounds the signed handshake of a new connection.
+var DefaultHandshakeTimeout = time.Second * 10
+
+// handshakeContext is signed along with the nonce, so the signature
+// can not be replayed as a signature of anything else.
+const handshakeContext = "dfs handshake\x00"
+
+// nonceSize is the size of the random nonce of every hello.
+const nonceSize = 32
+
+// Hello is what a node tells about itself when a connection is set up.
+type Hello struct {
+	NodeID     string   `json:"node_id"`
+	Version    int      `json:"version"`
+	MinVersion int      `json:"min_version"`
+	Features   []string `json:"features"`
+	ListenAddr string   `json:"listen_addr"`
+	PublicKey  []byte   `json:"public_key"`
+	Nonce      []byte   `json:"nonce"`
+}
+
+// helloProof proves that the sender of a hello holds its private key.
+type helloProof struct {
+	Signature []byte `json:"signature"`
+}
+
+// SignedHandshakeOpts is an options struct for SignedHandshakeFunc.
+type SignedHandshakeOpts struct {
+	NodeID string
+	// ListenAddr is the address the node accepts connections on.
+	// An unspecified host is replaced by the local address of the
+	// connection, which is where the remote node reached it.
+	ListenAddr string
+	PrivateKey ed25519.PrivateKey
+	Features   []string
+	// Verify is called with the hello of a remote node once its
+	// signature is verified, and rejects the peer when it fails.
+	Verify  func(Hello) error
+	Timeout time.Duration
+}
+
+// SignedHandshakeFunc returns a HandshakeFunc where both sides send a
+// Hello and then sign the nonce of the other side, along with their own
+// hello, with the key of their hello. Peers speaking no common protocol
+// version, connections to the node itself and node IDs presenting another
+// key than they did before are rejected. The node ID of the remote node
+// becomes the peer Identity. When an earlier handshake, like the one of
+// TLSHandshakeFunc, already verified the Identity, the node ID must be it.
+func SignedHandshakeFunc(opts SignedHandshakeOpts) HandshakeFunc {
+	if opts.Timeout == 0 {
+		opts.Timeout = DefaultHandshakeTimeout
+	}
+	var (
+		lock sync.Mutex
+		// keys are the public keys node IDs were seen with.
+		keys = make(map[string]ed25519.PublicKey)
+	)
+	return func(p Peer) error {
+		tp, ok := p.(*TCPPeer)
+		if !ok {
+			return errors.New("signed handshake requires a TCPPeer")
+		}
+		tp.Conn.SetDeadline(time.Now().Add(opts.Timeout))
+		defer tp.Conn.SetDeadline(time.Time{})
+
+		hello, err := exchangeHellos(tp, opts)
+		if err != nil {
+			return fmt.Errorf("handshake with (%s): %w", tp.RemoteAddr(), err)
+		}
+		if len(tp.identity) > 0 && tp.identity != hello.NodeID {
+			return fmt.Errorf("handshake with (%s): node (%s) is verified as (%s)", tp.RemoteAddr(), hello.NodeID, tp.identity)
+		}
+
+		lock.Lock()
+		known, ok := keys[hello.NodeID]
+		if !ok {
+			keys[hello.NodeID] = hello.PublicKey
+		}
+		lock.Unlock()
+		if ok && !known.Equal(ed25519.PublicKey(hello.PublicKey)) {
+			return fmt.Errorf("handshake with (%s): node (%s) presented another key than before", tp.RemoteAddr(), hello.NodeID)
+		}
+		if opts.Verify != nil {
+			if err := opts.Verify(hello); err != nil {
+				return fmt.Errorf("handshake with (%s): %w", tp.RemoteAddr(), err)
+			}
+		}
+
+		tp.identity = hello.NodeID
+		tp.listenAddr = hello.ListenAddr
+		tp.version = min(ProtocolVersion, hello.Version)
+		for _, f := range opts.Features {
+			if slices.Contains(hello.Features, f) {
+				tp.features = append(tp.features, f)
+			}
+		}
+		return nil
+	}
+}
+
+// exchangeHellos sends the hello of the local node and its proof, and
+// returns the hello of the remote node once its proof is verified.
+func exchangeHellos(tp *TCPPeer, opts SignedHandshakeOpts) (Hello, error) {
+	local := Hello{
+		NodeID:     opts.NodeID,
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Features:   opts.Features,
+		ListenAddr: advertisedAddr(opts.ListenAddr, tp.LocalAddr()),
+		PublicKey:  opts.PrivateKey.Public().(ed25519.PublicKey),
+		Nonce:      make([]byte, nonceSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, local.Nonce); err != nil {
+		return Hello{}, err
+	}
+	localBuf, err := json.Marshal(local)
+	if err != nil {
+		return Hello{}, err
+	}
+	// Both sides send first, the frames are small enough
+	// to never block on the other side reading them.
+	if err := tp.enqueue(outgoing{kind: HandshakeMessage, payload: localBuf}); err != nil {
+		return Hello{}, err
+	}
+
+	var remote Hello
+	remoteBuf, err := readHandshakeFrame(tp.Conn, &remote)
+	if err != nil {
+		return Hello{}, err
+	}
+	if err := checkHello(remote, opts.NodeID); err != nil {
+		return Hello{}, err
+	}
+
+	proof, err := json.Marshal(helloProof{
+		Signature: ed25519.Sign(opts.PrivateKey, signedHello(remote.Nonce, localBuf)),
+	})
+	if err != nil {
+		return Hello{}, err
+	}
+	if err := tp.enqueue(outgoing{kind: HandshakeMessage, payload: proof}); err != nil {
+		return Hello{}, err
+	}
+	var remoteProof helloProof
+	if _, err := readHandshakeFrame(tp.Conn, &remoteProof); err != nil {
+		return Hello{}, err
+	}
+	if !ed25519.Verify(remote.PublicKey, signedHello(local.Nonce, remoteBuf), remoteProof.Signature) {
+		return Hello{}, fmt.Errorf("invalid signature of node (%s)", remote.NodeID)
+	}
+	return remote, nil
+}
+
+// maxNodeIDSize bounds the size of a node ID.
+const maxNodeIDSize = 128
+
+// ValidNodeID reports whether id can name a node. Node IDs name the
+// folders the objects of peers are kept in, so they are limited to
+// letters, digits, '-', '_' and '.', and do not start with a '.'.
+func ValidNodeID(id string) bool {
+	if len(id) == 0 || len(id) > maxNodeIDSize || id[0] == '.' {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// checkHello checks the hello of a remote node before its proof is read.
+func checkHello(h Hello, localID string) error {
+	if h.Version < MinProtocolVersion || h.MinVersion > ProtocolVersion {
+		return fmt.Errorf("incompatible protocol versions (%d-%d), this node speaks (%d-%d)",
+			h.MinVersion, h.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	if !ValidNodeID(h.NodeID) {
+		return fmt.Errorf("invalid node ID %q", h.NodeID)
+	}
+	if h.NodeID == localID {
+		return errors.New("connected to itself")
+	}
+	if len(h.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid public key of (%d) bytes", len(h.PublicKey))
+	}
+	if len(h.Nonce) != nonceSize {
+		return fmt.Errorf("invalid nonce of (%d) bytes", len(h.Nonce))
+	}
+	return nil
+}
+
+// signedHello returns what a node signs: the nonce of the
+// other side followed by the hello the node sent.
+func signedHello(nonce, hello []byte) []byte {
+	return bytes.Join([][]byte{[]byte(handshakeContext), nonce, hello}, nil)
+}
+
+// readHandshakeFrame reads a handshake frame into v and returns its payload.
+func readHandshakeFrame(r io.Reader, v any) ([]byte, error) {
+	typ, payload, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	if typ != HandshakeMessage {
+		return nil, fmt.Errorf("unexpected frame type (0x%x), the peer does not shake hands", typ)
+	}
+	if err := json.Unmarshal(payload, v); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// advertisedAddr returns the listen address a node tells its peers. When
+// the host of listen is unspecified, like in ":3000", it is the IP of the
+// local address of the connection.
+func advertisedAddr(listen string, local net.Addr) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if ip := net.ParseIP(host); len(host) > 0 && (ip == nil || !ip.IsUnspecified()) {
+		return listen
+	}
+	if tcp, ok := local.(*net.TCPAddr); ok {
+		return net.JoinHostPort(tcp.IP.String(), port)
+	}
+	return listen
+}
@@ -0,0 +1,166 @@
+package p2p
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newSignedTestTransport(t *testing.T, network *MemoryNetwork, id string, features []string, peers chan Peer) *MemoryTransport {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	tr := NewMemoryTransport(MemoryTransportOpts{
+		Network:    network,
+		ListenAddr: id + ":3000",
+		ShakeHands: SignedHandshakeFunc(SignedHandshakeOpts{
+			NodeID:     id,
+			ListenAddr: id + ":3000",
+			PrivateKey: key,
+			Features:   features,
+		}),
+		Decoder: DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+func TestSignedHandshake(t *testing.T) {
+	t.Parallel()
+	network := NewMemoryNetwork()
+	peers1, peers2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1 := newSignedTestTransport(t, network, "node1", []string{FeatureStreams, "a"}, peers1)
+	newSignedTestTransport(t, network, "node2", []string{FeatureStreams, "b"}, peers2)
+
+	assert.Nil(t, tr1.Dail("node2:3000"))
+	for _, c := range []struct {
+		peers chan Peer
+		id    string
+	}{{peers1, "node2"}, {peers2, "node1"}} {
+		select {
+		case p := <-c.peers:
+			assert.Equal(t, c.id, p.Identity())
+			assert.Equal(t, c.id+":3000", p.ListenAddr())
+			assert.Equal(t, ProtocolVersion, p.(*TCPPeer).ProtocolVersion())
+			assert.Equal(t, []string{FeatureStreams}, p.(*TCPPeer).Features())
+		case <-time.After(time.Second * 2):
+			t.Fatalf("%s never completed the handshake", c.id)
+		}
+	}
+}
+
+// fakeHandshake plays the remote side of a signed handshake over conn by
+// hand, sending hello and signing the nonce of the other side with key.
+func fakeHandshake(conn net.Conn, hello Hello, key ed25519.PrivateKey) {
+	defer conn.Close()
+	var local Hello
+	if _, err := readHandshakeFrame(conn, &local); err != nil {
+		return
+	}
+	b, _ := json.Marshal(hello)
+	if err := WriteFrame(conn, HandshakeMessage, b); err != nil {
+		return
+	}
+	if _, err := readHandshakeFrame(conn, &helloProof{}); err != nil {
+		return
+	}
+	proof, _ := json.Marshal(helloProof{Signature: ed25519.Sign(key, signedHello(local.Nonce, b))})
+	WriteFrame(conn, HandshakeMessage, proof)
+	// Wait for the other side to be done with the connection.
+	conn.Read(make([]byte, 1))
+}
+
+func TestSignedHandshakeVerifiesSignatures(t *testing.T) {
+	t.Parallel()
+	_, local, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	otherPub, otherKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	handshake := SignedHandshakeFunc(SignedHandshakeOpts{NodeID: "node1", PrivateKey: local})
+
+	shake := func(hello Hello, key ed25519.PrivateKey) (*TCPPeer, error) {
+		a, b := net.Pipe()
+		hello.Nonce = make([]byte, nonceSize)
+		go fakeHandshake(b, hello, key)
+		p := NewTCPPeer(a, false)
+		defer p.Close()
+		return p, handshake(p)
+	}
+	hello := Hello{NodeID: "node2", Version: ProtocolVersion, MinVersion: MinProtocolVersion, ListenAddr: "node2:3000"}
+
+	// A hello signed by another key than its own is rejected.
+	hello.PublicKey = pub
+	_, err = shake(hello, otherKey)
+	assert.ErrorContains(t, err, "invalid signature")
+
+	p, err := shake(hello, key)
+	assert.Nil(t, err)
+	assert.Equal(t, "node2", p.Identity())
+	assert.Equal(t, "node2:3000", p.ListenAddr())
+
+	// Once seen, a node ID can not be taken over by another key.
+	hello.PublicKey = otherPub
+	_, err = shake(hello, otherKey)
+	assert.ErrorContains(t, err, "another key")
+}
+
+func TestCheckHello(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	valid := Hello{
+		NodeID:     "node2",
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		PublicKey:  pub,
+		Nonce:      make([]byte, nonceSize),
+	}
+	assert.Nil(t, checkHello(valid, "node1"))
+
+	for name, change := range map[string]func(*Hello){
+		"too old":     func(h *Hello) { h.Version, h.MinVersion = MinProtocolVersion-1, MinProtocolVersion-1 },
+		"too new":     func(h *Hello) { h.Version, h.MinVersion = ProtocolVersion+2, ProtocolVersion+1 },
+		"itself":      func(h *Hello) { h.NodeID = "node1" },
+		"no node ID":  func(h *Hello) { h.NodeID = "" },
+		"path":        func(h *Hello) { h.NodeID = "../../node2" },
+		"short key":   func(h *Hello) { h.PublicKey = pub[:8] },
+		"short nonce": func(h *Hello) { h.Nonce = h.Nonce[:8] },
+	} {
+		h := valid
+		change(&h)
+		assert.Error(t, checkHello(h, "node1"), name)
+	}
+
+	// A newer node that still speaks the current version is compatible.
+	h := valid
+	h.Version = ProtocolVersion + 1
+	assert.Nil(t, checkHello(h, "node1"))
+}
+
+func TestAdvertisedAddr(t *testing.T) {
+	local := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 40000}
+	assert.Equal(t, "10.0.0.1:3000", advertisedAddr(":3000", local))
+	assert.Equal(t, "10.0.0.1:3000", advertisedAddr("0.0.0.0:3000", local))
+	assert.Equal(t, "node1:3000", advertisedAddr("node1:3000", local))
+	assert.Equal(t, ":3000", advertisedAddr(":3000", memoryAddr("node1#1")))
+}
+
+func TestValidNodeID(t *testing.T) {
+	for _, id := range []string{"node1", "a", "node-1_b.c", strings.Repeat("f", maxNodeIDSize)} {
+		assert.True(t, ValidNodeID(id), id)
+	}
+	for _, id := range []string{"", ".", "..", ".hidden", "a/b", "../x", `a\b`, "a b", "nöde", strings.Repeat("f", maxNodeIDSize+1)} {
+		assert.False(t, ValidNodeID(id), id)
+	}
+}
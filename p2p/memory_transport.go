@@ -0,0 +1,318 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrPartitioned is returned when dialing a node on the other
+// side of a partition of a MemoryNetwork.
+var ErrPartitioned = errors.New("network partitioned")
+
+// MemoryNetwork is an in-process network that connects MemoryTransports
+// by name. It can inject latency, dropped connections and partitions
+// to test failures deterministically.
+type MemoryNetwork struct {
+	lock       sync.Mutex
+	listeners  map[string]*MemoryTransport
+	conns      map[*memoryConn]struct{}
+	partitions map[[2]string]struct{}
+	ports      int
+
+	latency  time.Duration
+	dropRate float64
+	rand     *rand.Rand
+}
+
+// NewMemoryNetwork returns a new empty MemoryNetwork.
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		listeners:  make(map[string]*MemoryTransport),
+		conns:      make(map[*memoryConn]struct{}),
+		partitions: make(map[[2]string]struct{}),
+		rand:       rand.New(rand.NewSource(1)),
+	}
+}
+
+// SetLatency delays every write on the network by d.
+func (n *MemoryNetwork) SetLatency(d time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.latency = d
+}
+
+// SetDropRate sets the probability of a write breaking its connection,
+// like a link that drops in the middle of a transfer.
+// The random source is seeded so runs are reproducible.
+func (n *MemoryNetwork) SetDropRate(p float64, seed int64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.dropRate = p
+	n.rand = rand.New(rand.NewSource(seed))
+}
+
+// Partition cuts every connection between the nodes a and b and
+// refuses new ones until Heal is called.
+func (n *MemoryNetwork) Partition(a, b string) {
+	n.lock.Lock()
+	n.partitions[linkKey(a, b)] = struct{}{}
+	conns := []*memoryConn{}
+	for conn := range n.conns {
+		if linkKey(conn.owner, conn.peer) == linkKey(a, b) {
+			conns = append(conns, conn)
+		}
+	}
+	n.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Heal removes the partition between the nodes a and b.
+func (n *MemoryNetwork) Heal(a, b string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.partitions, linkKey(a, b))
+}
+
+func linkKey(a, b string) [2]string {
+	if a > b {
+		a, b = b, a
+	}
+	return [2]string{a, b}
+}
+
+// dial connects the node from to the node listening at addr.
+func (n *MemoryNetwork) dial(from, addr string) (net.Conn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.partitions[linkKey(from, addr)]; ok {
+		return nil, ErrPartitioned
+	}
+	l, ok := n.listeners[addr]
+	if !ok {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	n.ports++
+	var (
+		ab     = newPipeBuffer()
+		ba     = newPipeBuffer()
+		local  = memoryAddr(fmt.Sprintf("%s#%d", from, n.ports))
+		remote = memoryAddr(addr)
+		out    = &memoryConn{r: ba, w: ab, local: local, remote: remote, owner: from, peer: addr, network: n}
+		in     = &memoryConn{r: ab, w: ba, local: remote, remote: local, owner: addr, peer: from, network: n}
+	)
+	out.other, in.other = in, out
+	n.conns[out] = struct{}{}
+	n.conns[in] = struct{}{}
+	go l.tcp.handleConn(in, false)
+	return out, nil
+}
+
+// faults returns the latency to inject before a write
+// and whether the write should break the connection.
+func (n *MemoryNetwork) faults() (time.Duration, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.latency, n.dropRate > 0 && n.rand.Float64() < n.dropRate
+}
+
+func (n *MemoryNetwork) forget(conn *memoryConn) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	delete(n.conns, conn)
+}
+
+// MemoryTransportOpts is an options struct for the MemoryTransport.
+type MemoryTransportOpts struct {
+	Network    *MemoryNetwork
+	ListenAddr string
+	ShakeHands HandshakeFunc
+	Decoder    Decoder
+	OnPeer     func(Peer) error
+	// OnPeerDisconnect is called once the connection
+	// of a peer that OnPeer accepted is closed.
+	OnPeerDisconnect func(Peer)
+}
+
+// MemoryTransport is a Transport over a MemoryNetwork.
+// Connections are handled exactly like the ones of a TCPTransport.
+type MemoryTransport struct {
+	MemoryTransportOpts
+	tcp *TCPTransport
+}
+
+// NewMemoryTransport returns a new MemoryTransport struct.
+func NewMemoryTransport(opts MemoryTransportOpts) *MemoryTransport {
+	t := &MemoryTransport{
+		MemoryTransportOpts: opts,
+	}
+	t.tcp = NewTCPTransport(TCPTransportOpts{
+		ListenAddr: opts.ListenAddr,
+		ShakeHands: opts.ShakeHands,
+		Decoder:    opts.Decoder,
+		OnPeer: func(p Peer) error {
+			if t.OnPeer == nil {
+				return nil
+			}
+			return t.OnPeer(p)
+		},
+		OnPeerDisconnect: func(p Peer) {
+			if t.OnPeerDisconnect != nil {
+				t.OnPeerDisconnect(p)
+			}
+		},
+	})
+	return t
+}
+
+// Addr implements the Transport interface.
+func (t *MemoryTransport) Addr() string {
+	return t.ListenAddr
+}
+
+// Consume implements the Transport interface.
+func (t *MemoryTransport) Consume() <-chan RPC {
+	return t.tcp.rpcch
+}
+
+// Dail implements the Transport interface.
+func (t *MemoryTransport) Dail(addr string) error {
+	conn, err := t.Network.dial(t.ListenAddr, addr)
+	if err != nil {
+		return err
+	}
+	go t.tcp.handleConn(conn, true)
+	return nil
+}
+
+// ListenAndAccept implements the Transport interface.
+// It registers the transport on the network under its ListenAddr.
+func (t *MemoryTransport) ListenAndAccept() error {
+	t.Network.lock.Lock()
+	defer t.Network.lock.Unlock()
+	if _, ok := t.Network.listeners[t.ListenAddr]; ok {
+		return fmt.Errorf("listen %s: address already in use", t.ListenAddr)
+	}
+	t.Network.listeners[t.ListenAddr] = t
+	log.Printf("Memory Transport Listening on: %s\n", t.ListenAddr)
+	return nil
+}
+
+// Close implements the Transport interface. Unlike the TCPTransport it
+// also closes every connection of the node, like a crashed process would.
+func (t *MemoryTransport) Close() error {
+	t.Network.lock.Lock()
+	delete(t.Network.listeners, t.ListenAddr)
+	conns := []*memoryConn{}
+	for conn := range t.Network.conns {
+		if conn.owner == t.ListenAddr {
+			conns = append(conns, conn)
+		}
+	}
+	t.Network.lock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// memoryAddr is the net.Addr of a node on a MemoryNetwork.
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
+
+// memoryConn is one end of a buffered in-memory connection. Writes never
+// block on the reader, like writes to a socket with a large kernel buffer.
+type memoryConn struct {
+	r, w          *pipeBuffer
+	local, remote memoryAddr
+	// owner and peer are the names of the nodes on each end.
+	owner, peer string
+	other       *memoryConn
+	network     *MemoryNetwork
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	return c.r.read(b)
+}
+
+func (c *memoryConn) Write(b []byte) (int, error) {
+	latency, drop := c.network.faults()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if drop {
+		c.Close()
+		return 0, net.ErrClosed
+	}
+	return c.w.write(b)
+}
+
+// Close closes both ends of the connection.
+func (c *memoryConn) Close() error {
+	c.r.close()
+	c.w.close()
+	c.network.forget(c)
+	c.network.forget(c.other)
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr                { return c.local }
+func (c *memoryConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *memoryConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memoryConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memoryConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// pipeBuffer is an unbounded buffer that one end of a
+// memoryConn writes to and the other end reads from.
+type pipeBuffer struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newPipeBuffer() *pipeBuffer {
+	b := &pipeBuffer{}
+	b.cond = sync.NewCond(&b.lock)
+	return b
+}
+
+func (b *pipeBuffer) write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return 0, net.ErrClosed
+	}
+	n, _ := b.buf.Write(p)
+	b.cond.Broadcast()
+	return n, nil
+}
+
+func (b *pipeBuffer) read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for b.buf.Len() == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if b.buf.Len() == 0 {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *pipeBuffer) close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	b.cond.Broadcast()
+}
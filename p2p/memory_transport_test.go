@@ -0,0 +1,199 @@
+package p2p
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryTestTransport(t *testing.T, network *MemoryNetwork, addr string, peers chan Peer) *MemoryTransport {
+	tr := NewMemoryTransport(MemoryTransportOpts{
+		Network:    network,
+		ListenAddr: addr,
+		ShakeHands: NOPHandshakeFunc,
+		Decoder:    DefaultDecoder{},
+		OnPeer: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+func TestMemoryTransportSendAndConsume(t *testing.T) {
+	t.Parallel()
+	network := NewMemoryNetwork()
+	peers1, peers2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1 := newMemoryTestTransport(t, network, "node1", peers1)
+	tr2 := newMemoryTestTransport(t, network, "node2", peers2)
+
+	assert.NotNil(t, tr1.Dail("missing"))
+	assert.Nil(t, tr1.Dail("node2"))
+	peer := <-peers1
+	assert.Equal(t, "node2", peer.RemoteAddr().String())
+	inbound := <-peers2
+	assert.Equal(t, peer.LocalAddr().String(), inbound.RemoteAddr().String())
+
+	assert.Nil(t, peer.Send([]byte("hello")))
+	rpc := <-tr2.Consume()
+	assert.Equal(t, "hello", string(rpc.Payload))
+	assert.Equal(t, inbound.RemoteAddr(), rpc.From)
+}
+
+func TestMemoryTransportPartition(t *testing.T) {
+	t.Parallel()
+	network := NewMemoryNetwork()
+	peers1, peers2 := make(chan Peer, 2), make(chan Peer, 2)
+	tr1 := newMemoryTestTransport(t, network, "node1", peers1)
+	tr2 := newMemoryTestTransport(t, network, "node2", peers2)
+	assert.Nil(t, tr1.Dail("node2"))
+	peer := <-peers1
+	<-peers2
+
+	network.Partition("node1", "node2")
+	assert.NotNil(t, peer.Send([]byte("lost")))
+	assert.ErrorIs(t, tr2.Dail("node1"), ErrPartitioned)
+
+	network.Heal("node1", "node2")
+	assert.Nil(t, tr2.Dail("node1"))
+}
+
+func TestMemoryTransportLatencyAndDrops(t *testing.T) {
+	t.Parallel()
+	network := NewMemoryNetwork()
+	peers1, peers2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1 := newMemoryTestTransport(t, network, "node1", peers1)
+	tr2 := newMemoryTestTransport(t, network, "node2", peers2)
+	assert.Nil(t, tr1.Dail("node2"))
+	peer := <-peers1
+	<-peers2
+
+	network.SetLatency(time.Millisecond * 20)
+	start := time.Now()
+	assert.Nil(t, peer.Send([]byte("slow")))
+	assert.GreaterOrEqual(t, time.Since(start), time.Millisecond*20)
+	rpc := <-tr2.Consume()
+	assert.Equal(t, "slow", string(rpc.Payload))
+
+	network.SetLatency(0)
+	network.SetDropRate(1, 1)
+	assert.NotNil(t, peer.Send([]byte("dropped")))
+}
+
+func TestMemoryTransportOnPeerDisconnect(t *testing.T) {
+	t.Parallel()
+	network := NewMemoryNetwork()
+	peers1, peers2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1 := newMemoryTestTransport(t, network, "node1", peers1)
+	tr2 := newMemoryTestTransport(t, network, "node2", peers2)
+	gone1, gone2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1.OnPeerDisconnect = func(p Peer) { gone1 <- p }
+	tr2.OnPeerDisconnect = func(p Peer) { gone2 <- p }
+	assert.Nil(t, tr1.Dail("node2"))
+	peer := <-peers1
+	inbound := <-peers2
+	assert.True(t, peer.Outbound())
+	assert.False(t, inbound.Outbound())
+
+	tr2.Close()
+	assert.Equal(t, peer, <-gone1)
+	assert.Equal(t, inbound, <-gone2)
+}
+
+func TestTCPPeerConcurrentSends(t *testing.T) {
+	t.Parallel()
+	network := NewMemoryNetwork()
+	peers1, peers2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1 := newMemoryTestTransport(t, network, "node1", peers1)
+	tr2 := newMemoryTestTransport(t, network, "node2", peers2)
+	assert.Nil(t, tr1.Dail("node2"))
+	peer := <-peers1
+	<-peers2
+
+	const senders = 20
+	body := bytes.Repeat([]byte("x"), 64<<10)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				assert.Nil(t, peer.Send([]byte("message")))
+			} else {
+				assert.Nil(t, peer.SendStream([]byte("stream"), bytes.NewReader(body)))
+			}
+		}(i)
+	}
+	// Interleaved writes would corrupt the frames or the stream bodies.
+	for i := 0; i < senders; i++ {
+		rpc := <-tr2.Consume()
+		if rpc.Stream == nil {
+			assert.Equal(t, "message", string(rpc.Payload))
+			continue
+		}
+		assert.Equal(t, "stream", string(rpc.Payload))
+		// The streams are read concurrently, like file transfers.
+		wg.Add(1)
+		go func(st *Stream) {
+			defer wg.Done()
+			defer st.Close()
+			got, err := io.ReadAll(st)
+			assert.Nil(t, err)
+			assert.Equal(t, body, got)
+		}(rpc.Stream)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	t.Parallel()
+	network := NewMemoryNetwork()
+	peers1, peers2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1 := newMemoryTestTransport(t, network, "node1", peers1)
+	tr2 := newMemoryTestTransport(t, network, "node2", peers2)
+	assert.Nil(t, tr1.Dail("node2"))
+	peer := <-peers1
+	<-peers2
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- peer.SendStream([]byte("big"), bytes.NewReader(make([]byte, 4*StreamWindow)))
+	}()
+	rpc := <-tr2.Consume()
+	assert.NotNil(t, rpc.Stream)
+
+	// The sender is stalled by the window of the unread stream,
+	// but messages still get through the connection.
+	assert.Nil(t, peer.Send([]byte("control")))
+	rpc2 := <-tr2.Consume()
+	assert.Equal(t, "control", string(rpc2.Payload))
+	select {
+	case err := <-sent:
+		t.Fatalf("stream was sent past its window: %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// Closing the stream early resets it and stops the sender.
+	buf := make([]byte, 1024)
+	_, err := io.ReadFull(rpc.Stream, buf)
+	assert.Nil(t, err)
+	assert.Nil(t, rpc.Stream.Close())
+	assert.ErrorIs(t, <-sent, ErrStreamReset)
+
+	// The connection is still usable after the reset.
+	go func() {
+		sent <- peer.SendStream([]byte("small"), bytes.NewReader([]byte("payload")))
+	}()
+	rpc = <-tr2.Consume()
+	got, err := io.ReadAll(rpc.Stream)
+	assert.Nil(t, err)
+	assert.Equal(t, "payload", string(got))
+	assert.Nil(t, rpc.Stream.Close())
+	assert.Nil(t, <-sent)
+}
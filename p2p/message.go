@@ -2,15 +2,38 @@ package p2p
 
 import "net"
 
+// Frame types.
 const (
 	IncomingMessage = 0x1
-	IncomingStream  = 0x2
+	// IncomingStream opens a stream, its payload is
+	// the stream ID followed by the stream header.
+	IncomingStream = 0x2
+	// The payloads of the other stream frames start with the stream ID.
+	// StreamData carries bytes of a stream, StreamClose ends a stream after
+	// its last bytes, StreamReset aborts a stream from either side and
+	// StreamWindowUpdate grants the sender of a stream more bytes to send.
+	StreamData         = 0x3
+	StreamClose        = 0x4
+	StreamReset        = 0x5
+	StreamWindowUpdate = 0x6
+	// HandshakeMessage frames are only sent by
+	// SignedHandshakeFunc, before any other frame.
+	HandshakeMessage = 0x7
 )
 
 // RPC represents any apbitrary data over
-// the trasport between to nodes on the network
+// the trasport between to nodes on the network.
+// When Stream is set the Payload is the stream header, the stream
+// bytes are read from Stream, which must be closed once done.
 type RPC struct {
 	Payload []byte
 	From    net.Addr
-	Stream  bool
+	// Identity is the verified identity of the sender, see Peer.
+	Identity string
+	Stream   *Stream
+
+	// frame is the type of the decoded frame, and
+	// streamID the stream of a stream frame.
+	frame    byte
+	streamID uint32
 }
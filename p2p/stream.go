@@ -0,0 +1,277 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// ErrStreamReset is returned when the other side aborted a stream.
+var ErrStreamReset = errors.New("stream reset by peer")
+
+// StreamWindow is the flow-control window of every stream: the most
+// bytes a sender may send that the receiver did not read yet.
+const StreamWindow = 256 << 10
+
+// maxStreamData is the most stream bytes a single frame carries,
+// so the frames of concurrent streams and messages interleave finely.
+const maxStreamData = 32 << 10
+
+// streamIDSize is the size of the stream ID prefixing stream frames.
+const streamIDSize = 4
+
+// Stream is one of the transfers multiplexed over the connection of a
+// peer. A stream opened by the peer is read by the consumer of its RPC,
+// the streams of the local node are written by SendStream. Every stream
+// has its own flow-control window, so a slow reader only stalls its own
+// stream and never the connection.
+type Stream struct {
+	id   uint32
+	peer *TCPPeer
+
+	lock sync.Mutex
+	cond *sync.Cond
+	buf  bytes.Buffer
+	// unacked are the bytes read since the last window update.
+	unacked int
+	// credit is what the sender may still send.
+	credit int
+	// eof is set once the sender closed the stream, closed once
+	// the consumer did, and err once the stream failed.
+	eof    bool
+	closed bool
+	err    error
+}
+
+func newStream(id uint32, peer *TCPPeer) *Stream {
+	st := &Stream{id: id, peer: peer, credit: StreamWindow}
+	st.cond = sync.NewCond(&st.lock)
+	return st
+}
+
+// Read reads the bytes of the stream, it returns io.EOF once the
+// sender closed it. The sender is granted more bytes as they are read.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.lock.Lock()
+	for st.buf.Len() == 0 && !st.eof && st.err == nil {
+		st.cond.Wait()
+	}
+	if st.buf.Len() == 0 {
+		err := st.err
+		if err == nil {
+			err = io.EOF
+		}
+		st.lock.Unlock()
+		return 0, err
+	}
+	n, _ := st.buf.Read(p)
+	st.unacked += n
+	grant := 0
+	if st.unacked >= StreamWindow/2 && !st.eof {
+		grant, st.unacked = st.unacked, 0
+	}
+	st.lock.Unlock()
+
+	if grant > 0 {
+		st.peer.sendControl(StreamWindowUpdate, st.id, binary.BigEndian.AppendUint32(nil, uint32(grant)))
+	}
+	return n, nil
+}
+
+// Close releases the stream. A stream that was not read to
+// the end is reset, so the sender stops sending it.
+func (st *Stream) Close() error {
+	st.lock.Lock()
+	done := st.eof || st.err != nil || st.closed
+	st.closed = true
+	if st.err == nil {
+		st.err = net.ErrClosed
+	}
+	st.buf.Reset()
+	st.cond.Broadcast()
+	st.lock.Unlock()
+
+	st.peer.forgetStream(st.id)
+	if !done {
+		st.peer.sendControl(StreamReset, st.id, nil)
+	}
+	return nil
+}
+
+// push buffers bytes received for the stream. Sending more than the
+// window allows is a protocol error that breaks the connection.
+func (st *Stream) push(data []byte) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.closed {
+		return nil
+	}
+	if st.buf.Len()+st.unacked+len(data) > StreamWindow {
+		return fmt.Errorf("stream (%d) exceeded its window", st.id)
+	}
+	st.buf.Write(data)
+	st.cond.Broadcast()
+	return nil
+}
+
+// finish ends the stream, with err or at EOF when err is nil.
+func (st *Stream) finish(err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if err == nil {
+		st.eof = true
+	} else if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+}
+
+// grant adds n bytes to what the sender may send.
+func (st *Stream) grant(n int) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.credit += n
+	st.cond.Broadcast()
+}
+
+// reserve waits until the sender may send bytes, and
+// returns how many of at most n it may send.
+func (st *Stream) reserve(n int) (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	for st.credit == 0 && st.err == nil {
+		st.cond.Wait()
+	}
+	if st.err != nil {
+		return 0, st.err
+	}
+	return min(n, st.credit), nil
+}
+
+// spend takes n sent bytes from the credit of the sender.
+func (st *Stream) spend(n int) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.credit -= n
+}
+
+// openStream registers a new stream of the local node.
+func (p *TCPPeer) openStream() *Stream {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+	st := newStream(p.nextStream, p)
+	// The two sides of a connection pick IDs of different parity.
+	p.nextStream += 2
+	p.streams[st.id] = st
+	return st
+}
+
+// acceptStream registers a stream opened by the peer.
+func (p *TCPPeer) acceptStream(id uint32) (*Stream, error) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+	if id%2 == p.nextStream%2 {
+		return nil, fmt.Errorf("stream (%d) has the ID parity of the local node", id)
+	}
+	if _, ok := p.streams[id]; ok {
+		return nil, fmt.Errorf("stream (%d) is already open", id)
+	}
+	st := newStream(id, p)
+	p.streams[id] = st
+	return st, nil
+}
+
+func (p *TCPPeer) stream(id uint32) (*Stream, bool) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+	st, ok := p.streams[id]
+	return st, ok
+}
+
+func (p *TCPPeer) forgetStream(id uint32) {
+	p.streamLock.Lock()
+	defer p.streamLock.Unlock()
+	delete(p.streams, id)
+}
+
+// failStreams fails every open stream once the connection is closed.
+func (p *TCPPeer) failStreams() {
+	p.streamLock.Lock()
+	streams := p.streams
+	p.streams = make(map[uint32]*Stream)
+	p.streamLock.Unlock()
+	for _, st := range streams {
+		st.finish(net.ErrClosed)
+	}
+}
+
+// handleStreamFrame applies a data, close, reset or window frame
+// received for a stream. Frames of forgotten streams are dropped.
+func (p *TCPPeer) handleStreamFrame(typ byte, id uint32, payload []byte) error {
+	st, ok := p.stream(id)
+	if !ok {
+		return nil
+	}
+	switch typ {
+	case StreamData:
+		return st.push(payload)
+	case StreamClose:
+		st.finish(nil)
+	case StreamReset:
+		st.finish(ErrStreamReset)
+		p.forgetStream(id)
+	case StreamWindowUpdate:
+		if len(payload) != 4 {
+			return fmt.Errorf("invalid window update of stream (%d)", id)
+		}
+		st.grant(int(binary.BigEndian.Uint32(payload)))
+	}
+	return nil
+}
+
+// sendControl queues a frame of the stream id. Errors are not reported,
+// a broken connection fails the stream on both sides anyway.
+func (p *TCPPeer) sendControl(typ byte, id uint32, payload []byte) {
+	p.enqueue(outgoing{kind: typ, payload: streamPayload(id, payload)})
+}
+
+// sendStream opens a stream with header b and sends body over it.
+func (p *TCPPeer) sendStream(b []byte, body io.Reader) error {
+	st := p.openStream()
+	defer p.forgetStream(st.id)
+	if err := p.enqueue(outgoing{kind: IncomingStream, payload: streamPayload(st.id, b)}); err != nil {
+		return err
+	}
+	buf := make([]byte, maxStreamData)
+	for {
+		size, err := st.reserve(len(buf))
+		if err != nil {
+			return err
+		}
+		n, rerr := body.Read(buf[:size])
+		if n > 0 {
+			st.spend(n)
+			if err := p.enqueue(outgoing{kind: StreamData, payload: streamPayload(st.id, buf[:n])}); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			return p.enqueue(outgoing{kind: StreamClose, payload: streamPayload(st.id, nil)})
+		}
+		if rerr != nil {
+			p.sendControl(StreamReset, st.id, nil)
+			return rerr
+		}
+	}
+}
+
+// streamPayload returns the payload of a frame of the stream id carrying data.
+func streamPayload(id uint32, data []byte) []byte {
+	payload := make([]byte, streamIDSize, streamIDSize+len(data))
+	binary.BigEndian.PutUint32(payload, id)
+	return append(payload, data...)
+}
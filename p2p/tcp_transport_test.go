@@ -8,7 +8,7 @@ import (
 
 func TestTCPTransport(t *testing.T) {
 	tcpOpts := TCPTransportOpts{
-		ListenAddr: ":3000",
+		ListenAddr: "127.0.0.1:0",
 		ShakeHands: NOPHandshakeFunc,
 		Decoder:    GOBDecoder{},
 	}
@@ -21,4 +21,5 @@ func TestTCPTransport(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	assert.Nil(t, tr.Close())
 }
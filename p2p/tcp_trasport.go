@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -16,28 +17,124 @@ type TCPPeer struct {
 	// Whether or not the connection is outbound (sending a connection)
 	// or inbound, (recieving a connection)
 	outbound bool
+	// The verified identity of the remote node, empty until a
+	// HandshakeFunc verified it.
+	identity string
+	// listenAddr, version and features are what the remote node told
+	// in a signed handshake: its listen address, the protocol version
+	// spoken with it and the features both nodes support.
+	listenAddr string
+	version    int
+	features   []string
 
-	wg *sync.WaitGroup
+	// streams are the open streams of either side, by ID.
+	streamLock sync.Mutex
+	streams    map[uint32]*Stream
+	nextStream uint32
+
+	// sendq queues everything sent to the peer, writeLoop is the
+	// only goroutine writing to the connection once it is set up.
+	sendq     chan outgoing
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// outgoing is a frame queued to be written to a peer.
+type outgoing struct {
+	kind    byte
+	payload []byte
+	done    chan error
 }
 
-// NewTCPPeer returns a new TCPPeer struct
+// NewTCPPeer returns a new TCPPeer struct and
+// starts the goroutine writing to the connection.
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
-	return &TCPPeer{
-		Conn:     conn,
-		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+	p := &TCPPeer{
+		Conn:       conn,
+		outbound:   outbound,
+		streams:    make(map[uint32]*Stream),
+		nextStream: 2,
+		sendq:      make(chan outgoing),
+		closed:     make(chan struct{}),
 	}
+	if outbound {
+		p.nextStream = 1
+	}
+	go p.writeLoop()
+	return p
 }
 
-// Send implements the Peer interface
+// Send implements the Peer interface.
+// It queues b as a single message frame and waits until it is written.
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
+	return p.enqueue(outgoing{kind: IncomingMessage, payload: b})
+}
+
+// SendStream implements the Peer interface.
+// It opens a new stream with the header b and sends body over it until
+// EOF. The frames of the stream are interleaved with the ones of other
+// streams and messages, and it fails if the receiver resets the stream.
+func (p *TCPPeer) SendStream(b []byte, body io.Reader) error {
+	return p.sendStream(b, body)
+}
+
+// Close closes the connection, stops the writer and fails the open streams.
+func (p *TCPPeer) Close() error {
+	err := p.Conn.Close()
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.failStreams()
+	})
 	return err
 }
 
-// CloseStream implements the Peer interface
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+func (p *TCPPeer) enqueue(out outgoing) error {
+	out.done = make(chan error, 1)
+	select {
+	case p.sendq <- out:
+	case <-p.closed:
+		return net.ErrClosed
+	}
+	return <-out.done
+}
+
+// writeLoop writes the queued frames one at a time, so the
+// frames of concurrent senders never interleave on the connection.
+func (p *TCPPeer) writeLoop() {
+	for {
+		select {
+		case out := <-p.sendq:
+			out.done <- WriteFrame(p.Conn, out.kind, out.payload)
+		case <-p.closed:
+			return
+		}
+	}
+}
+
+// Identity implements the Peer interface.
+func (p *TCPPeer) Identity() string {
+	return p.identity
+}
+
+// ListenAddr implements the Peer interface.
+func (p *TCPPeer) ListenAddr() string {
+	return p.listenAddr
+}
+
+// ProtocolVersion returns the protocol version spoken
+// with the peer, zero without a signed handshake.
+func (p *TCPPeer) ProtocolVersion() int {
+	return p.version
+}
+
+// Features returns the features both the local node and the peer support.
+func (p *TCPPeer) Features() []string {
+	return p.features
+}
+
+// Outbound implements the Peer interface.
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
 }
 
 // TCPTransportOpts is an options struct for the TCPTransport
@@ -46,6 +143,12 @@ type TCPTransportOpts struct {
 	ShakeHands HandshakeFunc
 	Decoder    Decoder
 	OnPeer     func(Peer) error
+	// OnPeerDisconnect is called once the connection of a peer
+	// that OnPeer accepted is closed.
+	OnPeerDisconnect func(Peer)
+	// TLSConfig enables TLS on every connection when set,
+	// use TLSHandshakeFunc to verify the peers.
+	TLSConfig *tls.Config
 }
 
 // TCPTransport is a Transport that uses the TCP/IP protocol.
@@ -83,6 +186,9 @@ func (t *TCPTransport) Dail(addr string) error {
 	if err != nil {
 		return err
 	}
+	if t.TLSConfig != nil {
+		conn = tls.Client(conn, t.TLSConfig)
+	}
 	go t.handleConn(conn, true)
 	return nil
 }
@@ -100,6 +206,9 @@ func (t *TCPTransport) ListenAndAccept() (err error) {
 	if err != nil {
 		return err
 	}
+	if t.TLSConfig != nil {
+		t.listener = tls.NewListener(t.listener, t.TLSConfig)
+	}
 	// Accept Loop
 	go t.acceptLoop()
 	log.Printf("TCP Transport Listening on: %s\n", t.ListenAddr)
@@ -116,6 +225,7 @@ func (t *TCPTransport) acceptLoop() {
 				return
 			}
 			log.Printf("TCPTransport Accept Error: %s\n", err)
+			continue
 		}
 		go t.handleConn(conn, false)
 	}
@@ -126,9 +236,13 @@ func (t *TCPTransport) acceptLoop() {
 func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 	// Create a peer
 	peer := NewTCPPeer(conn, outbound)
+	connected := false
 	defer func() {
 		peer.Close()
-		log.Printf("TCPTransport Closed Connection %+v\n", peer)
+		log.Printf("TCPTransport Closed Connection %s\n", peer.RemoteAddr())
+		if connected && t.OnPeerDisconnect != nil {
+			t.OnPeerDisconnect(peer)
+		}
 	}()
 	// Shake Hands with the peer connecting, (validate the connection)
 	if err := t.ShakeHands(peer); err != nil {
@@ -142,29 +256,37 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 			return
 		}
 	}
+	connected = true
 	// Read loop
 	for {
-		rpc := RPC{From: peer.Conn.RemoteAddr()}
+		rpc := RPC{From: peer.Conn.RemoteAddr(), Identity: peer.identity}
 		if err := t.Decoder.Decode(peer.Conn, &rpc); err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				return
 			}
+			// A malformed frame leaves the connection out of sync,
+			// so there is no way to recover the read loop.
 			log.Printf("TCP read error: %s\n", err)
-			continue
+			return
 		}
-		if rpc.Stream {
-			peer.wg.Add(1)
-			log.Printf(
-				"Incoming stream from [ %s ], waiting till stream is done...",
-				rpc.From.String(),
-			)
-			peer.wg.Wait()
-			log.Printf("Closed stream from [ %s ]. Resuming read loop...",
-				rpc.From.String(),
-			)
-			continue
+		switch rpc.frame {
+		case 0, IncomingMessage:
+			t.rpcch <- rpc
+		case IncomingStream:
+			st, err := peer.acceptStream(rpc.streamID)
+			if err != nil {
+				log.Printf("TCP stream error: %s\n", err)
+				return
+			}
+			rpc.Stream = st
+			t.rpcch <- rpc
+		default:
+			// The other stream frames never wait for the consumer,
+			// so a stream that is not read does not stall the others.
+			if err := peer.handleStreamFrame(rpc.frame, rpc.streamID, rpc.Payload); err != nil {
+				log.Printf("TCP stream error: %s\n", err)
+				return
+			}
 		}
-
-		t.rpcch <- rpc
 	}
 }
@@ -0,0 +1,158 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dfs test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	assert.Nil(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// newTLSTransport returns a transport over TLS, shakeHands
+// run on the connections once the TLS handshake succeeded.
+func newTLSTransport(t *testing.T, cert tls.Certificate, ca *testCA, peers chan Peer, shakeHands ...HandshakeFunc) *TCPTransport {
+	tr := NewTCPTransport(TCPTransportOpts{
+		ListenAddr: "127.0.0.1:0",
+		ShakeHands: ChainHandshakeFuncs(append([]HandshakeFunc{TLSHandshakeFunc(ca.pool)}, shakeHands...)...),
+		Decoder:    DefaultDecoder{},
+		TLSConfig:  NewMutualTLSConfig(cert, ca.pool),
+		OnPeer: func(p Peer) error {
+			peers <- p
+			return nil
+		},
+	})
+	assert.Nil(t, tr.ListenAndAccept())
+	t.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+func TestTLSTransportMutualIdentity(t *testing.T) {
+	ca := newTestCA(t)
+	peers1, peers2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1 := newTLSTransport(t, ca.issue(t, "node1"), ca, peers1)
+	tr2 := newTLSTransport(t, ca.issue(t, "node2"), ca, peers2)
+
+	assert.Nil(t, tr2.Dail(tr1.Addr()))
+
+	select {
+	case p := <-peers1:
+		assert.Equal(t, "node2", p.Identity())
+	case <-time.After(time.Second * 2):
+		t.Fatal("node1 never accepted node2")
+	}
+	select {
+	case p := <-peers2:
+		assert.Equal(t, "node1", p.Identity())
+	case <-time.After(time.Second * 2):
+		t.Fatal("node2 never connected to node1")
+	}
+}
+
+func TestTLSTransportWithSignedHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	signed := func(id string) HandshakeFunc {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		assert.Nil(t, err)
+		return SignedHandshakeFunc(SignedHandshakeOpts{NodeID: id, PrivateKey: key})
+	}
+	peers1, peers2 := make(chan Peer, 1), make(chan Peer, 1)
+	tr1 := newTLSTransport(t, ca.issue(t, "node1"), ca, peers1, signed("node1"))
+	tr2 := newTLSTransport(t, ca.issue(t, "node2"), ca, peers2, signed("node2"))
+
+	assert.Nil(t, tr2.Dail(tr1.Addr()))
+
+	// The signed handshake runs over TLS and names the peer.
+	select {
+	case p := <-peers1:
+		assert.Equal(t, "node2", p.Identity())
+	case <-time.After(time.Second * 2):
+		t.Fatal("node1 never accepted node2")
+	}
+
+	// A failing handshake stops the chain.
+	failed := errors.New("rejected")
+	tr3 := newTLSTransport(t, ca.issue(t, "node3"), ca, make(chan Peer, 1), func(Peer) error { return failed }, signed("node3"))
+	assert.Nil(t, tr3.Dail(tr1.Addr()))
+	select {
+	case p := <-peers1:
+		t.Fatalf("accepted peer (%s) that failed its handshake", p.Identity())
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	// A valid certificate does not let a peer claim another node ID.
+	tr4 := newTLSTransport(t, ca.issue(t, "node4"), ca, make(chan Peer, 1), signed("node5"))
+	assert.Nil(t, tr4.Dail(tr1.Addr()))
+	select {
+	case p := <-peers1:
+		t.Fatalf("accepted peer (%s) with the certificate of another node", p.Identity())
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
+func TestTLSTransportRejectsUnknownCA(t *testing.T) {
+	ca, rogueCA := newTestCA(t), newTestCA(t)
+	peers, roguePeers := make(chan Peer, 1), make(chan Peer, 1)
+	tr := newTLSTransport(t, ca.issue(t, "node1"), ca, peers)
+	rogue := newTLSTransport(t, rogueCA.issue(t, "rogue"), rogueCA, roguePeers)
+
+	assert.Nil(t, rogue.Dail(tr.Addr()))
+
+	select {
+	case p := <-peers:
+		t.Fatalf("accepted peer (%s) signed by an unknown CA", p.Identity())
+	case p := <-roguePeers:
+		t.Fatalf("rogue connected to (%s)", p.Identity())
+	case <-time.After(time.Millisecond * 200):
+	}
+}
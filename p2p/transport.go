@@ -1,12 +1,26 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+)
 
 // Peer is a representation of the remote node
 type Peer interface {
 	net.Conn
+	// Send writes b to the peer as a single message frame.
 	Send([]byte) error
-	CloseStream()
+	// SendStream opens a stream with the header b and sends body over
+	// it. Streams are multiplexed with each other and with messages.
+	SendStream(b []byte, body io.Reader) error
+	// Identity returns the verified identity of the remote
+	// node, or an empty string if it was not verified.
+	Identity() string
+	// ListenAddr returns the address the remote node accepts
+	// connections on, or an empty string if it did not tell.
+	ListenAddr() string
+	// Outbound reports whether the local node dialed the connection.
+	Outbound() bool
 }
 
 // Transport is anything that handles the communication
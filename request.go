@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/muhreeowki/dfs/p2p"
+)
+
+// response is a reply Message routed back to the caller
+// waiting on the request with the same ID.
+type response struct {
+	From string
+	Peer p2p.Peer
+	Msg  *Message
+	// Stream is set when the reply is the header of a stream,
+	// which must be closed once it is read.
+	Stream *p2p.Stream
+}
+
+// request is a pending outbound request waiting for replies.
+type request struct {
+	id     uint64
+	respch chan response
+}
+
+// requestTable routes replies to the requests waiting for them.
+type requestTable struct {
+	lock    sync.Mutex
+	nextID  atomic.Uint64
+	pending map[uint64]*request
+}
+
+func newRequestTable() *requestTable {
+	return &requestTable{
+		pending: make(map[uint64]*request),
+	}
+}
+
+// open registers a new request that can buffer up to n replies.
+func (t *requestTable) open(n int) *request {
+	req := &request{
+		id:     t.nextID.Add(1),
+		respch: make(chan response, n),
+	}
+	t.lock.Lock()
+	t.pending[req.id] = req
+	t.lock.Unlock()
+	return req
+}
+
+// close unregisters the request and discards any
+// replies that were delivered but never read.
+func (t *requestTable) close(req *request) {
+	t.lock.Lock()
+	delete(t.pending, req.id)
+	t.lock.Unlock()
+	for {
+		select {
+		case resp := <-req.respch:
+			discardResponse(resp)
+		default:
+			return
+		}
+	}
+}
+
+// resolve hands the reply to the request waiting for it.
+// Replies nobody is waiting for anymore are discarded.
+func (t *requestTable) resolve(resp response) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if req, ok := t.pending[resp.Msg.ID]; ok {
+		select {
+		case req.respch <- resp:
+			return
+		default:
+		}
+	}
+	log.Printf("dropping reply (%d) from (%s) with no pending request", resp.Msg.ID, resp.From)
+	discardResponse(resp)
+}
+
+// discardResponse closes the stream of a reply nobody reads,
+// which tells the peer to stop sending it.
+func discardResponse(resp response) {
+	if resp.Stream != nil {
+		resp.Stream.Close()
+	}
+}
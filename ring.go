@@ -0,0 +1,113 @@
+package main
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is the number of points each node
+// is given on a HashRing.
+var DefaultVirtualNodes = 64
+
+// HashRing is a consistent hash ring used to decide which
+// nodes own a file. Every node is placed on the ring
+// several times (virtual nodes) to spread the keys evenly.
+type HashRing struct {
+	lock         sync.RWMutex
+	virtualNodes int
+	points       []uint32
+	owners       map[uint32]string
+	nodes        map[string]struct{}
+}
+
+// NewHashRing returns a new HashRing with virtualNodes points per node.
+func NewHashRing(virtualNodes int) *HashRing {
+	if virtualNodes <= 0 {
+		virtualNodes = DefaultVirtualNodes
+	}
+	return &HashRing{
+		virtualNodes: virtualNodes,
+		owners:       make(map[uint32]string),
+		nodes:        make(map[string]struct{}),
+	}
+}
+
+// Add places a node on the ring.
+func (r *HashRing) Add(node string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.nodes[node]; ok {
+		return
+	}
+	r.nodes[node] = struct{}{}
+	for i := range r.virtualNodes {
+		point := ringHash(node + "#" + strconv.Itoa(i))
+		if _, ok := r.owners[point]; ok {
+			continue
+		}
+		r.owners[point] = node
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+}
+
+// Remove takes a node off the ring.
+func (r *HashRing) Remove(node string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.nodes[node]; !ok {
+		return
+	}
+	delete(r.nodes, node)
+	points := r.points[:0]
+	for _, point := range r.points {
+		if r.owners[point] == node {
+			delete(r.owners, point)
+			continue
+		}
+		points = append(points, point)
+	}
+	r.points = points
+}
+
+// Len returns the number of nodes on the ring.
+func (r *HashRing) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.nodes)
+}
+
+// Owners returns up to n distinct nodes that own the key,
+// in the order they are found walking the ring clockwise.
+func (r *HashRing) Owners(key string, n int) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	if n <= 0 {
+		return nil
+	}
+	var (
+		owners = make([]string, 0, n)
+		seen   = make(map[string]struct{}, n)
+		point  = ringHash(key)
+		start  = sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+	)
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		node := r.owners[r.points[(start+i)%len(r.points)]]
+		if _, ok := seen[node]; ok {
+			continue
+		}
+		seen[node] = struct{}{}
+		owners = append(owners, node)
+	}
+	return owners
+}
+
+// ringHash returns the position of a key on the ring.
+func ringHash(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
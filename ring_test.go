@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRingOwners(t *testing.T) {
+	r := NewHashRing(0)
+	assert.Empty(t, r.Owners(hashKey("foo"), 3))
+
+	for i := range 5 {
+		r.Add(fmt.Sprintf("node%d", i))
+	}
+	owners := r.Owners(hashKey("foo"), 3)
+	assert.Len(t, owners, 3)
+	assert.Equal(t, owners, r.Owners(hashKey("foo"), 3))
+	assert.Len(t, r.Owners(hashKey("foo"), 10), 5)
+
+	seen := map[string]bool{}
+	for _, owner := range owners {
+		assert.False(t, seen[owner])
+		seen[owner] = true
+	}
+}
+
+func TestHashRingRemoveOnlyMovesRemovedNode(t *testing.T) {
+	r := NewHashRing(0)
+	for i := range 5 {
+		r.Add(fmt.Sprintf("node%d", i))
+	}
+	before := map[string]string{}
+	for i := range 200 {
+		key := hashKey(fmt.Sprintf("key%d", i))
+		before[key] = r.Owners(key, 1)[0]
+	}
+
+	r.Remove("node2")
+	assert.Equal(t, 4, r.Len())
+	for key, owner := range before {
+		now := r.Owners(key, 1)[0]
+		assert.NotEqual(t, "node2", now)
+		if owner != "node2" {
+			assert.Equal(t, owner, now)
+		}
+	}
+}
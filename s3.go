@@ -0,0 +1,744 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// multipartNamespace is the Store namespace the parts of
+// unfinished multipart uploads are written under.
+const multipartNamespace = "_multipart"
+
+// DefaultS3Region is the region requests are signed for by default.
+var DefaultS3Region = "us-east-1"
+
+// s3Namespace is the XML namespace of S3 responses.
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3TimeFormat is the format of the timestamps in S3 responses.
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+// maxS3Keys is the most keys a listing returns.
+const maxS3Keys = 1000
+
+// s3Error is an S3 error response.
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	errS3AccessDenied                      = &s3Error{"AccessDenied", "Access Denied.", http.StatusForbidden}
+	errS3AuthorizationHeaderMalformed      = &s3Error{"AuthorizationHeaderMalformed", "The authorization header is malformed.", http.StatusBadRequest}
+	errS3AuthorizationQueryParametersError = &s3Error{"AuthorizationQueryParametersError", "The authorization query parameters are malformed.", http.StatusBadRequest}
+	errS3BadDigest                         = &s3Error{"BadDigest", "The Content-MD5 you specified did not match what we received.", http.StatusBadRequest}
+	errS3BucketNotEmpty                    = &s3Error{"BucketNotEmpty", "The bucket you tried to delete is not empty.", http.StatusConflict}
+	errS3ContentSHA256Mismatch             = &s3Error{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed.", http.StatusBadRequest}
+	errS3IncompleteBody                    = &s3Error{"IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.", http.StatusBadRequest}
+	errS3InternalError                     = &s3Error{"InternalError", "We encountered an internal error. Please try again.", http.StatusInternalServerError}
+	errS3InvalidAccessKeyID                = &s3Error{"InvalidAccessKeyId", "The AWS access key ID you provided does not exist in our records.", http.StatusForbidden}
+	errS3InvalidArgument                   = &s3Error{"InvalidArgument", "Invalid argument.", http.StatusBadRequest}
+	errS3InvalidBucketName                 = &s3Error{"InvalidBucketName", "The specified bucket is not valid.", http.StatusBadRequest}
+	errS3InvalidDigest                     = &s3Error{"InvalidDigest", "The Content-MD5 you specified is not valid.", http.StatusBadRequest}
+	errS3InvalidPart                       = &s3Error{"InvalidPart", "One or more of the specified parts could not be found.", http.StatusBadRequest}
+	errS3InvalidPartOrder                  = &s3Error{"InvalidPartOrder", "The list of parts was not in ascending order.", http.StatusBadRequest}
+	errS3InvalidRequest                    = &s3Error{"InvalidRequest", "Invalid request.", http.StatusBadRequest}
+	errS3MalformedXML                      = &s3Error{"MalformedXML", "The XML you provided was not well-formed.", http.StatusBadRequest}
+	errS3MethodNotAllowed                  = &s3Error{"MethodNotAllowed", "The specified method is not allowed against this resource.", http.StatusMethodNotAllowed}
+	errS3NoSuchKey                         = &s3Error{"NoSuchKey", "The specified key does not exist.", http.StatusNotFound}
+	errS3NoSuchUpload                      = &s3Error{"NoSuchUpload", "The specified multipart upload does not exist.", http.StatusNotFound}
+	errS3NotImplemented                    = &s3Error{"NotImplemented", "A header or query you provided implies functionality that is not implemented.", http.StatusNotImplemented}
+	errS3ServiceUnavailable                = &s3Error{"ServiceUnavailable", "Not enough replicas confirmed the request.", http.StatusServiceUnavailable}
+	errS3RequestTimeTooSkewed              = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large.", http.StatusForbidden}
+	errS3SignatureDoesNotMatch             = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided.", http.StatusForbidden}
+	errS3SignatureVersion                  = &s3Error{"InvalidRequest", "Please use AWS4-HMAC-SHA256.", http.StatusBadRequest}
+)
+
+// s3Errorf returns a copy of err with a more specific message.
+func s3Errorf(err *s3Error, format string, args ...any) *s3Error {
+	return &s3Error{Code: err.Code, Message: fmt.Sprintf(format, args...), Status: err.Status}
+}
+
+// S3GatewayOpts is an options struct for the S3Gateway.
+type S3GatewayOpts struct {
+	// Region is the region requests must be signed for.
+	Region string
+	// Credentials maps access key IDs to their secret keys.
+	Credentials map[string]string
+}
+
+// S3Gateway serves a subset of the S3 REST API with path style
+// addressing on top of a FileServer. A bucket is a key prefix, the
+// object "key" of bucket "photos" is the file "photos/key".
+//
+// Supported are ListBuckets, CreateBucket, HeadBucket, DeleteBucket,
+// ListObjectsV2, PutObject, GetObject, HeadObject, DeleteObject and
+// multipart uploads. Every request must be signed with SigV4.
+// Unfinished multipart uploads do not survive a restart.
+type S3Gateway struct {
+	S3GatewayOpts
+	server *FileServer
+
+	lock    sync.Mutex
+	buckets map[string]time.Time
+	uploads map[string]*multipartUpload
+}
+
+// multipartUpload is an unfinished multipart upload.
+type multipartUpload struct {
+	Bucket string
+	Key    string
+	Parts  map[int]uploadPart
+}
+
+type uploadPart struct {
+	ETag string
+	Size int64
+}
+
+// NewS3Gateway returns an S3Gateway serving the files of s.
+// It removes the parts of the uploads a previous gateway left unfinished.
+func NewS3Gateway(s *FileServer, opts S3GatewayOpts) *S3Gateway {
+	if len(opts.Region) == 0 {
+		opts.Region = DefaultS3Region
+	}
+	if err := s.store.DeleteNamespace(multipartNamespace); err != nil {
+		log.Printf("(%s): failed to remove unfinished uploads: %s", s.StorageFolder, err)
+	}
+	return &S3Gateway{
+		S3GatewayOpts: opts,
+		server:        s,
+		buckets:       make(map[string]time.Time),
+		uploads:       make(map[string]*multipartUpload),
+	}
+}
+
+// s3Subresources are the query parameters selecting
+// features of buckets and objects that are not supported.
+var s3Subresources = []string{
+	"accelerate", "acl", "analytics", "attributes", "cors", "delete", "encryption",
+	"intelligent-tiering", "inventory", "legal-hold", "lifecycle", "location",
+	"logging", "metrics", "notification", "object-lock", "ownershipControls",
+	"policy", "publicAccessBlock", "replication", "requestPayment", "restore",
+	"retention", "select", "tagging", "torrent", "versioning", "versions", "website",
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (g *S3Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := g.authenticate(r)
+	if err != nil {
+		g.writeError(w, r, err)
+		return
+	}
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{body, r.Body}
+
+	q := r.URL.Query()
+	for _, name := range s3Subresources {
+		if q.Has(name) {
+			g.writeError(w, r, errS3NotImplemented)
+			return
+		}
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(bucket) > 0 && !validBucketName(bucket) {
+		g.writeError(w, r, errS3InvalidBucketName)
+		return
+	}
+	switch {
+	case len(bucket) == 0:
+		if r.Method != http.MethodGet {
+			err = errS3MethodNotAllowed
+			break
+		}
+		err = g.listBuckets(w)
+	case len(key) == 0:
+		switch r.Method {
+		case http.MethodPut:
+			err = g.createBucket(w, bucket)
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodDelete:
+			err = g.deleteBucket(w, bucket)
+		case http.MethodGet:
+			if q.Get("list-type") != "2" {
+				err = errS3NotImplemented
+				break
+			}
+			err = g.listObjects(w, r, bucket)
+		default:
+			err = errS3MethodNotAllowed
+		}
+	default:
+		switch r.Method {
+		case http.MethodPut:
+			switch {
+			case q.Has("uploadId"):
+				err = g.uploadPart(w, r, bucket, key)
+			case len(r.Header.Get("X-Amz-Copy-Source")) > 0:
+				err = errS3NotImplemented
+			default:
+				err = g.putObject(w, r, bucket, key)
+			}
+		case http.MethodGet:
+			err = g.getObject(w, r, bucket, key)
+		case http.MethodHead:
+			err = g.headObject(w, bucket, key)
+		case http.MethodDelete:
+			if q.Has("uploadId") {
+				err = g.abortUpload(w, r, bucket, key)
+				break
+			}
+			err = g.deleteObject(w, bucket, key)
+		case http.MethodPost:
+			switch {
+			case q.Has("uploads"):
+				err = g.createUpload(w, bucket, key)
+			case q.Has("uploadId"):
+				err = g.completeUpload(w, r, bucket, key)
+			default:
+				err = errS3NotImplemented
+			}
+		default:
+			err = errS3MethodNotAllowed
+		}
+	}
+	if err != nil {
+		g.writeError(w, r, err)
+	}
+}
+
+// authenticate verifies the signature of r and returns its body,
+// which fails when read if it does not match its signed hash.
+func (g *S3Gateway) authenticate(r *http.Request) (io.Reader, error) {
+	auth, err := parseSigV4(r)
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := g.Credentials[auth.AccessKey]
+	if !ok {
+		return nil, errS3InvalidAccessKeyID
+	}
+	if auth.Region != g.Region || auth.Service != "s3" {
+		return nil, s3Errorf(errS3AuthorizationHeaderMalformed, "the credential scope must be %s/s3", g.Region)
+	}
+	now := time.Now()
+	if auth.Presigned {
+		if now.After(auth.Time.Add(auth.Expires)) {
+			return nil, s3Errorf(errS3AccessDenied, "Request has expired")
+		}
+	} else if d := now.Sub(auth.Time); d > sigV4MaxSkew || d < -sigV4MaxSkew {
+		return nil, errS3RequestTimeTooSkewed
+	}
+	signsHost := false
+	for _, name := range auth.SignedHeaders {
+		signsHost = signsHost || name == "host"
+	}
+	if !signsHost {
+		return nil, s3Errorf(errS3AuthorizationHeaderMalformed, "the host header must be signed")
+	}
+
+	signingKey := sigV4SigningKey(secret, auth.Date, auth.Region, auth.Service)
+	canonicalRequest := sigV4CanonicalRequest(r, auth.SignedHeaders, auth.PayloadHash)
+	signature := sigV4Sign(signingKey, sigV4StringToSign(auth.Time, auth.scope(), canonicalRequest))
+	if !hmac.Equal([]byte(signature), []byte(auth.Signature)) {
+		return nil, errS3SignatureDoesNotMatch
+	}
+
+	var body io.Reader = r.Body
+	switch auth.PayloadHash {
+	case unsignedPayload:
+	case streamingPayload:
+		size := int64(-1)
+		if v := r.Header.Get("X-Amz-Decoded-Content-Length"); len(v) > 0 {
+			if size, err = strconv.ParseInt(v, 10, 64); err != nil {
+				return nil, s3Errorf(errS3InvalidArgument, "invalid x-amz-decoded-content-length")
+			}
+		}
+		body = newChunkedPayloadReader(body, auth, signingKey, size)
+	default:
+		sum, err := hex.DecodeString(auth.PayloadHash)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, s3Errorf(errS3InvalidArgument, "invalid x-amz-content-sha256")
+		}
+		body = newHashCheckReader(body, sha256.New(), sum, errS3ContentSHA256Mismatch)
+	}
+	if v := r.Header.Get("Content-Md5"); len(v) > 0 {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			return nil, errS3InvalidDigest
+		}
+		body = newHashCheckReader(body, md5.New(), sum, errS3BadDigest)
+	}
+	return body, nil
+}
+
+// writeError writes err as an S3 error response.
+func (g *S3Gateway) writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3err *s3Error
+	switch {
+	case errors.As(err, &s3err):
+	case errors.Is(err, ErrFileNotFound):
+		s3err = errS3NoSuchKey
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		s3err = errS3IncompleteBody
+	case errors.Is(err, ErrNotEnoughReplicas):
+		s3err = s3Errorf(errS3ServiceUnavailable, "%s", err)
+	default:
+		log.Printf("(%s): s3 %s %s failed: %s", g.server.StorageFolder, r.Method, r.URL.Path, err)
+		s3err = errS3InternalError
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3err.Status)
+		return
+	}
+	writeXML(w, s3err.Status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: s3err.Code, Message: s3err.Message, Resource: r.URL.Path})
+}
+
+// writeXML writes v as an XML response.
+func writeXML(w http.ResponseWriter, status int, v any) {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(b)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(b)
+}
+
+var bucketNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]{1,61}[a-z0-9]$`)
+
+func validBucketName(name string) bool {
+	return bucketNameRegexp.MatchString(name)
+}
+
+// objects returns the metadata of the objects stored through this node
+// in bucket whose key starts with prefix, sorted by key.
+func (g *S3Gateway) objects(bucket, prefix string) []FileMeta {
+	metas := []FileMeta{}
+	for _, meta := range g.server.List(bucket + "/" + prefix) {
+		if meta.Owner == g.server.ID {
+			metas = append(metas, meta)
+		}
+	}
+	return metas
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+func (g *S3Gateway) listBuckets(w http.ResponseWriter) error {
+	created := make(map[string]time.Time)
+	for _, meta := range g.server.List("") {
+		bucket, _, ok := strings.Cut(meta.Key, "/")
+		if !ok || meta.Owner != g.server.ID || !validBucketName(bucket) {
+			continue
+		}
+		if t, ok := created[bucket]; !ok || meta.Created.Before(t) {
+			created[bucket] = meta.Created
+		}
+	}
+	g.lock.Lock()
+	for bucket, t := range g.buckets {
+		if c, ok := created[bucket]; !ok || t.Before(c) {
+			created[bucket] = t
+		}
+	}
+	g.lock.Unlock()
+
+	buckets := []s3Bucket{}
+	for name, t := range created {
+		buckets = append(buckets, s3Bucket{Name: name, CreationDate: t.UTC().Format(s3TimeFormat)})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Buckets: buckets})
+	return nil
+}
+
+// createBucket remembers an empty bucket until the gateway stops,
+// buckets that hold objects exist as long as their objects.
+func (g *S3Gateway) createBucket(w http.ResponseWriter, bucket string) error {
+	g.lock.Lock()
+	if _, ok := g.buckets[bucket]; !ok {
+		g.buckets[bucket] = time.Now()
+	}
+	g.lock.Unlock()
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *S3Gateway) deleteBucket(w http.ResponseWriter, bucket string) error {
+	if len(g.objects(bucket, "")) > 0 {
+		return errS3BucketNotEmpty
+	}
+	g.lock.Lock()
+	delete(g.buckets, bucket)
+	g.lock.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+// listObjects implements ListObjectsV2. The continuation token is
+// the last key or common prefix returned, base64 encoded.
+func (g *S3Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	q := r.URL.Query()
+	result := listBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              bucket,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		EncodingType:      q.Get("encoding-type"),
+		MaxKeys:           maxS3Keys,
+	}
+	if v := q.Get("max-keys"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3Errorf(errS3InvalidArgument, "invalid max-keys")
+		}
+		result.MaxKeys = min(n, maxS3Keys)
+	}
+	if len(result.EncodingType) > 0 && result.EncodingType != "url" {
+		return s3Errorf(errS3InvalidArgument, "invalid encoding-type")
+	}
+	after, continued := result.StartAfter, false
+	if len(result.ContinuationToken) > 0 {
+		b, err := base64.StdEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return s3Errorf(errS3InvalidArgument, "invalid continuation-token")
+		}
+		after, continued = string(b), true
+	}
+
+	encode := func(s string) string {
+		if result.EncodingType == "url" {
+			return awsURIEncode(s, false)
+		}
+		return s
+	}
+	last := ""
+	for _, meta := range g.objects(bucket, result.Prefix) {
+		key := strings.TrimPrefix(meta.Key, bucket+"/")
+		if key <= after {
+			continue
+		}
+		if continued && len(result.Delimiter) > 0 && strings.HasSuffix(after, result.Delimiter) && strings.HasPrefix(key, after) {
+			// The common prefix was returned by the previous page.
+			continue
+		}
+		entry := key
+		if len(result.Delimiter) > 0 {
+			if i := strings.Index(key[len(result.Prefix):], result.Delimiter); i >= 0 {
+				entry = key[:len(result.Prefix)+i+len(result.Delimiter)]
+			}
+		}
+		if entry == last {
+			continue
+		}
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if entry != key {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(entry)})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(key),
+				LastModified: meta.Created.UTC().Format(s3TimeFormat),
+				ETag:         etag(meta),
+				Size:         meta.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		result.KeyCount++
+		last = entry
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+	}
+	result.Prefix = encode(result.Prefix)
+	result.Delimiter = encode(result.Delimiter)
+	result.StartAfter = encode(result.StartAfter)
+	writeXML(w, http.StatusOK, result)
+	return nil
+}
+
+func (g *S3Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	fileKey := bucket + "/" + key
+	if err := g.server.Store(fileKey, r.Body, ConsistencyDefault); err != nil {
+		return err
+	}
+	meta, err := g.server.Stat(fileKey)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag(meta))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *S3Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	fileKey := bucket + "/" + key
+	f, err := g.server.Get(fileKey, ConsistencyDefault)
+	if err != nil {
+		return err
+	}
+	if rc, ok := f.(io.Closer); ok {
+		defer rc.Close()
+	}
+	meta, err := g.server.Stat(fileKey)
+	serveFile(w, r, key, f, meta, err == nil)
+	return nil
+}
+
+func (g *S3Gateway) headObject(w http.ResponseWriter, bucket, key string) error {
+	meta, err := g.server.Stat(bucket + "/" + key)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag(meta))
+	w.Header().Set("Content-Length", strconv.FormatInt(meta.Size, 10))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Last-Modified", meta.Created.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// deleteObject succeeds for missing objects, like S3 does.
+func (g *S3Gateway) deleteObject(w http.ResponseWriter, bucket, key string) error {
+	if err := g.server.Delete(bucket + "/" + key); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *S3Gateway) createUpload(w http.ResponseWriter, bucket, key string) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(b)
+	g.lock.Lock()
+	g.uploads[id] = &multipartUpload{Bucket: bucket, Key: key, Parts: make(map[int]uploadPart)}
+	g.lock.Unlock()
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: id})
+	return nil
+}
+
+// upload returns the upload of the request, which must be for bucket and key.
+func (g *S3Gateway) upload(r *http.Request, bucket, key string) (string, *multipartUpload, error) {
+	id := r.URL.Query().Get("uploadId")
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	upload, ok := g.uploads[id]
+	if !ok || upload.Bucket != bucket || upload.Key != key {
+		return "", nil, errS3NoSuchUpload
+	}
+	return id, upload, nil
+}
+
+// partKey returns the key a part of an upload is written under.
+func partKey(uploadID string, part int) string {
+	return fmt.Sprintf("%s/%d", uploadID, part)
+}
+
+func (g *S3Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	id, upload, err := g.upload(r, bucket, key)
+	if err != nil {
+		return err
+	}
+	part, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || part < 1 || part > 10000 {
+		return s3Errorf(errS3InvalidArgument, "part number must be an integer between 1 and 10000")
+	}
+	n, err := g.server.store.Write(multipartNamespace, partKey(id, part), r.Body)
+	if err != nil {
+		return err
+	}
+	sum, err := g.server.store.Checksum(multipartNamespace, partKey(id, part))
+	if err != nil {
+		return err
+	}
+	tag := `"` + sum + `"`
+	g.lock.Lock()
+	upload.Parts[part] = uploadPart{ETag: tag, Size: n}
+	g.lock.Unlock()
+	w.Header().Set("ETag", tag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (g *S3Gateway) completeUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	id, upload, err := g.upload(r, bucket, key)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil || len(req.Parts) == 0 {
+		return errS3MalformedXML
+	}
+	parts := []int{}
+	g.lock.Lock()
+	for i, p := range req.Parts {
+		uploaded, ok := upload.Parts[p.PartNumber]
+		if !ok || strings.Trim(uploaded.ETag, `"`) != strings.Trim(p.ETag, `"`) {
+			g.lock.Unlock()
+			return errS3InvalidPart
+		}
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			g.lock.Unlock()
+			return errS3InvalidPartOrder
+		}
+		parts = append(parts, p.PartNumber)
+	}
+	g.lock.Unlock()
+
+	// The parts are streamed one after another into the object.
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range parts {
+			_, f, err := g.server.store.Read(multipartNamespace, partKey(id, part))
+			if err == nil {
+				_, err = io.Copy(pw, f)
+				if rc, ok := f.(io.Closer); ok {
+					rc.Close()
+				}
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		pw.Close()
+	}()
+	fileKey := bucket + "/" + key
+	err = g.server.Store(fileKey, pr, ConsistencyDefault)
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	meta, err := g.server.Stat(fileKey)
+	if err != nil {
+		return err
+	}
+	g.removeUpload(id)
+
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Xmlns: s3Namespace, Location: "/" + fileKey, Bucket: bucket, Key: key, ETag: etag(meta)})
+	return nil
+}
+
+func (g *S3Gateway) abortUpload(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	id, _, err := g.upload(r, bucket, key)
+	if err != nil {
+		return err
+	}
+	g.removeUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// removeUpload forgets an upload and deletes its parts.
+func (g *S3Gateway) removeUpload(id string) {
+	g.lock.Lock()
+	upload, ok := g.uploads[id]
+	delete(g.uploads, id)
+	g.lock.Unlock()
+	if !ok {
+		return
+	}
+	for part := range upload.Parts {
+		if err := g.server.store.Delete(multipartNamespace, partKey(id, part)); err != nil {
+			log.Printf("(%s): failed to delete part (%d) of upload (%s): %s", g.server.StorageFolder, part, id, err)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// errScrubStopped stops a scrub pass when the FileServer stops.
+var errScrubStopped = errors.New("scrubber stopped")
+
+// ScrubStats counts the objects checked by the background scrubber.
+type ScrubStats struct {
+	Scanned  int64
+	Corrupt  int64
+	Repaired int64
+}
+
+type scrubStats struct {
+	scanned  atomic.Int64
+	corrupt  atomic.Int64
+	repaired atomic.Int64
+}
+
+// ScrubStats returns the counters of the background scrubber.
+func (s *FileServer) ScrubStats() ScrubStats {
+	return ScrubStats{
+		Scanned:  s.scrubStats.scanned.Load(),
+		Corrupt:  s.scrubStats.corrupt.Load(),
+		Repaired: s.scrubStats.repaired.Load(),
+	}
+}
+
+// scrubLoop keeps walking the storage folder, checking one
+// object every ScrubInterval, until the FileServer stops.
+func (s *FileServer) scrubLoop() {
+	for {
+		if err := s.scrub(); err != nil {
+			if errors.Is(err, errScrubStopped) {
+				return
+			}
+			log.Printf("(%s): scrub failed: %s", s.StorageFolder, err)
+		}
+		select {
+		case <-time.After(s.ScrubInterval):
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// scrub checks every object in the store against its checksum once,
+// and re-fetches the objects that are corrupt from a healthy replica.
+func (s *FileServer) scrub() error {
+	return s.store.WalkChecksums(func(id, key string) error {
+		select {
+		case <-time.After(s.ScrubInterval):
+		case <-s.quitch:
+			return errScrubStopped
+		}
+		s.scrubObject(id, key)
+		return nil
+	})
+}
+
+// scrubObject checks a single object and repairs it if it is corrupt.
+func (s *FileServer) scrubObject(id, key string) {
+	s.scrubStats.scanned.Add(1)
+	err := s.store.Verify(id, key)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		if err != nil && !errors.Is(err, ErrNoChecksum) && !os.IsNotExist(err) {
+			log.Printf("(%s): failed to verify (%s/%s): %s", s.StorageFolder, id, key, err)
+		}
+		return
+	}
+	// The object may have been replaced while it was read,
+	// only flag it if the new contents are corrupt too.
+	if err := s.store.Verify(id, key); !errors.Is(err, ErrChecksumMismatch) {
+		return
+	}
+
+	s.scrubStats.corrupt.Add(1)
+	log.Printf("(%s): object (%s/%s) is corrupt, fetching it from a replica", s.StorageFolder, id, key)
+	if err := s.repair(id, key); err != nil {
+		log.Printf("(%s): failed to repair (%s/%s): %s", s.StorageFolder, id, key, err)
+		return
+	}
+	s.scrubStats.repaired.Add(1)
+	log.Printf("(%s): repaired object (%s/%s)", s.StorageFolder, id, key)
+}
+
+// repair replaces a corrupt chunk with a healthy copy from a peer.
+func (s *FileServer) repair(id, key string) error {
+	owner, ok := strings.CutSuffix(id, chunkSuffix)
+	if !ok {
+		return fmt.Errorf("(%s) objects are only stored locally", id)
+	}
+
+	// A chunk of a file stored by this node, fetch the
+	// encrypted replica and decrypt it like Get does.
+	if owner == s.ID {
+		size, ok := s.catalog.ChunkSize(owner, key)
+		if !ok {
+			return fmt.Errorf("no file references chunk (%s)", key)
+		}
+		return s.fetchChunk(ChunkRef{Hash: key, Size: size})
+	}
+
+	// A replica of a chunk stored by another node, copy it as is from
+	// another replica. It can not be decrypted, so it is checked against
+	// the checksum recorded for the corrupt copy before it replaces it.
+	want, err := s.store.checksum(id, key)
+	if err != nil {
+		return err
+	}
+	maxSize, err := s.replicaSize(id, owner, key)
+	if err != nil {
+		return err
+	}
+	msg := &Message{
+		Payload: GetChunkInstruction{ServerID: owner, Hash: key},
+	}
+	return s.fetchFile(msg, key, func(r io.Reader, payload GetFileResponse) (int64, error) {
+		if r == nil || payload.Size > maxSize {
+			return 0, fmt.Errorf("unexpected reply for chunk (%s)", key)
+		}
+		return s.store.Write(id, key, newVerifyingReader(io.NopCloser(r), want))
+	})
+}
+
+// replicaSize returns the largest size of a replica of the chunk or shard
+// key of owner. It is the size of the chunk sealed, when a manifest on
+// this node records it, else the size of the copy on disk.
+func (s *FileServer) replicaSize(id, owner, key string) (int64, error) {
+	hash, _, shard := parseShardKey(key)
+	if !shard {
+		hash = key
+	}
+	if size, ok := s.catalog.ChunkSize(owner, hash); ok && (!shard || s.erasure != nil) {
+		if shard {
+			size = s.shardSize(size)
+		}
+		return sealedSize(size), nil
+	}
+	size, r, err := s.store.Read(id, key)
+	if err != nil {
+		return 0, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		rc.Close()
+	}
+	return size, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+func corruptObject(t *testing.T, s *FileServer, id, key string) {
+	path := s.store.TransFormPath(id, key).AbsPath()
+	b, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	b[len(b)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, b, 0644))
+}
+
+func TestScrubRepairsCorruptObjects(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	s3 := newTestServer(t, network, s1.Transport.Addr(), s2.Transport.Addr())
+	waitForPeers(t, s1, 2)
+	waitForPeers(t, s2, 2)
+	waitForPeers(t, s3, 2)
+
+	data := []byte("bits rot on disks")
+	assert.Nil(t, s3.Store("file.txt", bytes.NewReader(data), ConsistencyOne))
+	meta, err := s3.Stat("file.txt")
+	assert.Nil(t, err)
+	assert.Len(t, meta.Chunks, 1)
+	hash := meta.Chunks[0].Hash
+	assert.Eventually(t, func() bool {
+		return hasManifest(s1, s3.ID, "file.txt") && hasChunks(s1, meta) &&
+			hasManifest(s2, s3.ID, "file.txt") && hasChunks(s2, meta)
+	}, time.Second, time.Millisecond*5)
+
+	// A corrupt replica of a chunk is copied from another replica.
+	corruptObject(t, s1, chunkNamespace(s3.ID), hash)
+	assert.Nil(t, s1.scrub())
+	assert.Equal(t, ScrubStats{Scanned: 2, Corrupt: 1, Repaired: 1}, s1.ScrubStats())
+	assert.Nil(t, s1.store.Verify(chunkNamespace(s3.ID), hash))
+
+	// A corrupt local chunk is fetched and decrypted from a replica.
+	corruptObject(t, s3, chunkNamespace(s3.ID), hash)
+	assert.Nil(t, s3.scrub())
+	assert.EqualValues(t, 1, s3.ScrubStats().Repaired)
+	r, err := s3.Get("file.txt", ConsistencyOne)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestScrubRejectsBadReplicas(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	s3 := newTestServer(t, network, s1.Transport.Addr(), s2.Transport.Addr())
+	waitForPeers(t, s1, 2)
+	waitForPeers(t, s2, 2)
+	waitForPeers(t, s3, 2)
+
+	assert.Nil(t, s3.Store("file.txt", bytes.NewReader([]byte("bits rot on disks")), ConsistencyOne))
+	meta, err := s3.Stat("file.txt")
+	assert.Nil(t, err)
+	hash := meta.Chunks[0].Hash
+	assert.Eventually(t, func() bool {
+		return hasChunks(s1, meta) && hasChunks(s2, meta)
+	}, time.Second, time.Millisecond*5)
+
+	// s2 serves another object under the key of the chunk, with a
+	// checksum of its own, it must not replace the corrupt copy of s1.
+	_, err = s2.store.Write(chunkNamespace(s3.ID), hash, bytes.NewReader([]byte("not the replica")))
+	assert.Nil(t, err)
+	corruptObject(t, s1, chunkNamespace(s3.ID), hash)
+	assert.Nil(t, s1.scrub())
+	assert.Equal(t, ScrubStats{Scanned: 2, Corrupt: 1}, s1.ScrubStats())
+	assert.ErrorIs(t, s1.store.Verify(chunkNamespace(s3.ID), hash), ErrChecksumMismatch)
+}
@@ -2,11 +2,14 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"crypto/sha256"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"sync"
 	"time"
 
@@ -16,15 +19,19 @@ import (
 // Message is the primary struct for communication over
 // the network with other FileServer nodes.
 type Message struct {
+	// ID correlates a request with its replies.
+	// Replies carry the ID of the request they answer.
+	ID      uint64
 	Payload any
 }
 
 // StoreFileInstruction is a Message Payload instuction to store
-// a file in disk that is recieved from the rpcch channel.
+// the manifest of a file that is recieved from the rpcch channel.
+// The chunks of the file are streamed separately.
 type StoreFileInstruction struct {
 	ServerID string
 	FileKey  string
-	Size     int64
+	Meta     FileMeta
 }
 
 // GetFileInstruction is a Message Payload instuction to get
@@ -41,14 +48,97 @@ type DeleteFileInstruction struct {
 	FileKey  string
 }
 
+// GetFileResponse is a Message Payload reply to a GetFileInstruction,
+// carrying the manifest of the file in Meta, or to a GetChunkInstruction.
+// When it answers a GetChunkInstruction and Found is true, the reply is
+// sent as a stream header and Size bytes of the chunk follow it.
+type GetFileResponse struct {
+	Found bool
+	Size  int64
+	Err   string
+	Meta  FileMeta
+}
+
+// DefaultReplicationFactor is the number of peers
+// a file is replicated to when storing it.
+var DefaultReplicationFactor = 3
+
+// DefaultRequestTimeout is how long a FileServer waits for
+// peers to reply to a request.
+var DefaultRequestTimeout = time.Second * 5
+
+// Default redial timings, see FileServerOpts.
+var (
+	DefaultRedialInterval    = time.Millisecond * 500
+	DefaultMaxRedialInterval = time.Second * 30
+)
+
+var (
+	// ErrFileNotFound is returned when no node holds the requested file.
+	ErrFileNotFound = errors.New("file not found")
+	// ErrRequestTimeout is returned when peers did not reply in time.
+	ErrRequestTimeout = errors.New("request timed out")
+)
+
 // FileServerOpts is an options struct for FileServer.
 type FileServerOpts struct {
-	ID                string
-	Encryptionkey     []byte
+	ID string
+	// Encryptionkey only decrypts the objects sent to peers
+	// before they were sealed with keys of the Keyring.
+	Encryptionkey []byte
+	// MigrateCTR also decrypts the objects peers hold in the legacy AES-CTR
+	// format with Encryptionkey. That format is not authenticated, so it
+	// is only meant to be set while reading those objects back to migrate
+	// them, tampered objects are then decrypted to garbage.
+	MigrateCTR bool
+	// Keyring holds the key-encryption keys wrapping the data key of
+	// every object sent to peers. A new in-memory keyring is used when
+	// it is nil, so the objects can not be read after a restart.
+	Keyring           *Keyring
 	Transport         p2p.Transport
 	StorageFolder     string
 	PathTransformFunc PathTransformFunc
 	BootstrapNodes    []string
+	RequestTimeout    time.Duration
+	// ReplicationFactor is the number of peers, besides the local
+	// disk, each file is streamed to.
+	ReplicationFactor int
+	// VirtualNodes is the number of points each peer is
+	// given on the consistent hash ring.
+	VirtualNodes int
+	// ProbeInterval is the time between two membership probes.
+	ProbeInterval time.Duration
+	// SuspicionTimeout is how long a peer that failed a probe
+	// is suspected before it is removed.
+	SuspicionTimeout time.Duration
+	// ScrubInterval is the pause between two objects checked by the
+	// background scrubber, the scrubber is disabled when it is zero.
+	ScrubInterval time.Duration
+	// VerifyReads checks files against their checksum when they are read.
+	VerifyReads bool
+	// AverageChunkSize is the average size of the chunks files are split into.
+	AverageChunkSize int
+	// DataShards and ParityShards configure erasure coding. When both are
+	// set, chunks are streamed to peers as DataShards+ParityShards shards,
+	// any DataShards of which rebuild them, instead of being replicated.
+	// Every shard goes to a different peer, stores fail with fewer peers.
+	// The node drops its local copy of a chunk once every shard of it is
+	// acknowledged, so a 4+2 code stores 1.5 times the data, and Get
+	// rebuilds the chunks from their shards as they are read.
+	DataShards   int
+	ParityShards int
+	// KeepLocalChunks keeps the erasure coded chunks on the local disk
+	// too, which serves them without the network but stores 2.5 times
+	// the data with a 4+2 code.
+	KeepLocalChunks bool
+	// WriteConsistency and ReadConsistency are the levels Store
+	// and Get use when they are given ConsistencyDefault.
+	WriteConsistency Consistency
+	ReadConsistency  Consistency
+	// RedialInterval is the wait before redialing a peer after the first
+	// failed attempt, it doubles with every attempt up to MaxRedialInterval.
+	RedialInterval    time.Duration
+	MaxRedialInterval time.Duration
 }
 
 // FileServer is a server that performs file actions on a Store.
@@ -57,9 +147,25 @@ type FileServer struct {
 
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
-
-	store  *Store
-	quitch chan struct{}
+	ring     *HashRing
+	// redialing are the addresses a redial loop is running for.
+	redialing map[string]bool
+
+	store      *Store
+	catalog    *Catalog
+	requests   *requestTable
+	membership *Membership
+	erasure    *ReedSolomon
+	scrubStats scrubStats
+	quitch     chan struct{}
+	// handlers are the handlers running on their own goroutine.
+	handlers sync.WaitGroup
+
+	// chunkLock keeps chunks from being released while
+	// files that will reference them are being stored.
+	chunkLock sync.RWMutex
+	// keyLock serializes key rotations and retirements.
+	keyLock sync.Mutex
 }
 
 // NewFileServer returns a new FileServer struct.
@@ -68,115 +174,331 @@ func NewFileServer(opts FileServerOpts) *FileServer {
 	gob.Register(StoreFileInstruction{})
 	gob.Register(GetFileInstruction{})
 	gob.Register(DeleteFileInstruction{})
+	gob.Register(GetFileResponse{})
+	gob.Register(StoreChunkInstruction{})
+	gob.Register(GetChunkInstruction{})
+	gob.Register(DeleteChunksInstruction{})
+	gob.Register(StoreAck{})
+	gob.Register(PingMessage{})
+	gob.Register(PingReqMessage{})
+	gob.Register(AckMessage{})
+	gob.Register(GetKeyHeadersInstruction{})
+	gob.Register(KeyHeadersResponse{})
+	gob.Register(RewrapKeysInstruction{})
 	if len(opts.ID) == 0 {
 		opts.ID = generateID()
 	}
-	return &FileServer{
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = DefaultRequestTimeout
+	}
+	if opts.ReplicationFactor == 0 {
+		opts.ReplicationFactor = DefaultReplicationFactor
+	}
+	opts.WriteConsistency = opts.WriteConsistency.or(ConsistencyOne)
+	opts.ReadConsistency = opts.ReadConsistency.or(ConsistencyOne)
+	if opts.AverageChunkSize == 0 {
+		opts.AverageChunkSize = DefaultAverageChunkSize
+	}
+	if opts.RedialInterval == 0 {
+		opts.RedialInterval = DefaultRedialInterval
+	}
+	if opts.MaxRedialInterval == 0 {
+		opts.MaxRedialInterval = DefaultMaxRedialInterval
+	}
+	if opts.Keyring == nil {
+		opts.Keyring = NewKeyring()
+	}
+	store := NewStore(StoreOpts{
+		StorageFolder:     opts.StorageFolder,
+		PathTransformFunc: opts.PathTransformFunc,
+		VerifyReads:       opts.VerifyReads,
+	})
+	if n, err := store.RemoveTempFiles(); err != nil {
+		log.Printf("(%s): failed to remove temporary files: %s", opts.StorageFolder, err)
+	} else if n > 0 {
+		log.Printf("(%s): removed (%d) temporary files of unfinished writes", opts.StorageFolder, n)
+	}
+	catalog, err := NewCatalog(store)
+	if err != nil {
+		log.Printf("(%s): failed to load catalog: %s", opts.StorageFolder, err)
+	}
+	s := &FileServer{
 		FileServerOpts: opts,
-		store: NewStore(StoreOpts{
-			StorageFolder:     opts.StorageFolder,
-			PathTransformFunc: opts.PathTransformFunc,
-		}),
-		quitch:   make(chan struct{}),
-		peers:    make(map[string]p2p.Peer),
-		peerLock: sync.Mutex{},
+		store:          store,
+		catalog:        catalog,
+		requests:       newRequestTable(),
+		quitch:         make(chan struct{}),
+		peers:          make(map[string]p2p.Peer),
+		redialing:      make(map[string]bool),
+		ring:           NewHashRing(opts.VirtualNodes),
+		peerLock:       sync.Mutex{},
+	}
+	if opts.DataShards > 0 || opts.ParityShards > 0 {
+		if s.erasure, err = NewReedSolomon(opts.DataShards, opts.ParityShards); err != nil {
+			log.Printf("(%s): erasure coding disabled, falling back to replication: %s", opts.StorageFolder, err)
+		}
 	}
+	s.membership = NewMembership(MembershipOpts{
+		ID:               opts.ID,
+		ProbeInterval:    opts.ProbeInterval,
+		SuspicionTimeout: opts.SuspicionTimeout,
+		Send:             s.sendPayload,
+		Dial:             s.dialMember,
+		OnDead:           s.removePeer,
+	})
+	return s
 }
 
-// Get retrieves a file that is on the local disk.
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.store.Has(s.ID, key) {
-		log.Printf("(%s): serving file (%s) from local disk", s.StorageFolder, key)
-		_, r, err := s.store.Read(s.ID, key)
-		return r, err
+// Get retrieves a file stored by this node. The chunks of the file
+// that are missing on the local disk are fetched from the network.
+// Erasure coded chunks are rebuilt from their shards as they are read,
+// unless the node keeps its local chunks.
+// Above ConsistencyOne, the manifest of the file must be confirmed
+// by as many of its replicas as level requires.
+func (s *FileServer) Get(key string, level Consistency) (io.Reader, error) {
+	var (
+		meta     FileMeta
+		ok       bool
+		err      error
+		required = level.or(s.ReadConsistency).required(s.ReplicationFactor + 1)
+	)
+	if required > 1 {
+		if meta, err = s.readManifest(key, required); err != nil {
+			return nil, err
+		}
+	} else if meta, ok = s.catalog.Get(s.ID, key); !ok {
+		log.Printf("(%s): manifest of file (%s) not found on local disk, searching network", s.StorageFolder, key)
+		if meta, err = s.fetchManifest(key); err != nil {
+			return nil, err
+		}
 	}
 
-	log.Printf("(%s): file (%s) not found on local disk, searching network", s.StorageFolder, key)
+	if s.erasure != nil && !s.KeepLocalChunks {
+		log.Printf("(%s): serving file (%s), rebuilding the chunks that are not on local disk", s.StorageFolder, key)
+		return newChunkReader(s.store, s.ID, meta.Chunks, s.rebuildChunk), nil
+	}
+	fetched := 0
+	for _, ref := range meta.Chunks {
+		if s.store.Has(chunkNamespace(s.ID), ref.Hash) {
+			continue
+		}
+		if err := s.fetchChunk(ref); err != nil {
+			return nil, fmt.Errorf("chunk (%s): %w", ref.Hash, err)
+		}
+		fetched++
+	}
+	if fetched > 0 {
+		log.Printf("(%s): fetched (%d) of (%d) chunks of file (%s) from the network", s.StorageFolder, fetched, len(meta.Chunks), key)
+	} else {
+		log.Printf("(%s): serving file (%s) from local disk", s.StorageFolder, key)
+	}
+	return newChunkReader(s.store, s.ID, meta.Chunks, nil), nil
+}
 
+// fetchManifest fetches the manifest of a file stored by
+// this node from the network, and adds it to the catalog.
+func (s *FileServer) fetchManifest(key string) (FileMeta, error) {
+	var meta FileMeta
 	msg := &Message{
 		Payload: GetFileInstruction{
 			ServerID: s.ID,
 			FileKey:  hashKey(key),
 		},
 	}
+	err := s.fetchFile(msg, hashKey(key), func(r io.Reader, payload GetFileResponse) (int64, error) {
+		if r != nil || payload.Meta.Key != key || len(payload.Meta.Chunks) == 0 {
+			return 0, fmt.Errorf("unexpected reply for the manifest of (%s)", key)
+		}
+		meta = payload.Meta
+		return 0, nil
+	})
+	if err != nil {
+		return meta, err
+	}
+	return meta, s.catalog.Put(meta)
+}
+
+// fileSink writes a file streamed by a peer to disk. r is nil
+// when the reply carries no stream, like a manifest.
+type fileSink func(r io.Reader, payload GetFileResponse) (int64, error)
+
+// fetchFile asks the owners of key for the file requested by msg first,
+// and only falls back to the rest of the network if they miss it.
+func (s *FileServer) fetchFile(msg *Message, key string, sink fileSink) error {
+	owners, others := s.placement(key)
+	return s.fetchFileIn(msg, key, [][]p2p.Peer{owners, others}, sink)
+}
 
-	if err := s.broadcastMessage(msg); err != nil {
-		return nil, err
+// fetchFileIn asks the groups of peers in turn for the file requested
+// by msg, until one of the groups has it.
+func (s *FileServer) fetchFileIn(msg *Message, key string, groups [][]p2p.Peer, sink fileSink) error {
+	for _, peers := range groups {
+		err := s.fetchFileFrom(msg, key, peers, sink)
+		if errors.Is(err, ErrFileNotFound) {
+			continue
+		}
+		return err
 	}
+	return ErrFileNotFound
+}
 
-	time.Sleep(time.Millisecond * 100)
+// fetchFileFrom sends the request msg to peers and writes the file
+// to disk with sink from the first peer that has it.
+func (s *FileServer) fetchFileFrom(msg *Message, key string, peers []p2p.Peer, sink fileSink) error {
+	if len(peers) == 0 {
+		return ErrFileNotFound
+	}
 
-	for _, peer := range s.peers {
-		var size int64
-		err := binary.Read(peer, binary.LittleEndian, &size)
-		if err != nil {
-			return nil, err
+	req := s.requests.open(len(peers))
+	defer s.requests.close(req)
+	msg.ID = req.id
+
+	waiting, err := s.multicastMessage(peers, msg)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.After(s.RequestTimeout)
+	for waiting > 0 {
+		select {
+		case resp := <-req.respch:
+			waiting--
+			if err := s.receiveFile(resp, sink); err != nil {
+				if !errors.Is(err, ErrFileNotFound) {
+					log.Printf("(%s): failed to get (%s) from (%s): %s", s.StorageFolder, key, resp.From, err)
+				}
+				continue
+			}
+			return nil
+		case <-timeout:
+			return ErrRequestTimeout
 		}
+	}
+	return ErrFileNotFound
+}
 
-		n, err := s.store.WriteDecrypt(
-			s.Encryptionkey,
-			s.ID,
-			key,
-			io.LimitReader(peer, size),
-		)
-		if err != nil {
-			return nil, err
+// receiveFile writes the file streamed with a GetFileResponse to disk.
+func (s *FileServer) receiveFile(resp response, sink fileSink) error {
+	payload, ok := resp.Msg.Payload.(GetFileResponse)
+	if !ok {
+		discardResponse(resp)
+		return fmt.Errorf("unexpected reply %T", resp.Msg.Payload)
+	}
+	if resp.Stream == nil {
+		if len(payload.Err) > 0 {
+			return errors.New(payload.Err)
 		}
+		if !payload.Found {
+			return ErrFileNotFound
+		}
+		_, err := sink(nil, payload)
+		return err
+	}
+	defer resp.Stream.Close()
 
-		log.Printf(
-			"(%s): recieved (%d) bytes over the network from (%s).",
-			s.StorageFolder,
-			n,
-			peer.RemoteAddr().String(),
-		)
-		peer.CloseStream()
+	n, err := sink(newExactReader(resp.Stream, payload.Size), payload)
+	if err != nil {
+		return err
 	}
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
-}
 
-// Store stores a file to disk and streams
-// the data to other file server nodes to do the same.
-func (s *FileServer) Store(key string, r io.Reader, stream bool) error {
-	// 1. Store the file to disk
-	var (
-		fileBuf = new(bytes.Buffer)
-		tee     = io.TeeReader(r, fileBuf)
+	log.Printf(
+		"(%s): recieved (%d) bytes over the network from (%s).",
+		s.StorageFolder,
+		n,
+		resp.From,
 	)
-	size, err := s.store.Write(s.ID, key, tee)
+	return nil
+}
+
+// Store splits a file into chunks, stores the ones that are not
+// on disk yet and streams them to other file server nodes to do
+// the same. The manifest of the file is then sent to the owners
+// of its key. Only a single chunk is held in memory at a time.
+// ErrNotEnoughReplicas is returned when fewer peers than level
+// requires acknowledged the chunks and the manifest in time, the
+// file is still stored locally then.
+func (s *FileServer) Store(key string, r io.Reader, level Consistency) error {
+	acks := &ackSet{level: level.or(s.WriteConsistency)}
+	defer s.closeAcks(acks)
+
+	// 1. Store the chunks to disk, and stream them.
+	hash := sha256.New()
+	s.chunkLock.RLock()
+	chunks, size, err := s.storeChunks(io.TeeReader(r, hash), acks)
 	if err != nil {
-		return err
+		s.chunkLock.RUnlock()
+		// The chunks stored so far may be referenced by no file.
+		return errors.Join(err, s.releaseChunks(chunks))
+	}
+	log.Printf("(%s): stored file (%s) to disk locally in (%d) chunks\n", s.StorageFolder, key, len(chunks))
+
+	old, _ := s.catalog.Get(s.ID, key)
+	meta := FileMeta{
+		Key:     key,
+		Hash:    hex.EncodeToString(hash.Sum(nil)),
+		Size:    size,
+		Created: time.Now().UTC(),
+		Owner:   s.ID,
+		Chunks:  chunks,
 	}
-	log.Printf("(%s): stored file (%s) to disk locally\n", s.StorageFolder, key)
 
-	// Stream the File.
-	if stream {
+	// 2. Send the manifest to the owners of the key.
+	owners, _ := s.placement(hashKey(key))
+	required := acks.level.required(s.ReplicationFactor+1) - 1
+	id := s.expect(acks, "manifest of "+key, len(owners), required)
+	if len(owners) > 0 {
+		for _, peer := range owners {
+			meta.Replicas = append(meta.Replicas, peerAddr(peer))
+		}
 		msg := &Message{
+			ID: id,
 			Payload: StoreFileInstruction{
 				ServerID: s.ID,
 				FileKey:  hashKey(key),
-				Size:     size + 16,
+				Meta:     meta,
 			},
 		}
-		if err := s.broadcastMessage(msg); err != nil {
+		if _, err := s.multicastMessage(owners, msg); err != nil {
+			s.chunkLock.RUnlock()
 			return err
 		}
+		log.Printf("(%s): sent manifest of file of size (%d) bytes to (%d) peers\n", s.StorageFolder, size, len(owners))
+	}
+	// 3. Wait for the peers to acknowledge the writes.
+	ackErr := s.waitAcks(acks)
+	err = s.catalog.Put(meta)
+	if err != nil {
+		s.chunkLock.RUnlock()
+		return err
+	}
+	// 4. Drop the chunks whose shards are all stored.
+	dropErr := s.dropShardedChunks(acks)
+	s.chunkLock.RUnlock()
+	// 5. Release the chunks only the previous version referenced.
+	return errors.Join(ackErr, dropErr, s.releaseChunks(old.Chunks))
+}
 
-		time.Sleep(time.Millisecond * 5)
-		n, err := s.streamFile(fileBuf)
-		if err != nil {
-			return err
-		}
-		log.Printf("(%s): streamed file of size (%d) bytes\n", s.StorageFolder, n)
+// Stat returns the metadata of a file stored by this node.
+func (s *FileServer) Stat(key string) (FileMeta, error) {
+	meta, ok := s.catalog.Get(s.ID, key)
+	if !ok {
+		return FileMeta{}, ErrFileNotFound
 	}
-	return nil
+	return meta, nil
+}
+
+// List returns the metadata of every file held by this node, including
+// replicas of files stored by other nodes, whose key starts with prefix.
+func (s *FileServer) List(prefix string) []FileMeta {
+	return s.catalog.List(prefix)
 }
 
 func (s *FileServer) Delete(key string) error {
-	if s.store.Has(s.ID, key) {
-		if err := s.store.Delete(s.ID, key); err != nil {
-			return err
-		}
+	meta, ok := s.catalog.Get(s.ID, key)
+	if err := s.catalog.Remove(s.ID, hashKey(key)); err != nil {
+		return err
+	}
+	if ok {
 		log.Printf("(%s): deleted file (%s) from local disk", s.StorageFolder, key)
 	}
 
@@ -187,37 +509,124 @@ func (s *FileServer) Delete(key string) error {
 		},
 	}
 
-	if err := s.broadcastMessage(msg); err != nil {
+	if _, err := s.broadcastMessage(msg); err != nil {
 		return err
 	}
-	return nil
+	return s.releaseChunks(meta.Chunks)
 }
 
-// streamFile sends a file to all known connected peers.
-func (s *FileServer) streamFile(file io.Reader) (int64, error) {
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+// placement splits the connected peers into the owners of a hashed key,
+// according to the hash ring, and all the other peers.
+func (s *FileServer) placement(fileKey string) (owners, others []p2p.Peer) {
+	return s.placementN(fileKey, s.ReplicationFactor)
+}
+
+// placementN is placement with n owners.
+func (s *FileServer) placementN(fileKey string, n int) (owners, others []p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	isOwner := make(map[string]bool)
+	for _, addr := range s.ring.Owners(fileKey, n) {
+		if peer, ok := s.peers[addr]; ok {
+			owners = append(owners, peer)
+			isOwner[addr] = true
+		}
+	}
+	for addr, peer := range s.peers {
+		if !isOwner[addr] {
+			others = append(others, peer)
+		}
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	// Stream the encrypted file.
-	return copyEncrypt(s.Encryptionkey, file, mw)
+	return owners, others
+}
+
+// streamFile seals a file once and streams it to the provided
+// peers, using msg as the header of the stream. Only chunks and
+// shards are streamed, so the file is small enough to buffer.
+// A peer that already has the file resets the stream, which is
+// not an error: failures to store it are reported with acks.
+func (s *FileServer) streamFile(msg *Message, file io.Reader, peers []p2p.Peer) (int64, error) {
+	buf := new(bytes.Buffer)
+	n, err := s.seal(file, buf, peers...)
+	if err != nil {
+		return 0, err
+	}
+	for _, peer := range peers {
+		err := s.streamTo(peer, msg, bytes.NewReader(buf.Bytes()))
+		if err != nil && !errors.Is(err, p2p.ErrStreamReset) {
+			return 0, err
+		}
+	}
+	return n, nil
 }
 
 // broadcastMessage sends a message to all known connected peers
-func (s *FileServer) broadcastMessage(msg *Message) error {
+// and returns the number of peers it was sent to.
+func (s *FileServer) broadcastMessage(msg *Message) (int, error) {
+	return s.multicastMessage(s.peerList(), msg)
+}
+
+// multicastMessage sends a message to the provided peers
+// and returns the number of peers it was sent to.
+func (s *FileServer) multicastMessage(peers []p2p.Peer, msg *Message) (int, error) {
 	msgBuf := new(bytes.Buffer)
 	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
-		return err
+		return 0, err
 	}
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
+	n := 0
+	for _, peer := range peers {
 		if err := peer.Send(msgBuf.Bytes()); err != nil {
-			return err
+			return n, err
 		}
+		n++
 	}
-	return nil
+	return n, nil
+}
+
+// peer returns the connected peer at addr.
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// peerList returns a snapshot of the connected peers.
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// sendPayload sends a message with payload to the peer at addr.
+func (s *FileServer) sendPayload(addr string, payload any) error {
+	peer, ok := s.peer(addr)
+	if !ok {
+		return fmt.Errorf("(%s): peer (%s) not found", s.StorageFolder, addr)
+	}
+	return s.sendMessage(peer, &Message{Payload: payload})
+}
+
+// sendMessage sends a message to a single peer.
+func (s *FileServer) sendMessage(peer p2p.Peer, msg *Message) error {
+	msgBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
+		return err
+	}
+	return peer.Send(msgBuf.Bytes())
+}
+
+// streamTo sends msg to a single peer as the header of a stream of body.
+func (s *FileServer) streamTo(peer p2p.Peer, msg *Message, body io.Reader) error {
+	msgBuf := new(bytes.Buffer)
+	if err := gob.NewEncoder(msgBuf).Encode(msg); err != nil {
+		return err
+	}
+	return peer.SendStream(msgBuf.Bytes(), body)
 }
 
 // loop is an accept loop that waits for communication over channels
@@ -225,7 +634,9 @@ func (s *FileServer) broadcastMessage(msg *Message) error {
 func (s *FileServer) loop() {
 	defer func() {
 		log.Println("FileServer stopping due to user quit action.")
+		s.membership.Stop()
 		s.Transport.Close()
+		s.handlers.Wait()
 	}()
 	for {
 		select {
@@ -233,9 +644,16 @@ func (s *FileServer) loop() {
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				log.Println("Decoder error: ", err)
+				if rpc.Stream != nil {
+					rpc.Stream.Close()
+				}
 				continue
 			}
-			if err := s.handleMessage(rpc.From.String(), &msg); err != nil {
+			from := rpc.From.String()
+			if len(rpc.Identity) > 0 {
+				from = rpc.Identity
+			}
+			if err := s.handleMessage(from, &msg, rpc.Stream); err != nil {
 				log.Println("Handle Message Error: ", err)
 			}
 		case <-s.quitch:
@@ -245,7 +663,19 @@ func (s *FileServer) loop() {
 }
 
 // handleMessage handles messages recieved over the rpcch channel from store.
-func (s *FileServer) handleMessage(from string, msg *Message) error {
+// When stream is set the message is the header of a stream from the peer.
+// Handlers that read or send streams run on their own goroutine, so the
+// loop keeps consuming the frames the streams of the peer depend on.
+func (s *FileServer) handleMessage(from string, msg *Message, stream *p2p.Stream) error {
+	if stream != nil {
+		if _, ok := msg.Payload.(StoreChunkInstruction); !ok {
+			if _, ok := msg.Payload.(GetFileResponse); !ok {
+				stream.Close()
+				return fmt.Errorf("(%s): unexpected stream %T from (%s)", s.StorageFolder, msg.Payload, from)
+			}
+		}
+	}
+
 	switch msg.Payload.(type) {
 	case StoreFileInstruction:
 		log.Printf("(%s): [store file] request form (%s) for file (%s)\n",
@@ -253,7 +683,7 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 			from,
 			msg.Payload.(StoreFileInstruction).FileKey,
 		)
-		if err := s.handleStoreFile(from, msg.Payload.(StoreFileInstruction)); err != nil {
+		if err := s.sendAck(from, msg.ID, s.handleStoreFile(from, msg.Payload.(StoreFileInstruction))); err != nil {
 			return err
 		}
 
@@ -263,10 +693,22 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 			from,
 			msg.Payload.(GetFileInstruction).FileKey,
 		)
-		if err := s.handleGetFile(from, msg.Payload.(GetFileInstruction)); err != nil {
+		if err := s.handleGetFile(from, msg.ID, msg.Payload.(GetFileInstruction)); err != nil {
 			return err
 		}
 
+	case GetFileResponse, StoreAck, KeyHeadersResponse:
+		peer, ok := s.peer(from)
+		if !ok {
+			return fmt.Errorf("(%s): peer (%s) not found", s.StorageFolder, from)
+		}
+		s.requests.resolve(response{
+			From:   from,
+			Peer:   peer,
+			Msg:    msg,
+			Stream: stream,
+		})
+
 	case DeleteFileInstruction:
 		log.Printf("(%s): [delete file] request form (%s) for file (%s)\n",
 			s.StorageFolder,
@@ -277,6 +719,46 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 			return err
 		}
 
+	case StoreChunkInstruction:
+		if stream == nil {
+			return fmt.Errorf("(%s): chunk from (%s) was not streamed", s.StorageFolder, from)
+		}
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			err := s.handleStoreChunk(from, stream, msg.Payload.(StoreChunkInstruction))
+			if err := s.sendAck(from, msg.ID, err); err != nil {
+				log.Println("Handle Message Error: ", err)
+			}
+		}()
+
+	case GetChunkInstruction:
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			if err := s.handleGetChunk(from, msg.ID, msg.Payload.(GetChunkInstruction)); err != nil {
+				log.Println("Handle Message Error: ", err)
+			}
+		}()
+
+	case DeleteChunksInstruction:
+		if err := s.handleDeleteChunks(from, msg.Payload.(DeleteChunksInstruction)); err != nil {
+			return err
+		}
+
+	case GetKeyHeadersInstruction:
+		if err := s.handleGetKeyHeaders(from, msg.ID, msg.Payload.(GetKeyHeadersInstruction)); err != nil {
+			return err
+		}
+
+	case RewrapKeysInstruction:
+		if err := s.handleRewrapKeys(from, msg.ID, msg.Payload.(RewrapKeysInstruction)); err != nil {
+			return err
+		}
+
+	case PingMessage, PingReqMessage, AckMessage:
+		s.membership.HandleMessage(from, msg.Payload)
+
 	default:
 		log.Printf("(%s): recieved strange message request form (%s)\n",
 			s.StorageFolder,
@@ -286,68 +768,43 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 	return nil
 }
 
-// handleStoreFile handles MessageStoreMessages by writing
-// the recieved file from the peer connection onto disk.
+// handleStoreFile handles MessageStoreMessages by adding the
+// manifest of a file stored by a peer to the catalog.
 func (s *FileServer) handleStoreFile(from string, payload StoreFileInstruction) error {
-	log.Printf("(%s): recieving file over network from (%s)...", s.StorageFolder, from)
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) was not found", from)
+	hashes := make([]string, 0, len(payload.Meta.Chunks))
+	for _, ref := range payload.Meta.Chunks {
+		hashes = append(hashes, ref.Hash)
 	}
-	defer peer.CloseStream()
-
-	fileStream := io.LimitReader(peer, payload.Size)
-	n, err := s.store.Write(payload.ServerID, payload.FileKey, fileStream)
-	if err != nil {
+	if err := checkOwner(from, payload.ServerID); err != nil {
 		return err
 	}
-
-	log.Printf("(%s): recieved file of size (%d) bytes from (%s)\n", s.StorageFolder, n, from)
+	if err := checkOwner(from, payload.Meta.Owner, hashes...); err != nil {
+		return err
+	}
+	if err := s.catalog.Put(payload.Meta); err != nil {
+		return err
+	}
+	log.Printf("(%s): recieved manifest of file of size (%d) bytes from (%s)\n", s.StorageFolder, payload.Meta.Size, from)
 	return nil
 }
 
-// handleGetFile handles MessageGetFile messages.
-func (s *FileServer) handleGetFile(from string, payload GetFileInstruction) error {
-	if !s.store.Has(payload.ServerID, payload.FileKey) {
-		return fmt.Errorf("(%s): file (%s) not found", s.StorageFolder, payload.FileKey)
-	}
-
-	peer, ok := s.peers[from]
+// handleGetFile handles MessageGetFile messages by replying
+// with a GetFileResponse carrying the manifest of the file.
+func (s *FileServer) handleGetFile(from string, id uint64, payload GetFileInstruction) error {
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("(%s): peer (%s) not found", s.StorageFolder, from)
 	}
-
-	size, r, err := s.store.Read(payload.ServerID, payload.FileKey)
-	if err != nil {
-		return err
-	}
-
-	if rc, ok := r.(io.ReadCloser); ok {
-		log.Println("closing file.")
-		defer rc.Close()
-	}
-
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, size)
-
-	n, err := io.Copy(peer, r)
-	if err != nil {
-		return err
-	}
-	log.Printf(
-		"(%s): streamed file (%s) of size (%d) bytes to (%s)\n",
-		s.StorageFolder,
-		payload.FileKey,
-		n,
-		from,
-	)
-	return nil
+	meta, ok := s.catalog.get(payload.ServerID, payload.FileKey)
+	return s.sendMessage(peer, &Message{ID: id, Payload: GetFileResponse{Found: ok, Size: meta.Size, Meta: meta}})
 }
 
 // handleDeleteFile handles MessageGetFile messages.
 func (s *FileServer) handleDeleteFile(from string, payload DeleteFileInstruction) error {
-	err := s.store.Delete(payload.ServerID, payload.FileKey)
-	if err != nil {
+	if err := checkOwner(from, payload.ServerID); err != nil {
+		return err
+	}
+	if err := s.catalog.Remove(payload.ServerID, payload.FileKey); err != nil {
 		return err
 	}
 
@@ -361,27 +818,100 @@ func (s *FileServer) handleDeleteFile(from string, payload DeleteFileInstruction
 	return nil
 }
 
-// bootstrapNetwork connects to a list of nodes.
+// bootstrapNetwork connects to a list of nodes. Nodes that are not
+// up yet are redialed until they are.
 func (s *FileServer) bootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
 		if len(addr) == 0 {
 			continue
 		}
-		go func(a string) {
-			log.Printf("[%s]: Attempting to connect to: %s", s.Transport.Addr(), a)
-			if err := s.Transport.Dail(a); err != nil {
-				log.Printf("Failed to connect to %v: %v\n", a, err)
-			}
-		}(addr)
+		go s.redial(addr, true)
 	}
 	return nil
 }
 
+// dialMember connects to a member discovered through the membership.
+func (s *FileServer) dialMember(addr string) error {
+	s.redial(addr, false)
+	return nil
+}
+
+// redial dials addr until a connection is established or the server
+// stops, waiting longer after every failed attempt. Bootstrap nodes are
+// dialed forever, other addresses are given up once their member is dead.
+// A single loop runs for an address at a time.
+func (s *FileServer) redial(addr string, bootstrap bool) {
+	s.peerLock.Lock()
+	if s.redialing[addr] {
+		s.peerLock.Unlock()
+		return
+	}
+	s.redialing[addr] = true
+	s.peerLock.Unlock()
+	defer func() {
+		s.peerLock.Lock()
+		delete(s.redialing, addr)
+		s.peerLock.Unlock()
+	}()
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(s.backoff(attempt - 1)):
+			case <-s.quitch:
+				return
+			}
+		}
+		if s.connected(addr) {
+			return
+		}
+		if !bootstrap && s.membership.Dead(addr) {
+			log.Printf("[%s]: giving up on dead member at: %s", s.Transport.Addr(), addr)
+			return
+		}
+		log.Printf("[%s]: Attempting to connect to: %s", s.Transport.Addr(), addr)
+		err := s.Transport.Dail(addr)
+		if err == nil {
+			return
+		}
+		log.Printf("Failed to connect to %v (attempt %d): %v\n", addr, attempt+1, err)
+	}
+}
+
+// backoff returns the wait after the failed redial attempt, which doubles
+// with every attempt up to MaxRedialInterval. The wait is randomized
+// between half and all of it, so nodes that lost each other at the same
+// time do not redial in lockstep.
+func (s *FileServer) backoff(attempt int) time.Duration {
+	d := s.RedialInterval << min(attempt, 16)
+	if d <= 0 || d > s.MaxRedialInterval {
+		d = s.MaxRedialInterval
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// connected reports whether there is a connection to the peer at addr,
+// the address it listens on or the one it was dialed at.
+func (s *FileServer) connected(addr string) bool {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	for _, peer := range s.peers {
+		if peerAddr(peer) == addr || peer.RemoteAddr().String() == addr {
+			return true
+		}
+	}
+	return false
+}
+
 // Start starts the FileServer and it listens through the provided Transport.
 func (s *FileServer) Start() error {
 	if err := s.Transport.ListenAndAccept(); err != nil {
 		return err
 	}
+	s.membership.Start(s.Transport.Addr())
+	if s.ScrubInterval > 0 {
+		go s.scrubLoop()
+	}
 	s.bootstrapNetwork()
 	s.loop()
 	return nil
@@ -392,11 +922,92 @@ func (s *FileServer) Stop() {
 	close(s.quitch)
 }
 
-// OnPeer is a function that handles a peer connection.
+// removePeer closes the connection to a peer and forgets about it.
+func (s *FileServer) removePeer(addr string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	peer, ok := s.peers[addr]
+	if !ok {
+		return
+	}
+	peer.Close()
+	delete(s.peers, addr)
+	s.ring.Remove(addr)
+	log.Printf("[%s]: removed peer: %s", s.Transport.Addr(), addr)
+}
+
+// closePeer closes the connection to a peer.
+func (s *FileServer) closePeer(addr string) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+	if peer, ok := s.peers[addr]; ok {
+		peer.Close()
+	}
+}
+
+// peerKey returns the key of a peer in the peers, the ring and the
+// membership: its verified node ID, or its remote address without one.
+func peerKey(p p2p.Peer) string {
+	if id := p.Identity(); len(id) > 0 {
+		return id
+	}
+	return p.RemoteAddr().String()
+}
+
+// peerAddr returns the address a peer listens on, or its
+// remote address when the peer did not tell.
+func peerAddr(p p2p.Peer) string {
+	if addr := p.ListenAddr(); len(addr) > 0 {
+		return addr
+	}
+	return p.RemoteAddr().String()
+}
+
+// OnPeer is a function that handles a peer connection. A node that is
+// already connected is rejected, unless the new connection is the one
+// both nodes keep: the one dialed by the node with the lower ID.
 func (s *FileServer) OnPeer(p p2p.Peer) error {
+	key := peerKey(p)
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
-	s.peers[p.RemoteAddr().String()] = p
-	log.Printf("[%s]: Connection successfully established with peer: %s", s.Transport.Addr(), p.RemoteAddr())
+	if old, ok := s.peers[key]; ok {
+		if old.Outbound() == p.Outbound() || p.Outbound() != (s.ID < key) {
+			return fmt.Errorf("duplicate connection to node (%s)", key)
+		}
+		// The old connection is closed without forgetting the node.
+		old.Close()
+	}
+	s.peers[key] = p
+	s.ring.Add(key)
+	log.Printf("[%s]: Connection successfully established with peer: %s (%s)", s.Transport.Addr(), key, peerAddr(p))
+	go s.membership.Join(key)
 	return nil
 }
+
+// OnPeerDisconnect forgets a peer whose connection was closed. Peers this
+// node dialed are redialed, so the cluster heals once they are back up.
+func (s *FileServer) OnPeerDisconnect(p p2p.Peer) {
+	key := peerKey(p)
+	s.peerLock.Lock()
+	// A newer connection to the same node may have replaced the peer.
+	replaced := s.peers[key] != p
+	if !replaced {
+		delete(s.peers, key)
+		s.ring.Remove(key)
+		log.Printf("[%s]: peer disconnected: %s", s.Transport.Addr(), key)
+	}
+	s.peerLock.Unlock()
+	if replaced {
+		return
+	}
+	s.membership.Disconnected(key)
+
+	select {
+	case <-s.quitch:
+		return
+	default:
+	}
+	if p.Outbound() {
+		go s.redial(p.RemoteAddr().String(), false)
+	}
+}
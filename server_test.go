@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"runtime"
+	"runtime/metrics"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/muhreeowki/dfs/p2p"
+	"github.com/stretchr/testify/assert"
+)
+
+var testNodes atomic.Int64
+
+// newTestServer starts a FileServer on an in-memory network
+// that bootstraps from the provided nodes.
+func newTestServer(t testing.TB, network *p2p.MemoryNetwork, nodes ...string) *FileServer {
+	return newTestServerAt(t, network, fmt.Sprintf("node%d", testNodes.Add(1)), nodes...)
+}
+
+// newTestServerAt starts a test node at addr, restarting
+// a stopped node at the address of the node.
+func newTestServerAt(t testing.TB, network *p2p.MemoryNetwork, addr string, nodes ...string) *FileServer {
+	ident, err := NewIdentity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := p2p.NewMemoryTransport(p2p.MemoryTransportOpts{
+		Network:    network,
+		ListenAddr: addr,
+		ShakeHands: p2p.SignedHandshakeFunc(p2p.SignedHandshakeOpts{
+			NodeID:     ident.ID,
+			ListenAddr: addr,
+			PrivateKey: ident.PrivateKey,
+		}),
+		Decoder: p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		ID:                ident.ID,
+		Encryptionkey:     ident.DataKey,
+		Transport:         transport,
+		PathTransformFunc: CASPathTransformFunc,
+		StorageFolder:     t.TempDir(),
+		BootstrapNodes:    nodes,
+		RequestTimeout:    time.Second,
+		ProbeInterval:     time.Millisecond * 20,
+		SuspicionTimeout:  time.Millisecond * 100,
+		RedialInterval:    time.Millisecond * 10,
+		MaxRedialInterval: time.Millisecond * 100,
+	})
+	transport.OnPeer = s.OnPeer
+	transport.OnPeerDisconnect = s.OnPeerDisconnect
+	assert.Nil(t, transport.ListenAndAccept())
+	stopped := make(chan struct{})
+	go func() {
+		s.loop()
+		close(stopped)
+	}()
+	assert.Nil(t, s.bootstrapNetwork())
+	t.Cleanup(func() {
+		select {
+		case <-s.quitch:
+		default:
+			s.Stop()
+		}
+		// Nothing writes to the storage folder once the loop returned.
+		<-stopped
+	})
+	return s
+}
+
+func waitForPeers(t testing.TB, s *FileServer, n int) {
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		s.peerLock.Lock()
+		count := len(s.peers)
+		s.peerLock.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond * 5)
+	}
+	t.Fatalf("timed out waiting for %d peers", n)
+}
+
+// hasChunks reports whether s holds every chunk of meta.
+func hasChunks(s *FileServer, meta FileMeta) bool {
+	for _, ref := range meta.Chunks {
+		if !s.store.Has(chunkNamespace(meta.Owner), ref.Hash) {
+			return false
+		}
+	}
+	return true
+}
+
+// hasManifest reports whether s holds the manifest of key stored by owner.
+func hasManifest(s *FileServer, owner, key string) bool {
+	_, ok := s.catalog.Get(owner, key)
+	return ok
+}
+
+func TestFileServerGetFromNetwork(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s1, 1)
+	waitForPeers(t, s2, 1)
+
+	data := []byte("some file contents")
+	assert.Nil(t, s2.Store("file.txt", bytes.NewReader(data), ConsistencyOne))
+	meta, err := s2.Stat("file.txt")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return hasChunks(s1, meta) }, time.Second, time.Millisecond*5)
+	// Lose the manifest and the chunks on the local disk.
+	assert.Nil(t, s2.catalog.Remove(s2.ID, hashKey("file.txt")))
+	assert.Nil(t, s2.store.DeleteNamespace(chunkNamespace(s2.ID)))
+
+	r, err := s2.Get("file.txt", ConsistencyOne)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+	assert.True(t, hasManifest(s2, s2.ID, "file.txt"))
+	assert.True(t, hasChunks(s2, meta))
+}
+
+func TestFileServerGetNotFound(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s2, 1)
+
+	start := time.Now()
+	_, err := s2.Get("missing.txt", ConsistencyOne)
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	assert.Less(t, time.Since(start), s2.RequestTimeout)
+}
+
+func TestFileServerStoreReplicatesToOwners(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	s3 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s1, 2)
+	s1.ReplicationFactor = 1
+
+	assert.Nil(t, s1.Store("file.txt", bytes.NewReader([]byte("data")), ConsistencyOne))
+	meta, err := s1.Stat("file.txt")
+	assert.Nil(t, err)
+
+	owners, _ := s1.placement(hashKey("file.txt"))
+	assert.Len(t, owners, 1)
+	assert.Equal(t, []string{owners[0].ListenAddr()}, meta.Replicas)
+
+	// The stores are handled asynchronously by the peers.
+	assert.Eventually(t, func() bool {
+		return hasManifest(s2, s1.ID, "file.txt") || hasManifest(s3, s1.ID, "file.txt")
+	}, time.Second, time.Millisecond*5)
+	assert.Eventually(t, func() bool {
+		return hasChunks(s2, meta) || hasChunks(s3, meta)
+	}, time.Second, time.Millisecond*5)
+	time.Sleep(time.Millisecond * 20)
+	assert.False(t, hasManifest(s2, s1.ID, "file.txt") && hasManifest(s3, s1.ID, "file.txt"))
+	assert.False(t, hasChunks(s2, meta) && hasChunks(s3, meta))
+}
+
+func TestFileServerDeleteFromNetwork(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s1, 1)
+	waitForPeers(t, s2, 1)
+
+	assert.Nil(t, s2.Store("file.txt", bytes.NewReader([]byte("data")), ConsistencyOne))
+	meta, err := s2.Stat("file.txt")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return hasManifest(s1, s2.ID, "file.txt") && hasChunks(s1, meta)
+	}, time.Second, time.Millisecond*5)
+
+	assert.Nil(t, s2.Delete("file.txt"))
+	assert.False(t, hasManifest(s2, s2.ID, "file.txt"))
+	assert.False(t, s2.store.Has(chunkNamespace(s2.ID), meta.Chunks[0].Hash))
+	assert.Eventually(t, func() bool {
+		return !hasManifest(s1, s2.ID, "file.txt") && !s1.store.Has(chunkNamespace(s2.ID), meta.Chunks[0].Hash)
+	}, time.Second, time.Millisecond*5)
+
+	_, err = s2.Get("file.txt", ConsistencyOne)
+	assert.ErrorIs(t, err, ErrFileNotFound)
+}
+
+func TestFileServerRejectsInstructionsForOtherNodes(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	s3 := newTestServer(t, network, s1.Transport.Addr(), s2.Transport.Addr())
+	waitForPeers(t, s2, 2)
+	waitForPeers(t, s3, 2)
+
+	assert.Nil(t, s1.Store("file.txt", bytes.NewReader([]byte("data")), ConsistencyOne))
+	meta, err := s1.Stat("file.txt")
+	assert.Nil(t, err)
+	hash := meta.Chunks[0].Hash
+	assert.Eventually(t, func() bool {
+		return hasManifest(s2, s1.ID, "file.txt") && hasChunks(s2, meta)
+	}, time.Second, time.Millisecond*5)
+
+	// s3 can not delete or replace what s1 stored on s2.
+	assert.Error(t, s2.handleDeleteChunks(s3.ID, DeleteChunksInstruction{ServerID: s1.ID, Hashes: []string{hash}}))
+	assert.Error(t, s2.handleDeleteFile(s3.ID, DeleteFileInstruction{ServerID: s1.ID, FileKey: hashKey("file.txt")}))
+	assert.Error(t, s2.handleStoreFile(s3.ID, StoreFileInstruction{ServerID: s3.ID, FileKey: hashKey("file.txt"), Meta: meta}))
+	assert.True(t, hasManifest(s2, s1.ID, "file.txt"))
+	assert.True(t, hasChunks(s2, meta))
+
+	// Nor stream chunks in the name of s1.
+	peer, ok := s3.peer(s2.ID)
+	assert.True(t, ok)
+	data := []byte("planted")
+	sum := sha256.Sum256(data)
+	planted := hex.EncodeToString(sum[:])
+	req := s3.requests.open(1)
+	defer s3.requests.close(req)
+	_, err = s3.streamFile(&Message{
+		ID:      req.id,
+		Payload: StoreChunkInstruction{ServerID: s1.ID, Hash: planted, Size: sealedSize(int64(len(data)))},
+	}, bytes.NewReader(data), []p2p.Peer{peer})
+	assert.Nil(t, err)
+	select {
+	case resp := <-req.respch:
+		assert.Contains(t, resp.Msg.Payload.(StoreAck).Err, "can not change the objects")
+	case <-time.After(time.Second):
+		t.Fatal("no ack for the planted chunk")
+	}
+	assert.False(t, s2.store.Has(chunkNamespace(s1.ID), planted))
+
+	// Nor read or rewrap the data keys of s1.
+	assert.Error(t, s2.handleGetKeyHeaders(s3.ID, 0, GetKeyHeadersInstruction{ServerID: s1.ID}))
+	header, err := s2.readKeyHeader(chunkNamespace(s1.ID), hash)
+	assert.Nil(t, err)
+	forged, err := s3.Keyring.wrap(newEncryptionKey())
+	assert.Nil(t, err)
+	assert.Error(t, s2.handleRewrapKeys(s3.ID, 0, RewrapKeysInstruction{
+		ServerID: s1.ID,
+		Rewraps:  []KeyRewrap{{Key: hash, Old: header, New: forged}},
+	}))
+	after, err := s2.readKeyHeader(chunkNamespace(s1.ID), hash)
+	assert.Nil(t, err)
+	assert.Equal(t, header, after)
+
+	// Keys are file names, they can not leave the folder of a node.
+	for _, key := range []string{"../../escape", hash + "/../x", hash + ".01", "abc"} {
+		assert.Error(t, s2.handleDeleteChunks(s3.ID, DeleteChunksInstruction{ServerID: s3.ID, Hashes: []string{key}}), key)
+	}
+}
+
+func TestFileServerDedupChunks(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s1, 1)
+	waitForPeers(t, s2, 1)
+	s2.AverageChunkSize = 1 << 10
+
+	data := make([]byte, 64<<10)
+	rand.New(rand.NewSource(1)).Read(data)
+	edited := append(bytes.Clone(data[:1000]), append([]byte("an edit"), data[1000:]...)...)
+	assert.Nil(t, s2.Store("a.bin", bytes.NewReader(data), ConsistencyOne))
+	assert.Nil(t, s2.Store("b.bin", bytes.NewReader(edited), ConsistencyOne))
+
+	a, err := s2.Stat("a.bin")
+	assert.Nil(t, err)
+	b, err := s2.Stat("b.bin")
+	assert.Nil(t, err)
+	chunks := make(map[string]bool)
+	for _, ref := range append(a.Chunks, b.Chunks...) {
+		chunks[ref.Hash] = true
+	}
+	// The edit only changes the chunks around it.
+	assert.Less(t, len(chunks), len(a.Chunks)+3)
+	assert.Eventually(t, func() bool { return hasChunks(s1, a) && hasChunks(s1, b) }, time.Second, time.Millisecond*5)
+
+	// The chunks b.bin shares with a.bin outlive it.
+	assert.Nil(t, s2.Delete("a.bin"))
+	assert.True(t, hasChunks(s2, b))
+	r, err := s2.Get("b.bin", ConsistencyOne)
+	assert.Nil(t, err)
+	got, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, edited, got)
+
+	assert.Nil(t, s2.Delete("b.bin"))
+	for hash := range chunks {
+		assert.False(t, s2.store.Has(chunkNamespace(s2.ID), hash))
+	}
+	assert.Eventually(t, func() bool {
+		for hash := range chunks {
+			if s1.store.Has(chunkNamespace(s2.ID), hash) {
+				return false
+			}
+		}
+		return true
+	}, time.Second, time.Millisecond*5)
+}
+
+// zeroReader is an endless stream of zeros that takes no memory.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// peakHeap returns the most heap memory that was in use while
+// fn ran, on top of the memory in use before it was called.
+func peakHeap(fn func()) uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	runtime.GC()
+	metrics.Read(sample)
+	base := sample[0].Value.Uint64()
+
+	done, peakch := make(chan struct{}), make(chan uint64)
+	go func() {
+		sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+		peak := base
+		for {
+			metrics.Read(sample)
+			peak = max(peak, sample[0].Value.Uint64())
+			select {
+			case <-done:
+				peakch <- peak - base
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+	fn()
+	close(done)
+	return <-peakch
+}
+
+// storeReplicated stores size bytes under key on s and waits for
+// the replica to commit them, the manifest is sent after the chunks.
+func storeReplicated(t testing.TB, s, replica *FileServer, key string, size int64) {
+	if err := s.Store(key, io.LimitReader(zeroReader{}, size), ConsistencyOne); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 30)
+	for !hasManifest(replica, s.ID, key) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the replica of (%s)", key)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Not parallel, other tests would be counted in the heap. The heap of
+// both nodes is counted, the replica must not buffer what it receives.
+func TestFileServerStoreBoundedMemory(t *testing.T) {
+	s1 := newTCPTestServer(t)
+	s2 := newTCPTestServer(t, s1.Transport.Addr())
+	waitForPeers(t, s2, 1)
+	size := int64(64 << 20)
+
+	peak := peakHeap(func() {
+		storeReplicated(t, s2, s1, "big.bin", size)
+	})
+	assert.Less(t, peak, uint64(16<<20))
+
+	meta, err := s2.Stat("big.bin")
+	assert.Nil(t, err)
+	assert.Equal(t, size, meta.Size)
+	assert.True(t, hasChunks(s1, meta))
+}
+
+// newTCPTestServer starts a FileServer on a local TCP port. Unlike the
+// in-memory network, sockets apply backpressure to fast writers.
+func newTCPTestServer(t testing.TB, nodes ...string) *FileServer {
+	ident, err := NewIdentity("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The handshake announces the listen address, so it is picked first.
+	addr := l.Addr().String()
+	l.Close()
+	transport := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr: addr,
+		ShakeHands: p2p.SignedHandshakeFunc(p2p.SignedHandshakeOpts{
+			NodeID:     ident.ID,
+			ListenAddr: addr,
+			PrivateKey: ident.PrivateKey,
+			Features:   []string{p2p.FeatureStreams},
+		}),
+		Decoder: p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		ID:                ident.ID,
+		Encryptionkey:     ident.DataKey,
+		Transport:         transport,
+		PathTransformFunc: CASPathTransformFunc,
+		StorageFolder:     t.TempDir(),
+		BootstrapNodes:    nodes,
+	})
+	transport.OnPeer = s.OnPeer
+	transport.OnPeerDisconnect = s.OnPeerDisconnect
+	assert.Nil(t, transport.ListenAndAccept())
+	go s.loop()
+	assert.Nil(t, s.bootstrapNetwork())
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// BenchmarkFileServerStore stores files of growing sizes to a node with
+// a replica and reports the peak heap in use, which must not grow with them.
+func BenchmarkFileServerStore(b *testing.B) {
+	for _, size := range []int64{1 << 20, 16 << 20, 128 << 20} {
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			s1 := newTCPTestServer(b)
+			s2 := newTCPTestServer(b, s1.Transport.Addr())
+			waitForPeers(b, s2, 1)
+
+			b.SetBytes(size)
+			b.ResetTimer()
+			var peak uint64
+			for i := 0; i < b.N; i++ {
+				peak = max(peak, peakHeap(func() {
+					storeReplicated(b, s2, s1, fmt.Sprintf("big-%d.bin", i), size)
+				}))
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MiB")
+		})
+	}
+}
+
+func TestFileServerErasureCodingNeedsAPeerPerShard(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s := newTestServer(t, network)
+	peers := []*FileServer{}
+	for range 3 {
+		peers = append(peers, newTestServer(t, network, s.Transport.Addr()))
+	}
+	waitForPeers(t, s, 3)
+	erasure, err := NewReedSolomon(2, 2)
+	assert.Nil(t, err)
+	s.erasure = erasure
+
+	err = s.Store("file.txt", bytes.NewReader([]byte("four shards, three peers")), ConsistencyOne)
+	assert.ErrorIs(t, err, ErrTooFewOwners)
+	_, err = s.Stat("file.txt")
+	assert.ErrorIs(t, err, ErrFileNotFound)
+	for _, peer := range peers {
+		assert.Empty(t, peer.catalog.List(""))
+	}
+}
+
+func TestFileServerErasureCoding(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s := newTestServer(t, network)
+	peers := []*FileServer{}
+	for range 4 {
+		peers = append(peers, newTestServer(t, network, s.Transport.Addr()))
+	}
+	// Membership removes the peers of the nodes that are lost.
+	for _, node := range append(peers, s) {
+		node.membership.Start(node.Transport.Addr())
+	}
+	waitForPeers(t, s, 4)
+	erasure, err := NewReedSolomon(2, 2)
+	assert.Nil(t, err)
+	s.erasure = erasure
+
+	data := bytes.Repeat([]byte("erasure coded "), 1000)
+	assert.Nil(t, s.Store("file.txt", bytes.NewReader(data), ConsistencyOne))
+	meta, err := s.Stat("file.txt")
+	assert.Nil(t, err)
+	assert.Len(t, meta.Chunks, 1)
+	hash := meta.Chunks[0].Hash
+
+	// Every peer holds a single shard, and no peer the whole chunk.
+	holders := make(map[int]*FileServer)
+	assert.Eventually(t, func() bool {
+		for _, peer := range peers {
+			for i := 0; i < erasure.Shards(); i++ {
+				if peer.store.Has(chunkNamespace(s.ID), shardKey(hash, i)) {
+					holders[i] = peer
+				}
+			}
+		}
+		return len(holders) == erasure.Shards()
+	}, time.Second, time.Millisecond*5)
+	for _, peer := range peers {
+		assert.False(t, hasChunks(peer, meta))
+	}
+	// Once every shard is stored, the node only keeps the shards.
+	assert.False(t, hasChunks(s, meta))
+
+	// Unless it keeps its local chunks.
+	s.KeepLocalChunks = true
+	assert.Nil(t, s.Store("kept.txt", bytes.NewReader([]byte("kept locally")), ConsistencyOne))
+	kept, err := s.Stat("kept.txt")
+	assert.Nil(t, err)
+	assert.True(t, hasChunks(s, kept))
+	s.KeepLocalChunks = false
+
+	// Lose two nodes, any two shards rebuild the chunk.
+	holders[0].Stop()
+	holders[2].Stop()
+	assert.Eventually(t, func() bool {
+		s.peerLock.Lock()
+		defer s.peerLock.Unlock()
+		return len(s.peers) == 2
+	}, time.Second*2, time.Millisecond*5)
+
+	r, err := s.Get("file.txt", ConsistencyOne)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	// A third loss leaves too few shards.
+	holders[1].Stop()
+	assert.Eventually(t, func() bool {
+		s.peerLock.Lock()
+		defer s.peerLock.Unlock()
+		return len(s.peers) == 1
+	}, time.Second*2, time.Millisecond*5)
+	// Chunks are rebuilt as they are read, reads fail then.
+	r, err = s.Get("file.txt", ConsistencyOne)
+	assert.Nil(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrTooFewShards)
+}
+
+func TestFileServerConsistencyLevels(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	s3 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s1, 2)
+	s1.ReplicationFactor = 2
+
+	data := []byte("acknowledged")
+	assert.Nil(t, s1.Store("all.txt", bytes.NewReader(data), ConsistencyAll))
+	// ALL returns once both peers stored the manifest.
+	assert.True(t, hasManifest(s2, s1.ID, "all.txt"))
+	assert.True(t, hasManifest(s3, s1.ID, "all.txt"))
+	r, err := s1.Get("all.txt", ConsistencyAll)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+
+	// Writes fail on s3 once its storage folder is a regular file.
+	broken := t.TempDir() + "/file"
+	assert.Nil(t, os.WriteFile(broken, nil, 0644))
+	s3.store.StorageFolder = broken
+
+	err = s1.Store("file.txt", bytes.NewReader(data), ConsistencyAll)
+	assert.ErrorIs(t, err, ErrNotEnoughReplicas)
+	// The file is stored anyway, the peers that could store it have it.
+	assert.True(t, hasManifest(s1, s1.ID, "file.txt"))
+	assert.True(t, hasManifest(s2, s1.ID, "file.txt"))
+
+	assert.Nil(t, s1.Store("file.txt", bytes.NewReader(data), ConsistencyQuorum))
+	_, err = s1.Get("file.txt", ConsistencyQuorum)
+	assert.Nil(t, err)
+	_, err = s1.Get("file.txt", ConsistencyAll)
+	assert.ErrorIs(t, err, ErrNotEnoughReplicas)
+}
+
+func TestFileServerRedialsAfterRestart(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	addr := fmt.Sprintf("node%d", testNodes.Add(1))
+	// The bootstrap node is not up yet, s2 keeps dialing it.
+	s2 := newTestServer(t, network, addr)
+	time.Sleep(time.Millisecond * 50)
+	s1 := newTestServerAt(t, network, addr)
+	waitForPeers(t, s2, 1)
+
+	s1.Stop()
+	assert.Eventually(t, func() bool { return !s2.connected(addr) }, time.Second, time.Millisecond*5)
+	s1 = newTestServerAt(t, network, addr)
+	waitForPeers(t, s2, 1)
+	waitForPeers(t, s1, 1)
+
+	key := "healed.txt"
+	assert.Nil(t, s2.Store(key, bytes.NewReader([]byte("back together")), ConsistencyOne))
+	meta, err := s2.Stat(key)
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool {
+		return hasChunks(s1, meta) && hasManifest(s1, s2.ID, key)
+	}, time.Second, time.Millisecond*5)
+}
+
+func TestFileServerKeysPeersByNodeID(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	addr1 := fmt.Sprintf("node%d", testNodes.Add(1))
+	addr2 := fmt.Sprintf("node%d", testNodes.Add(1))
+	// Both nodes dial each other, they must still see a single peer.
+	s1 := newTestServerAt(t, network, addr1, addr2)
+	s2 := newTestServerAt(t, network, addr2, addr1)
+
+	for _, c := range []struct {
+		s    *FileServer
+		peer *FileServer
+		addr string
+	}{{s1, s2, addr2}, {s2, s1, addr1}} {
+		assert.Eventually(t, func() bool {
+			peer, ok := c.s.peer(c.peer.ID)
+			return ok && peer.ListenAddr() == c.addr
+		}, time.Second*2, time.Millisecond*5)
+		assert.True(t, c.s.connected(c.addr))
+	}
+	assert.Never(t, func() bool {
+		return len(s1.peerList()) != 1 || len(s2.peerList()) != 1
+	}, time.Millisecond*200, time.Millisecond*5)
+
+	// Both nodes kept the same connection.
+	p1, _ := s1.peer(s2.ID)
+	p2, _ := s2.peer(s1.ID)
+	assert.Equal(t, p1.LocalAddr().String(), p2.RemoteAddr().String())
+}
+
+func TestFileServerRotateKeys(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s1, 1)
+	waitForPeers(t, s2, 1)
+
+	data := []byte("rotated file contents")
+	assert.Nil(t, s2.Store("file.txt", bytes.NewReader(data), ConsistencyOne))
+	meta, err := s2.Stat("file.txt")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return hasChunks(s1, meta) }, time.Second, time.Millisecond*5)
+	old := s2.Keyring.Active()
+	header, err := s1.readKeyHeader(chunkNamespace(s2.ID), meta.Chunks[0].Hash)
+	assert.Nil(t, err)
+	kid, _ := envelopeKEK(header)
+	assert.Equal(t, old, kid)
+	assert.Equal(t, []string{s1.ID}, s2.Keyring.Holders(old))
+
+	// Peers hold no data key wrapped by the active key before a rotation.
+	assert.ErrorContains(t, s2.RetireKey(old), "active key")
+	rot, err := s2.RotateKeys()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{old}, rot.Previous)
+	assert.Equal(t, len(meta.Chunks), rot.Rewrapped)
+	after, err := s1.readKeyHeader(chunkNamespace(s2.ID), meta.Chunks[0].Hash)
+	assert.Nil(t, err)
+	kid, _ = envelopeKEK(after)
+	assert.Equal(t, rot.KeyID, kid)
+	assert.Empty(t, s2.Keyring.Holders(old))
+	assert.Equal(t, []string{s1.ID}, s2.Keyring.Holders(rot.KeyID))
+
+	// Data keys wrapped by the old key keep it from being retired.
+	assert.Nil(t, s1.rewrapObject(chunkNamespace(s2.ID), meta.Chunks[0].Hash, after, header))
+	assert.ErrorIs(t, s2.RetireKey(old), ErrKEKInUse)
+	assert.Nil(t, s1.rewrapObject(chunkNamespace(s2.ID), meta.Chunks[0].Hash, header, after))
+	assert.Nil(t, s2.RetireKey(old))
+	assert.Equal(t, []string{rot.KeyID}, s2.Keyring.IDs())
+
+	// The rewrapped chunks are still read back from the peer.
+	assert.Nil(t, s2.catalog.Remove(s2.ID, hashKey("file.txt")))
+	assert.Nil(t, s2.store.DeleteNamespace(chunkNamespace(s2.ID)))
+	r, err := s2.Get("file.txt", ConsistencyOne)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestFileServerOpensLegacyChunksOfOldFilesOnly(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s2, 1)
+
+	data := []byte("sent before envelope encryption")
+	assert.Nil(t, s2.Store("file.txt", bytes.NewReader(data), ConsistencyOne))
+	meta, err := s2.Stat("file.txt")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return hasChunks(s1, meta) }, time.Second, time.Millisecond*5)
+	// s1 holds the chunk as it was sent before envelopes.
+	legacy := new(bytes.Buffer)
+	_, err = copyEncrypt(s2.Encryptionkey, bytes.NewReader(data), legacy)
+	assert.Nil(t, err)
+	_, err = s1.store.Write(chunkNamespace(s2.ID), meta.Chunks[0].Hash, legacy)
+	assert.Nil(t, err)
+	assert.Nil(t, s2.store.DeleteNamespace(chunkNamespace(s2.ID)))
+
+	// The file was stored after the keyring was created, so its chunks
+	// must have an envelope: the legacy chunk fails to decrypt.
+	_, err = s2.Get("file.txt", ConsistencyOne)
+	assert.ErrorIs(t, err, ErrFileNotFound)
+
+	meta.Created = s2.Keyring.Since().Add(-time.Hour)
+	assert.Nil(t, s2.catalog.Put(meta))
+	r, err := s2.Get("file.txt", ConsistencyOne)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestFileServerFetchesChunksOfAnEarlierChunkSize(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s2, 1)
+
+	s2.AverageChunkSize = 1 << 20
+	data := make([]byte, 512<<10)
+	rand.Read(data)
+	assert.Nil(t, s2.Store("big.bin", bytes.NewReader(data), ConsistencyOne))
+	meta, err := s2.Stat("big.bin")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return hasChunks(s1, meta) }, time.Second, time.Millisecond*5)
+
+	// Chunks are bounded by the size of their manifest, not by the
+	// chunk size the node uses now.
+	s2.AverageChunkSize = 4 << 10
+	assert.Nil(t, s2.store.DeleteNamespace(chunkNamespace(s2.ID)))
+	r, err := s2.Get("big.bin", ConsistencyOne)
+	assert.Nil(t, err)
+	b, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestFileServerRetireKeyNeedsEveryHolder(t *testing.T) {
+	t.Parallel()
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	waitForPeers(t, s2, 1)
+
+	assert.Nil(t, s2.Store("file.txt", bytes.NewReader([]byte("held by s1")), ConsistencyOne))
+	meta, err := s2.Stat("file.txt")
+	assert.Nil(t, err)
+	assert.Eventually(t, func() bool { return hasChunks(s1, meta) }, time.Second, time.Millisecond*5)
+	old := s2.Keyring.Active()
+	s1.Stop()
+	assert.Eventually(t, func() bool { return len(s2.peerList()) == 0 }, time.Second, time.Millisecond*5)
+
+	// s1 still holds a data key wrapped by the old key, even though
+	// no connected peer reports one.
+	rot, err := s2.RotateKeys()
+	assert.Nil(t, err)
+	assert.Zero(t, rot.Rewrapped)
+	err = s2.RetireKey(old)
+	assert.ErrorIs(t, err, ErrKEKInUse)
+	assert.ErrorContains(t, err, s1.ID)
+	assert.Equal(t, []string{old, rot.KeyID}, s2.Keyring.IDs())
+}
+
+func TestFileServerConcurrentLoad(t *testing.T) {
+	network := p2p.NewMemoryNetwork()
+	s1 := newTestServer(t, network)
+	s2 := newTestServer(t, network, s1.Transport.Addr())
+	s3 := newTestServer(t, network, s1.Transport.Addr(), s2.Transport.Addr())
+	waitForPeers(t, s1, 2)
+	waitForPeers(t, s3, 2)
+
+	var wg sync.WaitGroup
+	for i, s := range []*FileServer{s1, s2, s3, s1, s2, s3} {
+		wg.Add(1)
+		go func(i int, s *FileServer) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				key := fmt.Sprintf("load-%d-%d.txt", i, j)
+				data := bytes.Repeat([]byte(key), 1000)
+				if !assert.Nil(t, s.Store(key, bytes.NewReader(data), ConsistencyOne)) {
+					return
+				}
+				r, err := s.Get(key, ConsistencyOne)
+				if !assert.Nil(t, err) {
+					return
+				}
+				got, err := io.ReadAll(r)
+				if rc, ok := r.(io.Closer); ok {
+					rc.Close()
+				}
+				assert.Nil(t, err)
+				assert.Equal(t, data, got)
+				if j%2 == 0 {
+					assert.Nil(t, s.Delete(key))
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+}
+
+func TestFileServerBackoff(t *testing.T) {
+	s := &FileServer{FileServerOpts: FileServerOpts{
+		RedialInterval:    time.Millisecond * 100,
+		MaxRedialInterval: time.Second,
+	}}
+	for attempt, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		want *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			d := s.backoff(attempt)
+			assert.GreaterOrEqual(t, d, want/2)
+			assert.LessOrEqual(t, d, want)
+		}
+	}
+	// The shift must not overflow after many attempts.
+	assert.GreaterOrEqual(t, s.backoff(100), time.Second/2)
+}
+
+func TestParseConsistency(t *testing.T) {
+	for name, want := range map[string]Consistency{"": ConsistencyDefault, "one": ConsistencyOne, "QUORUM": ConsistencyQuorum, "All": ConsistencyAll} {
+		level, err := ParseConsistency(name)
+		assert.Nil(t, err)
+		assert.Equal(t, want, level)
+	}
+	_, err := ParseConsistency("most")
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, ConsistencyQuorum.required(4))
+	assert.Equal(t, 1, ConsistencyOne.required(4))
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/muhreeowki/dfs/p2p"
+)
+
+// shardKey returns the key shard i of the chunk hash is stored under.
+func shardKey(hash string, i int) string {
+	return hash + "." + strconv.Itoa(i)
+}
+
+// parseShardKey returns the chunk hash and the index of a shard key.
+func parseShardKey(key string) (string, int, bool) {
+	hash, index, ok := strings.Cut(key, ".")
+	if !ok {
+		return "", 0, false
+	}
+	i, err := strconv.Atoi(index)
+	return hash, i, err == nil && i >= 0
+}
+
+// encodeShards erasure codes a chunk. The chunk is prefixed with
+// its size, so the padding of the shards can be told from it.
+func (s *FileServer) encodeShards(chunk []byte) ([][]byte, error) {
+	data := binary.BigEndian.AppendUint64(make([]byte, 0, 8+len(chunk)), uint64(len(chunk)))
+	shards := s.erasure.Split(append(data, chunk...))
+	return shards, s.erasure.Encode(shards)
+}
+
+// decodeShards returns the chunk encoded into shards, which must be whole.
+func (s *FileServer) decodeShards(shards [][]byte) ([]byte, error) {
+	data := s.erasure.Join(shards)
+	if len(data) < 8 {
+		return nil, fmt.Errorf("shards hold %d bytes", len(data))
+	}
+	size := binary.BigEndian.Uint64(data)
+	if size > uint64(len(data)-8) {
+		return nil, fmt.Errorf("shards hold %d bytes, want %d", len(data)-8, size)
+	}
+	return data[8 : 8+size], nil
+}
+
+// ErrTooFewOwners is returned when an erasure coded chunk is stored
+// while fewer peers are connected than it has shards.
+var ErrTooFewOwners = errors.New("fewer peers than shards")
+
+// streamShards erasure codes a chunk and streams every shard to a
+// different owner of its hash. It fails with ErrTooFewOwners rather
+// than give a peer more than one shard, losing that peer would cost
+// more shards than the code was chosen to survive. Without any peer,
+// the chunk is only kept on the local disk.
+// All the shards are sent with the same request ID, the acks of the
+// peers are counted as the acks of the chunk.
+func (s *FileServer) streamShards(hash string, chunk []byte, acks *ackSet) error {
+	shards, err := s.encodeShards(chunk)
+	if err != nil {
+		return err
+	}
+	owners, _ := s.placementN(hash, len(shards))
+	if len(owners) > 0 && len(owners) < len(shards) {
+		return fmt.Errorf("%w: (%d) peers for the (%d) shards of chunk (%s)", ErrTooFewOwners, len(owners), len(shards), hash)
+	}
+	sent := 0
+	if len(owners) > 0 {
+		sent = len(shards)
+	}
+	id := s.expectShards(acks, hash, sent)
+	if len(owners) == 0 {
+		return nil
+	}
+	for i, shard := range shards {
+		msg := &Message{
+			ID: id,
+			Payload: StoreChunkInstruction{
+				ServerID: s.ID,
+				Hash:     shardKey(hash, i),
+				Size:     sealedSize(int64(len(shard))),
+			},
+		}
+		if _, err := s.streamFile(msg, bytes.NewReader(shard), owners[i:i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardSize returns the size of the shards of a chunk of size bytes.
+func (s *FileServer) shardSize(size int64) int64 {
+	k := int64(s.erasure.DataShards)
+	return max((8+size+k-1)/k, 1)
+}
+
+// fetchShards rebuilds a chunk of a file stored by this node from its
+// shards, and writes it to disk.
+func (s *FileServer) fetchShards(ref ChunkRef) error {
+	chunk, err := s.rebuildChunk(ref)
+	if err != nil {
+		return err
+	}
+	_, err = s.store.Write(chunkNamespace(s.ID), ref.Hash, bytes.NewReader(chunk))
+	return err
+}
+
+// rebuildChunk fetches shards of a chunk of a file stored by this node
+// until there are enough to rebuild it, and returns it.
+func (s *FileServer) rebuildChunk(ref ChunkRef) ([]byte, error) {
+	var (
+		hash           = ref.Hash
+		n              = s.erasure.Shards()
+		shards         = make([][]byte, n)
+		maxSize        = sealedSize(s.shardSize(ref.Size))
+		found          = 0
+		owners, others = s.placementN(hash, n)
+	)
+	for i := 0; i < n && found < s.erasure.DataShards; i++ {
+		key := shardKey(hash, i)
+		msg := &Message{
+			Payload: GetChunkInstruction{ServerID: s.ID, Hash: key},
+		}
+		// Ask the owner the shard was streamed to first, then everyone else.
+		groups := [][]p2p.Peer{nil, others}
+		for j, peer := range owners {
+			if j == i%len(owners) {
+				groups[0] = append(groups[0], peer)
+			} else {
+				groups[1] = append(groups[1], peer)
+			}
+		}
+		err := s.fetchFileIn(msg, key, groups, func(r io.Reader, payload GetFileResponse) (int64, error) {
+			if r == nil || payload.Size > maxSize {
+				return 0, fmt.Errorf("unexpected reply for shard (%s)", key)
+			}
+			buf := new(bytes.Buffer)
+			n, err := s.open(hash, r, buf)
+			if err != nil {
+				return n, err
+			}
+			shards[i] = buf.Bytes()
+			return n, nil
+		})
+		if err != nil {
+			log.Printf("(%s): failed to get shard (%s): %s", s.StorageFolder, key, err)
+			shards[i] = nil
+			continue
+		}
+		found++
+	}
+
+	if err := s.erasure.Reconstruct(shards); err != nil {
+		return nil, fmt.Errorf("found (%d) of (%d) shards: %w", found, n, err)
+	}
+	chunk, err := s.decodeShards(shards)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(chunk)
+	if hex.EncodeToString(sum[:]) != hash {
+		return nil, ErrChecksumMismatch
+	}
+	return chunk, nil
+}
+
+// dropShardedChunks deletes the local copy of every erasure coded chunk
+// of acks whose shards were all acknowledged, see expectShards. It waits
+// up to RequestTimeout for the acks the consistency level did not need,
+// chunks missing some are kept.
+func (s *FileServer) dropShardedChunks(acks *ackSet) error {
+	timeout := time.After(s.RequestTimeout)
+	var errs []error
+	for i := range acks.writes {
+		w := &acks.writes[i]
+		if len(w.chunk) == 0 {
+			continue
+		}
+	wait:
+		// A failed ack keeps the chunk, there is no need to wait for the others.
+		for w.acked == w.replied && w.replied < w.sent {
+			select {
+			case resp := <-w.req.respch:
+				s.countAck(w, resp)
+			case <-timeout:
+				break wait
+			}
+		}
+		if w.acked < w.sent {
+			log.Printf("(%s): keeping chunk (%s), (%d) of (%d) shards were stored", s.StorageFolder, w.chunk, w.acked, w.sent)
+			continue
+		}
+		if err := s.store.Delete(chunkNamespace(s.ID), w.chunk); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// readShards reads a chunk of this node and erasure codes it.
+func (s *FileServer) readShards(hash string) ([][]byte, error) {
+	if s.erasure == nil {
+		return nil, nil
+	}
+	_, r, err := s.store.Read(chunkNamespace(s.ID), hash)
+	if err != nil {
+		return nil, err
+	}
+	if rc, ok := r.(io.Closer); ok {
+		defer rc.Close()
+	}
+	chunk, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.encodeShards(chunk)
+}
+
+// sendShard replies to a GetChunkInstruction for a shard of a
+// chunk of this node by encoding the chunk again.
+func (s *FileServer) sendShard(peer p2p.Peer, id uint64, hash string, i int) error {
+	shards, err := s.readShards(hash)
+	if err != nil {
+		return errors.Join(err, s.sendMessage(peer, &Message{
+			ID:      id,
+			Payload: GetFileResponse{Err: err.Error()},
+		}))
+	}
+	if i >= len(shards) {
+		return s.sendMessage(peer, &Message{ID: id, Payload: GetFileResponse{}})
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := s.seal(bytes.NewReader(shards[i]), buf, peer); err != nil {
+		return err
+	}
+	msg := &Message{ID: id, Payload: GetFileResponse{Found: true, Size: int64(buf.Len())}}
+	return s.streamTo(peer, msg, buf)
+}
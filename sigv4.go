@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, as used by S3.
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+	sigV4DateFormat = "20060102"
+	// sigV4MaxSkew is how far the time of a request may be from ours.
+	sigV4MaxSkew = time.Minute * 15
+	// sigV4MaxExpires is the longest a presigned URL may be valid for.
+	sigV4MaxExpires = time.Hour * 24 * 7
+
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptySHA256      = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// maxPayloadChunkSize bounds the chunks of a streaming payload,
+	// which are buffered to be verified before they are used.
+	maxPayloadChunkSize = 16 << 20
+)
+
+// sigV4Auth is the parsed signature of a request.
+type sigV4Auth struct {
+	AccessKey     string
+	Date          string
+	Region        string
+	Service       string
+	SignedHeaders []string
+	Signature     string
+	Time          time.Time
+	// PayloadHash is the hex SHA-256 of the body, unsignedPayload or streamingPayload.
+	PayloadHash string
+	// Presigned is true when the signature is in the query string.
+	Presigned bool
+	Expires   time.Duration
+}
+
+// scope returns the credential scope of the signature.
+func (a *sigV4Auth) scope() string {
+	return strings.Join([]string{a.Date, a.Region, a.Service, "aws4_request"}, "/")
+}
+
+// parseSigV4 parses the signature of r from its
+// Authorization header or, for presigned URLs, its query.
+func parseSigV4(r *http.Request) (*sigV4Auth, error) {
+	if r.URL.Query().Has("X-Amz-Signature") {
+		return parseSigV4Query(r.URL.Query())
+	}
+	header := r.Header.Get("Authorization")
+	if len(header) == 0 {
+		return nil, errS3AccessDenied
+	}
+	algorithm, fields, _ := strings.Cut(header, " ")
+	if algorithm != sigV4Algorithm {
+		return nil, errS3SignatureVersion
+	}
+	auth := &sigV4Auth{}
+	var credential, signedHeaders string
+	for _, field := range strings.Split(fields, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		switch name {
+		case "Credential":
+			credential = value
+		case "SignedHeaders":
+			signedHeaders = value
+		case "Signature":
+			auth.Signature = value
+		}
+	}
+	if err := auth.parse(credential, signedHeaders, r.Header.Get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+	auth.PayloadHash = r.Header.Get("X-Amz-Content-Sha256")
+	if len(auth.PayloadHash) == 0 {
+		return nil, s3Errorf(errS3InvalidRequest, "missing required header x-amz-content-sha256")
+	}
+	return auth, nil
+}
+
+// parseSigV4Query parses the signature of a presigned URL.
+func parseSigV4Query(q url.Values) (*sigV4Auth, error) {
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, errS3SignatureVersion
+	}
+	auth := &sigV4Auth{
+		Signature:   q.Get("X-Amz-Signature"),
+		Presigned:   true,
+		PayloadHash: unsignedPayload,
+	}
+	if err := auth.parse(q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Date")); err != nil {
+		return nil, err
+	}
+	seconds, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > sigV4MaxExpires {
+		return nil, s3Errorf(errS3AuthorizationQueryParametersError, "X-Amz-Expires must be between 0 and %d seconds", int(sigV4MaxExpires.Seconds()))
+	}
+	auth.Expires = time.Duration(seconds) * time.Second
+	if payloadHash := q.Get("X-Amz-Content-Sha256"); len(payloadHash) > 0 {
+		auth.PayloadHash = payloadHash
+	}
+	return auth, nil
+}
+
+// parse sets the fields shared by both kinds of signatures.
+func (a *sigV4Auth) parse(credential, signedHeaders, date string) error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || len(signedHeaders) == 0 || len(a.Signature) == 0 {
+		return s3Errorf(errS3AuthorizationHeaderMalformed, "malformed credential or signature")
+	}
+	a.AccessKey, a.Date, a.Region, a.Service = parts[0], parts[1], parts[2], parts[3]
+	a.SignedHeaders = strings.Split(signedHeaders, ";")
+	t, err := time.Parse(sigV4TimeFormat, date)
+	if err != nil {
+		return s3Errorf(errS3AccessDenied, "AWS authentication requires a valid x-amz-date")
+	}
+	if t.Format(sigV4DateFormat) != a.Date {
+		return s3Errorf(errS3AuthorizationHeaderMalformed, "credential date does not match x-amz-date")
+	}
+	a.Time = t
+	return nil
+}
+
+// sigV4CanonicalRequest returns the canonical form of r that is signed.
+func sigV4CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	query := r.URL.Query()
+	query.Del("X-Amz-Signature")
+
+	headers := new(strings.Builder)
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = r.Header.Get("Content-Length")
+			if len(value) == 0 && r.ContentLength >= 0 {
+				value = strconv.FormatInt(r.ContentLength, 10)
+			}
+		default:
+			values := r.Header.Values(name)
+			for i, v := range values {
+				values[i] = strings.Join(strings.Fields(v), " ")
+			}
+			value = strings.Join(values, ",")
+		}
+		fmt.Fprintf(headers, "%s:%s\n", name, value)
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		sigV4CanonicalQuery(query),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// sigV4CanonicalQuery returns the query sorted and encoded the way AWS signs it.
+func sigV4CanonicalQuery(q url.Values) string {
+	pairs := []string{}
+	for name, values := range q {
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(name, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent encodes every byte of s except the unreserved
+// characters of RFC 3986, and '/' unless encodeSlash is true.
+func awsURIEncode(s string, encodeSlash bool) string {
+	b := new(strings.Builder)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sigV4StringToSign returns the string signed for a canonical request.
+func sigV4StringToSign(t time.Time, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	return strings.Join([]string{
+		sigV4Algorithm,
+		t.Format(sigV4TimeFormat),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+}
+
+// sigV4SigningKey derives the key that signs requests of a day, region and service.
+func sigV4SigningKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sigV4Sign returns the hex signature of stringToSign.
+func sigV4Sign(signingKey []byte, stringToSign string) string {
+	return hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+}
+
+// errPayloadMismatch is returned when a body does not match the hash it was signed with.
+var errPayloadMismatch = errors.New("payload does not match its signed hash")
+
+// hashCheckReader fails with err at the end of r if the hash of r is not want.
+type hashCheckReader struct {
+	r    io.Reader
+	hash hash.Hash
+	want []byte
+	err  error
+}
+
+func newHashCheckReader(r io.Reader, hash hash.Hash, want []byte, err error) io.Reader {
+	return &hashCheckReader{r: r, hash: hash, want: want, err: err}
+}
+
+func (h *hashCheckReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(h.hash.Sum(nil), h.want) {
+		return n, h.err
+	}
+	return n, err
+}
+
+// chunkedPayloadReader decodes and verifies a body sent with
+// STREAMING-AWS4-HMAC-SHA256-PAYLOAD, where every chunk is
+// signed with the signature of the previous one.
+type chunkedPayloadReader struct {
+	r          *bufio.Reader
+	auth       *sigV4Auth
+	signingKey []byte
+	prevSig    string
+	buf        []byte
+	done       bool
+	// size is the decoded length announced by the client, or -1.
+	size int64
+	read int64
+}
+
+func newChunkedPayloadReader(r io.Reader, auth *sigV4Auth, signingKey []byte, size int64) io.Reader {
+	return &chunkedPayloadReader{
+		r:          bufio.NewReader(r),
+		auth:       auth,
+		signingKey: signingKey,
+		prevSig:    auth.Signature,
+		size:       size,
+	}
+}
+
+func (c *chunkedPayloadReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// next reads and verifies the next chunk.
+func (c *chunkedPayloadReader) next() error {
+	line, err := c.r.ReadSlice('\n')
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	hexSize, params, _ := strings.Cut(strings.TrimRight(string(line), "\r\n"), ";")
+	size, err := strconv.ParseInt(hexSize, 16, 64)
+	sig, ok := strings.CutPrefix(params, "chunk-signature=")
+	if err != nil || !ok || size < 0 || size > maxPayloadChunkSize {
+		return s3Errorf(errS3IncompleteBody, "malformed payload chunk")
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return unexpectedEOF(err)
+	}
+	if !bytes.HasSuffix(data, []byte("\r\n")) {
+		return s3Errorf(errS3IncompleteBody, "malformed payload chunk")
+	}
+	data = data[:size]
+
+	hash := sha256.Sum256(data)
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm + "-PAYLOAD",
+		c.auth.Time.Format(sigV4TimeFormat),
+		c.auth.scope(),
+		c.prevSig,
+		emptySHA256,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	if !hmac.Equal([]byte(sigV4Sign(c.signingKey, stringToSign)), []byte(sig)) {
+		return errS3SignatureDoesNotMatch
+	}
+	c.prevSig = sig
+	c.read += size
+	c.buf = data
+	if size == 0 {
+		c.done = true
+		if c.size >= 0 && c.read != c.size {
+			return s3Errorf(errS3IncompleteBody, "payload is %d bytes, %d were announced", c.read, c.size)
+		}
+	}
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
 	"strings"
 )
 
@@ -33,8 +37,9 @@ var DefaultPathTransformFunc = func(id, key, storageFolder string) *PathKey {
 }
 
 // CASPathTransformFunc is a PathTransformFunc that takes a key and returns a PathKey
-// with a pathname and filename derived from the hashed key.
-// This is used for a Content addressable file store.
+// with a pathname and filename derived from the hashed key. Chunks are
+// stored under the hash of their contents, see chunkNamespace, which
+// makes the store content addressable.
 func CASPathTransformFunc(id, key, storageFolder string) *PathKey {
 	hash := sha1.Sum([]byte(key))
 	hashStr := hex.EncodeToString(hash[:])
@@ -57,6 +62,9 @@ func CASPathTransformFunc(id, key, storageFolder string) *PathKey {
 type StoreOpts struct {
 	StorageFolder     string
 	PathTransformFunc PathTransformFunc
+	// VerifyReads makes Read check the contents of a file
+	// against its checksum, see verifyingReader.
+	VerifyReads bool
 }
 
 // DefaultStorageFolder is the name of the default storage folder
@@ -95,7 +103,16 @@ func (s *Store) Has(id, key string) bool {
 
 // Read reads the data from the file into an io Reader
 func (s *Store) Read(id, key string) (int64, io.Reader, error) {
-	return s.readSteam(id, key)
+	size, file, err := s.readSteam(id, key)
+	if err != nil || !s.VerifyReads {
+		return size, file, err
+	}
+	sum, err := s.checksum(id, key)
+	if err != nil {
+		file.Close()
+		return 0, nil, err
+	}
+	return size, newVerifyingReader(file, sum), nil
 }
 
 // readSteam returns the file refered to by the key
@@ -108,6 +125,7 @@ func (s *Store) readSteam(id, key string) (int64, io.ReadCloser, error) {
 	}
 	fi, err := file.Stat()
 	if err != nil {
+		file.Close()
 		return 0, nil, err
 	}
 	return fi.Size(), file, nil
@@ -118,15 +136,61 @@ func (s *Store) Write(id, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
 }
 
-// openWriteFile creates a new file using the provided key and returns it
+// tempFileMarker is part of the name of every file that is still being written.
+const tempFileMarker = ".tmp-"
+
+// openWriteFile creates a temporary file next to the file
+// refered to by the key and returns it.
+// The file only becomes visible under the key after commitWriteFile.
 func (s *Store) openWriteFile(id, key string) (*os.File, error) {
 	// Create the Folders
 	pathKey := s.TransFormPath(id, key)
 	if err := os.MkdirAll(pathKey.Path, os.ModePerm); err != nil {
 		return nil, err
 	}
-	// Open or Create the file
-	return os.Create(pathKey.AbsPath())
+	// Create the temporary file in the same directory so it can be renamed
+	return os.CreateTemp(pathKey.Path, "."+pathKey.Filename+tempFileMarker+"*")
+}
+
+// commitWriteFile flushes a file created by openWriteFile to disk and
+// atomically renames it to the file refered to by the key, then records
+// sum as its checksum. If err is not nil the temporary file is removed instead.
+func (s *Store) commitWriteFile(id, key string, f *os.File, sum []byte, err error) error {
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	pathKey := s.TransFormPath(id, key)
+	// The old checksum must not outlive the contents it was computed for,
+	// a file without a checksum is unverified rather than corrupt.
+	if err := os.Remove(checksumPath(pathKey)); err != nil && !os.IsNotExist(err) {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), pathKey.AbsPath()); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := s.writeChecksum(id, key, sum); err != nil {
+		return err
+	}
+	return syncDir(pathKey.Path)
+}
+
+// syncDir flushes a directory so a rename inside it survives a crash.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
 }
 
 // WriteDecrypt takes a key and an io.Reader
@@ -137,7 +201,9 @@ func (s *Store) WriteDecrypt(encKey []byte, id, key string, r io.Reader) (int64,
 	if err != nil {
 		return 0, err
 	}
-	return copyDecrypt(encKey, r, f)
+	hash := sha256.New()
+	n, err := copyDecrypt(encKey, r, io.MultiWriter(f, hash))
+	return n, s.commitWriteFile(id, key, f, hash.Sum(nil), err)
 }
 
 // writeStream takes a key and an io.Reader
@@ -148,16 +214,114 @@ func (s *Store) writeStream(id, key string, r io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	return io.Copy(f, r)
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), r)
+	return n, s.commitWriteFile(id, key, f, hash.Sum(nil), err)
+}
+
+// RemoveTempFiles removes the temporary files left behind by writes
+// that never completed, for example because the process crashed.
+// It must not be called while writes are in progress.
+func (s *Store) RemoveTempFiles() (int, error) {
+	removed := 0
+	err := filepath.WalkDir(s.StorageFolder, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == s.StorageFolder && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// isTempFile reports whether name is a file created by openWriteFile.
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempFileMarker)
 }
 
-// Delete deletes the file refered to by the key
+// Delete deletes the file refered to by the key and its checksum, and
+// then the directories of its path that are left empty. Other keys may
+// share these directories, so only empty ones are removed.
 func (s *Store) Delete(id, key string) error {
 	pathKey := s.TransFormPath(id, key)
-	return os.RemoveAll(pathKey.Root)
+	if len(pathKey.Root) == 0 {
+		return os.RemoveAll(pathKey.Path)
+	}
+	for _, path := range []string{pathKey.AbsPath(), checksumPath(pathKey)} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for dir := pathKey.Path; len(dir) >= len(pathKey.Root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// DeleteNamespace deletes every file stored in the id namespace.
+func (s *Store) DeleteNamespace(id string) error {
+	return os.RemoveAll(fmt.Sprintf("%s/%s", s.StorageFolder, id))
+}
+
+// Walk calls fn for every file stored in the id namespace.
+func (s *Store) Walk(id string, fn func(path string, d fs.DirEntry) error) error {
+	root := fmt.Sprintf("%s/%s", s.StorageFolder, id)
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || isTempFile(d.Name()) || isChecksumFile(d.Name()) {
+			return nil
+		}
+		return fn(path, d)
+	})
 }
 
 // Clear removes all the files in the storage folder
 func (s *Store) Clear() error {
 	return os.RemoveAll(s.StorageFolder)
 }
+
+// exactReader reads exactly n bytes from r. Unlike io.LimitReader it
+// fails with io.ErrUnexpectedEOF when r ends before n bytes were read,
+// so a dropped transfer is never mistaken for a complete one.
+type exactReader struct {
+	r io.Reader
+	n int64
+}
+
+func newExactReader(r io.Reader, n int64) io.Reader {
+	return &exactReader{r: r, n: n}
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.n {
+		p = p[:e.n]
+	}
+	n, err := e.r.Read(p)
+	e.n -= int64(n)
+	if err == io.EOF && e.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -72,4 +73,117 @@ func TestStoreDelete(t *testing.T) {
 	err := s.Delete(id(), key())
 	assert.Nil(t, err)
 	assert.EqualValues(t, false, s.Has(id(), key()))
+	_, err = os.Stat(s.TransFormPath(id(), key()).Root)
+	assert.True(t, os.IsNotExist(err))
+
+	// Keys sharing the directories of the deleted key are kept.
+	shared := NewStore(StoreOpts{
+		StorageFolder: t.TempDir(),
+		PathTransformFunc: func(id, key, storageFolder string) *PathKey {
+			root := storageFolder + "/" + id + "/shared"
+			return &PathKey{Path: root + "/" + key, Filename: key, Root: root}
+		},
+	})
+	for _, k := range []string{"a", "b"} {
+		_, err := shared.Write(id(), k, bytes.NewReader(data()))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, shared.Delete(id(), "a"))
+	assert.False(t, shared.Has(id(), "a"))
+	assert.True(t, shared.Has(id(), "b"))
+}
+
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestStoreWriteIsAtomic(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		StorageFolder:     t.TempDir(),
+	})
+	_, err := createTestData(s)
+	assert.Nil(t, err)
+
+	// A failed write leaves the previous contents in place.
+	r := &failingReader{r: bytes.NewReader([]byte("partial")), err: io.ErrUnexpectedEOF}
+	_, err = s.Write(id(), key(), r)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	_, f, err := s.Read(id(), key())
+	assert.Nil(t, err)
+	b, _ := io.ReadAll(f)
+	assert.Equal(t, data(), b)
+
+	// A truncated transfer never becomes visible.
+	_, err = s.Write(id(), "other", newExactReader(bytes.NewReader([]byte("short")), 10))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	assert.False(t, s.Has(id(), "other"))
+
+	n, err := s.RemoveTempFiles()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestStoreRemoveTempFiles(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		StorageFolder:     t.TempDir(),
+	})
+	_, err := createTestData(s)
+	assert.Nil(t, err)
+
+	// Simulate a crash in the middle of a write.
+	f, err := s.openWriteFile(id(), "crashed")
+	assert.Nil(t, err)
+	f.Write([]byte("half written"))
+	f.Close()
+	assert.False(t, s.Has(id(), "crashed"))
+
+	n, err := s.RemoveTempFiles()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	_, err = os.Stat(f.Name())
+	assert.True(t, os.IsNotExist(err))
+	assert.True(t, s.Has(id(), key()))
+}
+
+func TestStoreChecksums(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		StorageFolder:     t.TempDir(),
+		VerifyReads:       true,
+	})
+	_, err := createTestData(s)
+	assert.Nil(t, err)
+
+	sum, err := s.Checksum(id(), key())
+	assert.Nil(t, err)
+	assert.Len(t, sum, 64)
+	assert.Nil(t, s.Verify(id(), key()))
+
+	var walked []string
+	assert.Nil(t, s.WalkChecksums(func(id, key string) error {
+		walked = append(walked, id+"/"+key)
+		return nil
+	}))
+	assert.Equal(t, []string{id() + "/" + key()}, walked)
+
+	// Flip the contents on disk behind the store's back.
+	path := s.TransFormPath(id(), key()).AbsPath()
+	assert.Nil(t, os.WriteFile(path, []byte("jesuslovesmethisiknoW"), 0644))
+
+	assert.ErrorIs(t, s.Verify(id(), key()), ErrChecksumMismatch)
+	_, r, err := s.Read(id(), key())
+	assert.Nil(t, err)
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, ErrChecksumMismatch)
 }